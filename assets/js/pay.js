@@ -140,8 +140,9 @@ function getURLParameters() {
 
 
 // Check response status from the gateway, we then manipulate the payment flow
-// in Vend in response to this using the Payment API steps.
-function checkResponse(response) {
+// in Vend in response to this using the Payment API steps. deadline is set
+// while polling for the outcome of an UNKNOWN payment.
+function checkResponse(response, deadline) {
   var response = response;
   logger.info("Response From Server: " + response)
   switch (response.status) {
@@ -154,7 +155,12 @@ function checkResponse(response) {
             receiptHTML = `
             <div>
                 <h2>APPROVED</h2>
-                <span>Oxipay Purchase #: ` + response.id+ ` </span>
+                <span>Oxipay Purchase #: ` + response.id+ ` </span>`;
+            if (typeof(response.remaining) != 'undefined') {
+                receiptHTML += `
+                <span>Remaining to refund: ` + response.remaining + ` </span>`;
+            }
+            receiptHTML += `
             </div>`;
         }
       
@@ -196,6 +202,10 @@ function checkResponse(response) {
 
       setTimeout(declineStep, 4000,'<div>TIMEOUT</div>')
       break
+    case 'UNKNOWN':
+      // Oxipay may have processed the payment, keep waiting until we know
+      setTimeout(pollStatus, 2000, response.reference, deadline || Date.now() + pollTimeout)
+      break
     default:
       $('#statusMessage').empty()
       $.get('../assets/templates/failed.html', function (data) {
@@ -207,6 +217,122 @@ function checkResponse(response) {
   }
 }
 
+// pollTimeout is how long to wait for the outcome of a payment whose response
+// from Oxipay was lost. The gateway gives up replaying it after about 2.5
+// minutes and asks the cashier to check the Oxipay portal.
+var pollTimeout = 5 * 60 * 1000
+
+// pollStatus asks the gateway for the outcome of a payment whose response from
+// Oxipay was lost, checkResponse polls again while it is still UNKNOWN. The
+// payment is treated as timed out once the deadline has passed.
+function pollStatus(reference, deadline) {
+  var result = getURLParameters()
+
+  if (Date.now() > deadline) {
+    logger.error('Gave up waiting for the outcome of ' + reference)
+    pollTimedOut()
+    return
+  }
+
+  $.ajax({
+      url: '/pay/status',
+      type: 'GET',
+      dataType: 'json',
+      data: {
+        reference: reference,
+        origin: result.origin,
+        register_id: result.register_id
+      }
+    })
+    .done(function (response) {
+      logger.debug(response)
+      checkResponse(response, deadline)
+    })
+    .fail(function (error) {
+      logger.error(error)
+
+      // the payment is still being reconciled, so only give up if it's gone
+      // or the gateway hasn't answered by the deadline
+      if (error.status !== 404) {
+        setTimeout(pollStatus, 2000, reference, deadline)
+        return
+      }
+      pollTimedOut()
+    })
+}
+
+function pollTimedOut() {
+  $('#statusMessage').empty()
+  $.get('../assets/templates/timeout.html', function (data) {
+    $('#statusMessage').append(data)
+  })
+  setTimeout(declineStep, 4000, '<div>TIMEOUT</div>')
+}
+
+// Show how much is left to refund on the purchase number the cashier entered
+function refundBalance() {
+  var purchaseNumber = $('#purchaseno').val()
+  $('#remaining').empty()
+  if (!purchaseNumber) {
+    return
+  }
+
+  $.ajax({
+    url: '/refund/balance',
+    type: 'GET',
+    dataType: 'json',
+    data: { purchaseno: purchaseNumber }
+  })
+    .done(function (response) {
+      $('#remaining').text('Remaining to refund: ' + response.remaining)
+    })
+    .fail(function (error) {
+      logger.debug(error)
+      if (error.status === 404) {
+        $('#remaining').text('This purchase was not made through Vend, check the amount in the Oxipay portal')
+      }
+    })
+}
+
+// Find the Oxipay purchase for the sale being refunded so that the cashier
+// doesn't have to enter it. Sales that weren't paid through the proxy keep the
+// manual entry.
+function lookupPurchase() {
+  if (!inIframe()) {
+    return
+  }
+
+  var purchaseLookupListener = function (event) {
+    var result = getURLParameters()
+    if (event.origin !== result.origin) {
+      return false
+    }
+    window.removeEventListener('message', purchaseLookupListener, false)
+
+    var data = JSON.parse(event.data)
+    $.ajax({
+      url: '/refund/purchase',
+      type: 'GET',
+      dataType: 'json',
+      data: {
+        sale_id: data.register_sale.client_sale_id,
+        original_sale_id: data.register_sale.return_for
+      }
+    })
+      .done(function (response) {
+        $('#purchaseno').val(response.id)
+        $('#purchasenogroup').hide()
+        $('#remaining').text('Oxipay Purchase #: ' + response.id + ', remaining to refund: ' + response.remaining)
+      })
+      .fail(function (error) {
+        logger.debug(error)
+      })
+  }
+
+  window.addEventListener('message', purchaseLookupListener, false)
+  dataStep()
+}
+
 var refundDataResponseListener = function (event) {
     
     var result = getURLParameters()
@@ -227,6 +353,7 @@ var refundDataResponseListener = function (event) {
         amount: result.amount,
         origin: result.origin,
         sale_id: data.register_sale.client_sale_id,
+        original_sale_id: data.register_sale.return_for,
         register_id: result.register_id,
         purchaseno: $("#purchaseno").val()
     };
@@ -478,4 +605,9 @@ $(function () {
 
   // Show outcome buttons.
   $('#outcomes').show()
+
+  // refunds look up the purchase number rather than asking for it
+  if ($('#purchaseno').length) {
+    lookupPurchase()
+  }
 })
\ No newline at end of file
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/simulator"
+	logrus "github.com/sirupsen/logrus"
+)
+
+// devices collects repeated -device flags of the form <device id>=<signing key>
+type devices map[string]string
+
+func (d devices) String() string {
+	return ""
+}
+
+func (d devices) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return errors.New("expected <device id>=<signing key>")
+	}
+	d[parts[0]] = parts[1]
+	return nil
+}
+
+// A standalone Oxipay POS gateway simulator for demos and local development.
+// Point oxipay.gatewayurl at http://localhost:<port>/webapi/v1/
+func main() {
+	preRegistered := make(devices)
+
+	port := flag.String("port", "5050", "port to listen on")
+	registration := flag.String("registration", "SCRK01", "x_code returned by CreateKey")
+	authorisation := flag.String("authorisation", "SPRA01", "x_code returned by ProcessAuthorisation")
+	adjustment := flag.String("adjustment", "SPSA01", "x_code returned by ProcessSalesAdjustment")
+	delay := flag.Duration("delay", 0, "time to wait before answering each request")
+	malformed := flag.Bool("malformed", false, "answer every request with a body that is not JSON")
+	flag.Var(preRegistered, "device", "pre-registered device as <device id>=<signing key>, may be repeated")
+	flag.Parse()
+
+	log := logrus.New()
+	log.Formatter = &logrus.JSONFormatter{}
+	log.SetOutput(os.Stdout)
+	log.SetLevel(logrus.DebugLevel)
+
+	sim := simulator.New(log)
+	sim.SetDefault(simulator.EndpointCreateKey, simulator.Behaviour{Code: *registration, Delay: *delay, Malformed: *malformed})
+	sim.SetDefault(simulator.EndpointProcessAuthorisation, simulator.Behaviour{Code: *authorisation, Delay: *delay, Malformed: *malformed})
+	sim.SetDefault(simulator.EndpointProcessSalesAdjustment, simulator.Behaviour{Code: *adjustment, Delay: *delay, Malformed: *malformed})
+
+	for deviceID, key := range preRegistered {
+		sim.AddDevice(deviceID, key)
+	}
+
+	log.Infof("Starting Oxipay simulator on port %s \n", *port)
+	log.Fatal(http.ListenAndServe(":"+*port, sim))
+}
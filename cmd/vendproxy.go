@@ -1,28 +1,51 @@
 package main
 
 import (
+	"context"
 	_ "crypto/hmac"
+	"crypto/x509"
 	"database/sql"
 	"encoding/gob"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/sessions"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/oxipay/oxipay-vend/internal/pkg/admin"
+	"github.com/oxipay/oxipay-vend/internal/pkg/audit"
 	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+	"github.com/oxipay/oxipay-vend/internal/pkg/database"
+	"github.com/oxipay/oxipay-vend/internal/pkg/drain"
+	"github.com/oxipay/oxipay-vend/internal/pkg/health"
+	"github.com/oxipay/oxipay-vend/internal/pkg/keyring"
+	"github.com/oxipay/oxipay-vend/internal/pkg/metrics"
+	"github.com/oxipay/oxipay-vend/internal/pkg/migrate"
 	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
+	"github.com/oxipay/oxipay-vend/internal/pkg/region"
 	"github.com/oxipay/oxipay-vend/internal/pkg/terminal"
+	"github.com/oxipay/oxipay-vend/internal/pkg/transaction"
 	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+	"github.com/oxipay/oxipay-vend/internal/pkg/webhook"
 	logrus "github.com/sirupsen/logrus"
 	"github.com/srinathgs/mysqlstore"
 	shortid "github.com/ventu-io/go-shortid"
@@ -38,6 +61,9 @@ const (
 	statusUnknown   = "UNKNOWN"
 )
 
+// proxyUser is recorded as the creator or modifier of registers changed by the proxy
+const proxyUser = "vend-proxy"
+
 // Response We build a JSON response object that contains important information for
 // which step we should send back to Vend to guide the payment flow.
 type Response struct {
@@ -48,79 +74,619 @@ type Response struct {
 	Signature    string `json:"-"`
 	TrackingData string `json:"tracking_data,omitempty"`
 	Message      string `json:"message,omitempty"`
+	Reference    string `json:"reference,omitempty"` // used to poll /pay/status while the outcome is UNKNOWN
+	Remaining    string `json:"remaining,omitempty"` // amount left to refund on the purchase
 	HTTPStatus   int    `json:"-"`
 	file         string
 }
 
-// DbSessionStore is the database session storage manager
-var DbSessionStore *mysqlstore.MySQLStore
+// DbSessionStore is the session storage manager, sessions are stored in the
+// database when using MySQL and in a cookie otherwise
+var DbSessionStore sessions.Store
 
 var log *logrus.Logger
 
-var appConfig *config.HostConfig
+// configFile is the -config flag, see config.FilePath
+var configFile string
+
+// configFlags are the configuration values set on the command line
+var configFlags []config.Override
 
-var oxipayClient oxipay.Client
+// gateways holds the *region.Router that routes each request to the Oxipay
+// gateway for its country, it is replaced when the configuration is reloaded
+var gateways atomic.Value
+
+// regions returns the current router. Payments and refunds keep the region
+// they started with so a reload doesn't affect them.
+func regions() *region.Router {
+	return gateways.Load().(*region.Router)
+}
 
 var db *sql.DB
 
 var term *terminal.Terminal
 
+var ledger *transaction.Ledger
+
+// reconciler resolves payments whose response from Oxipay was lost
+var reconciler *transaction.Reconciler
+
+// payments collapses duplicate payment requests for the same Vend sale
+var payments = transaction.NewInFlight()
+
+// webhooks sends completed payments and refunds to the subscribers
+var webhooks *webhook.Dispatcher
+
+// adminConfig the credentials for the admin API and the register changes
+var adminConfig config.AdminConfig
+
+// auditLog records who registered, re-keyed, paid or refunded on which register
+var auditLog *audit.Log
+
+// trustedProxies may set the X-Forwarded-For address recorded for a request
+var trustedProxies audit.Proxies
+
+// inFlight tracks the payments and refunds that must finish before shutting down
+var inFlight = drain.NewGroup()
+
+// readyInterval is how often the health checks run until the proxy is ready
+const readyInterval = 2 * time.Second
+
+// pendingTimeout is how long an authorisation can wait on Oxipay before it is
+// treated as abandoned, for example the proxy that sent it was killed
+const pendingTimeout = 5 * time.Minute
+
+// templateDir holds the pages served by the proxy and loaded by pay.js, it is
+// set from the configuration by serve
+var templateDir = config.Defaults().Assets.TemplateDir()
+
+// templates must be on disk before the proxy is ready
+var templates = []string{
+	"cancelling.html",
+	"declined.html",
+	"failed.html",
+	"index.html",
+	"payment.html",
+	"refund.html",
+	"register.html",
+	"register_success.html",
+	"timeout.html",
+	"waiting.html",
+}
+
+// registrationType labels registrations in the metrics, they aren't recorded in the ledger
+const registrationType = "REGISTRATION"
+
+// defaultShutdownTimeout is used when webserver.shutdowntimeout is not configured
+const defaultShutdownTimeout = 30 * time.Second
+
+// command is a subcommand of vendproxy
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string) error
+}
+
+// commands are the subcommands, serve is run when none is given
+func commands() []command {
+	return []command{
+		{"serve", "serve", "start the webserver (default)", serve},
+		{"migrate", "migrate up|down|status", "apply, revert or list the database migrations", migrateCommand},
+		{"terminal", "terminal list|show|delete|rekey", "list, show or delete registers, or re-encrypt their signing keys", terminalCommand},
+		{"config", "config validate|sources", "check the configuration, or show where each value came from", configCommand},
+		{"sign", "sign -key KEY [-type TYPE] [FILE]", "compute the Oxipay signature of a JSON payload", signCommand},
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command]\n\nCommands:\n", os.Args[0])
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, c := range commands() {
+		fmt.Fprintf(w, "  %s\t%s\n", c.usage, c.summary)
+	}
+	w.Flush()
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+}
+
 func main() {
-	// default configuration file for prod
-	configurationFile := "/etc/vendproxy/vendproxy.json"
-	if os.Getenv("DEV") != "" {
-		// default configuration file for dev
-		configurationFile = "../configs/vendproxy.json"
+	rotateKeys := flag.Bool("rotate-keys", false, "deprecated, use terminal rekey")
+	flag.StringVar(&configFile, "config", "", "the configuration `file`, defaults to $"+config.PathEnv+" or "+config.DefaultPath)
+	// these override the configuration file and the environment
+	overrides := map[string]string{
+		"assets":    "assets.root",
+		"templates": "assets.templates",
+		"port":      "webserver.port",
+		"loglevel":  "loglevel",
 	}
+	flag.String("assets", "", "the `directory` served under /assets/, overrides assets.root")
+	flag.String("templates", "", "the `directory` of the page templates, overrides assets.templates")
+	flag.String("port", "", "the `port` to listen on, overrides webserver.port")
+	flag.String("loglevel", "", "the log `level`, overrides loglevel")
+	flag.Usage = usage
+	flag.Parse()
+
+	flag.Visit(func(f *flag.Flag) {
+		if key, ok := overrides[f.Name]; ok {
+			configFlags = append(configFlags, config.Override{Key: key, Value: f.Value.String()})
+		}
+	})
 
-	// load config
-	appConfig, err := config.ReadApplicationConfig(configurationFile)
-	if err != nil {
-		logrus.Fatal(err)
+	// until the configuration has been read
+	log = initLogger(logrus.InfoLevel)
+
+	args := flag.Args()
+	if *rotateKeys {
+		log.Warn("-rotate-keys is deprecated, use vendproxy terminal rekey")
+		args = []string{"terminal", "rekey"}
+	}
+
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
 	}
 
-	// init our logging framework
-	level, err := logrus.ParseLevel(appConfig.LogLevel)
+	for _, c := range commands() {
+		if c.name == name {
+			if err := c.run(args); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(flag.CommandLine.Output(), "Unknown command %s\n\n", name)
+	usage()
+	os.Exit(2)
+}
+
+// readConfig loads the configuration file and sets up logging at the
+// configured level
+func readConfig() (config.HostConfig, error) {
+	appConfig, err := config.ReadApplicationConfig(config.FilePath(configFile), configFlags...)
 	if err != nil {
-		logrus.Fatalf("Level %s is not a valid log level. Try setting 'info' in production ", level)
+		return appConfig, err
+	}
+	if err = config.Validate(appConfig, config.Dev()); err != nil {
+		return appConfig, err
 	}
 
+	// init our logging framework, Validate has checked the level
+	level, _ := logrus.ParseLevel(appConfig.LogLevel)
+
 	log = initLogger(level)
+	log.WithFields(logrus.Fields{
+		"module": "vendproxy",
+		"call":   "readConfig",
+	}).Infof("Read the configuration from %s", appConfig.File)
+
+	// values from the file and the defaults aren't worth logging
+	for _, key := range appConfig.Sources.Keys() {
+		if source := appConfig.Sources[key]; source == config.SourceEnv || source == config.SourceFlag {
+			log.WithFields(logrus.Fields{
+				"module": "vendproxy",
+				"call":   "readConfig",
+			}).Infof("%s is set by the %s", key, source)
+		}
+	}
+	return appConfig, nil
+}
+
+// readCommandConfig loads the configuration for a command other than serve,
+// logging to stderr so that the output of the command can be piped
+func readCommandConfig() (config.HostConfig, error) {
+	appConfig, err := readConfig()
+	log.SetOutput(os.Stderr)
+	return appConfig, err
+}
+
+// newTerminal returns the registers stored in the database, decrypting their
+// signing keys with the configured encryption keys
+func newTerminal(appConfig config.HostConfig, db *sql.DB) (*terminal.Terminal, error) {
+	registerStore, err := terminal.NewRegisterStore(database.Driver(appConfig.Database), db)
 	if err != nil {
-		log.Fatalf("Configuration Error: %s ", err)
+		return nil, err
+	}
+	t := terminal.NewTerminal(registerStore)
+
+	t.Keys, err = keyring.Load(appConfig.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("Encryption Error: %s ", err)
+	}
+	if t.Keys == nil {
+		log.Warn("No encryption keys are configured, device signing keys will be stored in plaintext")
+	}
+	return t, nil
+}
+
+// serve starts the webserver and blocks until it receives SIGTERM or SIGINT
+func serve(args []string) error {
+	appConfig, err := readConfig()
+	if err != nil {
+		return err
 	}
 
 	db = connectToDatabase(appConfig.Database)
 
-	DbSessionStore = initSessionStore(db, appConfig.Session)
+	migrator, err := migrate.NewMigrator(database.Driver(appConfig.Database), db)
+	if err != nil {
+		log.Fatalf("Configuration Error: %s ", err)
+	}
+	migrateOnStartup(migrator, appConfig.Database.Migrate)
+
+	DbSessionStore = initSessionStore(db, database.Driver(appConfig.Database), appConfig.Session)
+
+	// create an Oxipay Client for each region
+	clientOptions, err := oxipayOptions(appConfig.Oxipay)
+	if err != nil {
+		log.Fatalf("Configuration Error: %s ", err)
+	}
+	router, err := region.NewRouter(appConfig, log, clientOptions...)
+	if err != nil {
+		log.Fatalf("Configuration Error: %s ", err)
+	}
+	gateways.Store(router)
+
+	term, err = newTerminal(appConfig, db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	webhooks, err = webhook.FromConfig(appConfig.Webhooks, webhook.NewQueue(database.Driver(appConfig.Database), db), log)
+	if err != nil {
+		log.Fatalf("Configuration Error: %s ", err)
+	}
+	webhooks.Start()
 
-	// create a reference to the Oxipay Client
-	oxipayClient = oxipay.NewOxipay(
-		appConfig.Oxipay.GatewayURL,
-		appConfig.Oxipay.Version,
-		log,
-	)
+	auditLog = audit.NewLog(database.Driver(appConfig.Database), db)
+	trustedProxies, err = audit.ParseProxies(appConfig.Webserver.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Configuration Error: %s ", err)
+	}
 
-	term = terminal.NewTerminal(db)
+	ledger = transaction.NewLedger(database.Driver(appConfig.Database), db)
+	ledger.OnComplete = webhooks.Publish
+	reconciler = transaction.NewReconciler(ledger, log)
 
-	// We are hosting all of the content in ./assets, as the resources are
-	// required by the frontend.
-	fileServer := http.FileServer(http.Dir("../assets"))
+	// We are hosting all of the content in the assets directory, as the
+	// resources are required by the frontend.
+	templateDir = appConfig.Assets.TemplateDir()
+	fileServer := http.FileServer(http.Dir(appConfig.Assets.Root))
 	http.Handle("/assets/", http.StripPrefix("/assets/", fileServer))
 	http.HandleFunc("/", Index)
-	http.HandleFunc("/pay", PaymentHandler)
-	http.HandleFunc("/register", RegisterHandler)
-	http.HandleFunc("/refund", RefundHandler)
+	http.HandleFunc("/pay", drainable(audited(audit.ActionPay, PaymentHandler)))
+	http.HandleFunc("/pay/status", PaymentStatusHandler)
+	http.Handle("/metrics", metrics.Handler())
+	http.HandleFunc("/register", audited(audit.ActionRegister, RegisterHandler))
+	http.HandleFunc("/register/rekey", adminOnly(audited(audit.ActionRekey, RekeyHandler)))
+	http.HandleFunc("/register/deactivate", adminOnly(audited(audit.ActionDeactivate, DeactivateHandler)))
+	http.HandleFunc("/register/delete", adminOnly(audited(audit.ActionDelete, DeleteRegisterHandler)))
+	http.HandleFunc("/refund", drainable(audited(audit.ActionRefund, RefundHandler)))
+	http.HandleFunc("/refund/balance", RefundBalanceHandler)
+	http.HandleFunc("/refund/purchase", RefundPurchaseHandler)
+
+	adminConfig = appConfig.Admin
+	if appConfig.Admin.Password != "" {
+		http.Handle("/admin/", admin.NewHandler(term, auditLog, appConfig.Admin, log))
+	} else {
+		log.Info("Admin API disabled, no admin password is configured")
+	}
 
 	// The default port is 500, but one can be specified as an env var if needed.
 	port := appConfig.Webserver.Port
 
-	log.Infof("Starting webserver on port %s \n", port)
+	shutdownTimeout := defaultShutdownTimeout
+	if appConfig.Webserver.ShutdownTimeout != "" {
+		shutdownTimeout, err = time.ParseDuration(appConfig.Webserver.ShutdownTimeout)
+		if err != nil {
+			log.Fatalf("Configuration Error: webserver.shutdowntimeout %s", err)
+		}
+	}
+
+	checker := newHealthChecker(db, appConfig)
+	http.HandleFunc("/healthz", health.LiveHandler)
+	http.HandleFunc("/readyz", checker.ReadyHandler)
+
+	// everything apart from the probes is refused until the proxy is ready
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: checker.Gate(http.DefaultServeMux, "/healthz", "/readyz", "/metrics"),
+	}
+
+	go func() {
+		checker.WaitUntilReady(context.Background(), readyInterval)
+		log.Info("Ready to serve")
+	}()
+
+	go func() {
+		log.Infof("Starting webserver on port %s \n", port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// the configuration is reloaded on SIGHUP or when the file changes
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	stopWatching := make(chan struct{})
+	err = config.Watch(appConfig.File, stopWatching, func() {
+		select {
+		case reloads <- syscall.SIGHUP:
+		default:
+			// a reload is already pending
+		}
+	})
+	if err != nil {
+		log.Warnf("Unable to watch %s for changes, send SIGHUP to reload the configuration: %s", appConfig.File, err)
+	}
+	go func() {
+		for range reloads {
+			appConfig = reload(appConfig)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-stop
+
+	log.Infof("Received %s, shutting down", sig)
+	signal.Stop(reloads)
+	close(stopWatching)
+	shutdown(server, shutdownTimeout)
+	return nil
+}
+
+// reload reads the configuration again and swaps in the log level and the
+// gateway clients, returning the configuration in use. A configuration that
+// fails validation is logged and the current one is kept. Payments and
+// refunds in flight finish with the client they started with.
+func reload(current config.HostConfig) config.HostConfig {
+	logger := log.WithFields(logrus.Fields{
+		"module": "vendproxy",
+		"call":   "reload",
+	})
+
+	next, err := config.ReadApplicationConfig(current.File, configFlags...)
+	if err == nil {
+		err = config.Validate(next, config.Dev())
+	}
+	var router *region.Router
+	if err == nil {
+		var clientOptions []oxipay.Option
+		if clientOptions, err = oxipayOptions(next.Oxipay); err == nil {
+			router, err = region.NewRouter(next, log, clientOptions...)
+		}
+	}
+	if err != nil {
+		logger.Errorf("Keeping the current configuration, the reloaded configuration is invalid: %s", err)
+		return current
+	}
+
+	// the rest of the configuration is only read on startup
+	restart := []struct {
+		key             string
+		current, reload interface{}
+	}{
+		{"webserver", current.Webserver, next.Webserver},
+		{"database", current.Database, next.Database},
+		{"session", current.Session, next.Session},
+		{"admin", current.Admin, next.Admin},
+		{"encryption", current.Encryption, next.Encryption},
+		{"webhooks", current.Webhooks, next.Webhooks},
+		{"assets", current.Assets, next.Assets},
+	}
+	for _, r := range restart {
+		if !reflect.DeepEqual(r.current, r.reload) {
+			logger.Warnf("%s has changed, restart the proxy to apply it", r.key)
+		}
+	}
+
+	level, _ := logrus.ParseLevel(next.LogLevel)
+	replaced := regions()
+	gateways.Store(router)
+	log.SetLevel(level)
+
+	// the replaced clients are no longer used once their requests in flight
+	// complete, don't leave their connections open
+	replaced.CloseIdleConnections()
+
+	logger.Infof("Reloaded the configuration from %s", next.File)
+	return next
+}
+
+// shutdown stops accepting new requests and waits up to timeout for in-flight
+// payments and refunds to complete before closing the session store and the
+// database
+func shutdown(server *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// stop new payments first, the gateway calls already in-flight need the
+	// database to record the result
+	if err := inFlight.Drain(ctx); err != nil {
+		log.Errorf("Timed out waiting for in-flight payments and refunds, results may not have been recorded: %s", err)
+	}
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("Unable to shutdown the webserver cleanly: %s", err)
+	}
+
+	if err := reconciler.Stop(ctx); err != nil {
+		log.Errorf("Timed out waiting for payments to be reconciled: %s", err)
+	}
+
+	// undelivered events stay queued until the next start
+	if err := webhooks.Stop(ctx); err != nil {
+		log.Errorf("Timed out waiting for webhooks to be delivered: %s", err)
+	}
+
+	if store, ok := DbSessionStore.(interface{ Close() }); ok {
+		store.Close()
+	}
+	if err := db.Close(); err != nil {
+		log.Error(err)
+	}
+	log.Info("Shutdown complete")
+}
+
+// drainable tracks requests that call the Oxipay gateway, so that a shutdown
+// waits for them, and refuses new ones once the shutdown has started
+func drainable(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !inFlight.Acquire() {
+			w.Header().Set("Retry-After", "5")
+			sendResponse(w, r, &Response{
+				Status:     statusFailed,
+				Message:    "The payment service is restarting, please try again",
+				HTTPStatus: http.StatusServiceUnavailable,
+			})
+			return
+		}
+		defer inFlight.Release()
+
+		handler(w, r)
+	}
+}
+
+// auditContextKey holds the outcome of an audited request, set by sendResponse
+type auditContextKey struct{}
+
+// principalContextKey holds the username authenticated by adminOnly
+type principalContextKey struct{}
+
+// anonymous is the audit actor of requests without credentials, Vend opens
+// the payment and register pages so they only carry the origin it claims
+const anonymous = "anonymous"
+
+// statusRecorder keeps the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// audited records the action in the audit log once the handler has responded.
+// GET requests only display the form, so they aren't recorded. A failure to
+// record is logged rather than failing the request, which may already have
+// been processed by Oxipay.
+func audited(action string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			handler(w, r)
+			return
+		}
+
+		outcome := new(string)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		r = r.WithContext(context.WithValue(r.Context(), auditContextKey{}, outcome))
+
+		handler(recorder, r)
+
+		if *outcome == "" {
+			*outcome = fmt.Sprintf("%d %s", recorder.status, http.StatusText(recorder.status))
+		}
+
+		details := audit.Redact(r.Form)
+		entry := &audit.Entry{
+			Actor:          anonymous,
+			Action:         action,
+			VendRegisterID: r.Form.Get("register_id"),
+			Outcome:        *outcome,
+			ClientIP:       trustedProxies.ClientIP(r),
+		}
+		if principal, ok := r.Context().Value(principalContextKey{}).(string); ok {
+			entry.Actor = principal
+		}
+		if details["origin"] == "" || entry.VendRegisterID == "" {
+			// the register pages and refunds take the register from the session
+			if vReq, err := getPaymentRequestFromSession(r); err == nil {
+				details["origin"] = vReq.Origin
+				entry.VendRegisterID = vReq.RegisterID
+			}
+		}
+		entry.Details = audit.NewDetails(details)
+
+		if err := auditLog.Record(entry); err != nil {
+			log.WithFields(logrus.Fields{
+				"module": "vendproxy",
+				"call":   "audited",
+				"action": action,
+			}).Errorf("Unable to record the audit entry: %s", err)
+		}
+	}
+}
 
-	//defer sessionStore.Close()
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+// adminOnly requires the admin credentials and passes the username on to the
+// handler. Index puts whatever register it is given in the session, so the
+// session can't authorise changes to an existing register.
+func adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, ok := admin.Authenticate(adminConfig, r)
+		if !ok {
+			log.WithFields(logrus.Fields{
+				"module": "vendproxy",
+				"call":   "adminOnly",
+				"remote": r.RemoteAddr,
+				"path":   r.URL.Path,
+			}).Warn("Register change authentication failed")
+
+			w.Header().Set("WWW-Authenticate", `Basic realm="vendproxy admin"`)
+			sendResponse(w, r, &Response{
+				Status:     statusFailed,
+				Message:    "Unauthorized",
+				HTTPStatus: http.StatusUnauthorized,
+			})
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), principalContextKey{}, username)))
+	}
+}
+
+// newHealthChecker checks the dependencies needed to take payments
+func newHealthChecker(db *sql.DB, hostConfig config.HostConfig) *health.Checker {
+	checker := health.NewChecker(log)
+
+	checker.Add("database", db.PingContext)
 
-	// @todo handle shutdowns
+	if database.Driver(hostConfig.Database) == database.DriverMySQL {
+		checker.Add("sessions", func(ctx context.Context) error {
+			rows, err := db.QueryContext(ctx, "SELECT 1 FROM sessions LIMIT 1")
+			if err != nil {
+				return err
+			}
+			return rows.Close()
+		})
+	}
+
+	checker.Add("gateway", func(ctx context.Context) error {
+		for name, profile := range hostConfig.GatewayRegions() {
+			gatewayURL, err := url.Parse(profile.GatewayURL)
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+			if _, err = net.DefaultResolver.LookupHost(ctx, gatewayURL.Hostname()); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		}
+		return nil
+	})
+
+	checker.Add("templates", func(ctx context.Context) error {
+		for _, template := range templates {
+			if _, err := os.Stat(filepath.Join(templateDir, template)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return checker
 }
 
 func initLogger(logLevel logrus.Level) *logrus.Logger {
@@ -136,15 +702,9 @@ func initLogger(logLevel logrus.Level) *logrus.Logger {
 	return logger
 }
 
-func initSessionStore(db *sql.DB, sessionConfig config.SessionConfig) *mysqlstore.MySQLStore {
-
-	// @todo support multiple keys from the config so that key rotation is possible
-	store, err := mysqlstore.NewMySQLStoreFromConnection(db, "sessions", "/", 3600, []byte(sessionConfig.Secret))
-	if err != nil {
-		log.Warn(err)
-	}
+func initSessionStore(db *sql.DB, driver string, sessionConfig config.SessionConfig) sessions.Store {
 
-	store.Options = &sessions.Options{
+	options := &sessions.Options{
 		Domain:   sessionConfig.Domain,
 		Path:     sessionConfig.Path,
 		MaxAge:   sessionConfig.MaxAge,   // 8 hours
@@ -153,25 +713,37 @@ func initSessionStore(db *sql.DB, sessionConfig config.SessionConfig) *mysqlstor
 
 	// register the type VendPaymentRequest so that we can use it later in the session
 	gob.Register(&vend.PaymentRequest{})
+
+	// sessions are signed with the newest key pair, older pairs keep existing
+	// sessions valid until they expire
+	keyPairs, err := sessionConfig.KeyPairs()
+	if err != nil {
+		log.Fatalf("Configuration Error: %s ", err)
+	}
+
+	if driver != database.DriverMySQL {
+		// mysqlstore only supports MySQL, the payment request is small enough
+		// to be kept in the cookie instead
+		store := sessions.NewCookieStore(keyPairs...)
+		store.Options = options
+		return store
+	}
+
+	store, err := mysqlstore.NewMySQLStoreFromConnection(db, "sessions", "/", 3600, keyPairs...)
+	if err != nil {
+		log.Warn(err)
+	}
+
+	store.Options = options
 	return store
 }
 
 func connectToDatabase(params config.DbConnection) *sql.DB {
 
-	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true&loc=Local&timeout=%s",
-		params.Username,
-		params.Password,
-		params.Host,
-		params.Name,
-		params.Timeout,
-	)
-
-	log.Infof("Attempting to connect to database %s\n", dsn)
+	log.Infof("Attempting to connect to %s database %s on %s\n", database.Driver(params), params.Name, params.Host)
 
 	// connect to the database
-	// @todo grab config
-
-	db, err := sql.Open("mysql", dsn)
+	db, err := database.Open(params)
 
 	if err != nil {
 		log.Error("Unable to connect")
@@ -180,10 +752,10 @@ func connectToDatabase(params config.DbConnection) *sql.DB {
 
 	err = retry(30, time.Duration(10), db.Ping)
 
-	// test to make sure it's all good
+	// test to make sure it's all good, /readyz keeps checking if it isn't
 	if err != nil {
-		log.Errorf("Unable to connect to database: %s on %s", params.Name, params.Host)
-		log.Warn(err)
+		log.Errorf("Unable to connect to database: %s on %s: %s", params.Name, params.Host, err)
+		return db
 	}
 
 	log.Info("Database Connected")
@@ -191,6 +763,401 @@ func connectToDatabase(params config.DbConnection) *sql.DB {
 	return db
 }
 
+// migrateOnStartup applies the pending migrations when database.migrate is
+// set, otherwise it warns about them so that a database left behind by a
+// deployment is noticed
+func migrateOnStartup(migrator *migrate.Migrator, apply bool) {
+	if apply {
+		applied, err := migrator.Up()
+		for _, m := range applied {
+			log.Infof("Applied migration %04d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatalf("Database Error: %s ", err)
+		}
+		return
+	}
+
+	pending, err := migrator.Pending()
+	if err != nil {
+		log.Errorf("Unable to check the database migrations: %s", err)
+		return
+	}
+	for _, m := range pending {
+		log.Warnf("Migration %04d_%s has not been applied, run vendproxy migrate up", m.Version, m.Name)
+	}
+}
+
+// migrateCommand applies, reverts or lists the database migrations
+func migrateCommand(args []string) error {
+	appConfig, err := readCommandConfig()
+	if err != nil {
+		return err
+	}
+
+	db = connectToDatabase(appConfig.Database)
+	defer db.Close()
+
+	migrator, err := migrate.NewMigrator(database.Driver(appConfig.Database), db)
+	if err != nil {
+		return err
+	}
+	return runMigrate(migrator, strings.Join(args, " "))
+}
+
+// runMigrate runs the migrate up|down|status command
+func runMigrate(migrator *migrate.Migrator, command string) error {
+	switch command {
+	case "up":
+		applied, err := migrator.Up()
+		for _, m := range applied {
+			fmt.Printf("Applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("The database is up to date")
+		}
+		return err
+	case "down":
+		reverted, err := migrator.Down()
+		if err == nil && reverted == nil {
+			fmt.Println("No migrations have been applied")
+		} else if err == nil {
+			fmt.Printf("Reverted %04d_%s\n", reverted.Version, reverted.Name)
+		}
+		return err
+	case "status", "":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, s := range statuses {
+			applied := "pending"
+			if s.Applied {
+				applied = s.AppliedDate.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return w.Flush()
+	}
+	return fmt.Errorf("Unknown migrate command %s, expected up, down or status", command)
+}
+
+// terminalCommand lists, shows or deletes registers or re-encrypts their
+// signing keys, so that a register can be checked without writing SQL
+func terminalCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("Expected terminal list|show|delete|rekey")
+	}
+
+	appConfig, err := readCommandConfig()
+	if err != nil {
+		return err
+	}
+
+	db = connectToDatabase(appConfig.Database)
+	defer db.Close()
+
+	term, err = newTerminal(appConfig, db)
+	if err != nil {
+		return err
+	}
+	auditLog = audit.NewLog(database.Driver(appConfig.Database), db)
+
+	return runTerminal(os.Stdout, args[0], args[1:])
+}
+
+// runTerminal runs the terminal list|show|delete|rekey command against term.
+// Signing keys are never written out.
+func runTerminal(out io.Writer, command string, args []string) error {
+	switch command {
+	case "list":
+		flags := flag.NewFlagSet("terminal list", flag.ContinueOnError)
+		filter := terminal.Filter{}
+		flags.StringVar(&filter.OriginDomain, "origin", "", "Vend origin, e.g. https://example.vendhq.com")
+		flags.StringVar(&filter.FxlSellerID, "merchant", "", "Oxipay merchant ID")
+		flags.StringVar(&filter.VendRegisterID, "register", "", "Vend register ID")
+		flags.IntVar(&filter.Limit, "limit", 50, "maximum number of registers, 0 for all of them")
+		flags.IntVar(&filter.Offset, "offset", 0, "number of registers to skip")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+
+		registers, err := term.List(filter)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tORIGIN\tVEND REGISTER\tDEVICE\tMERCHANT\tREGION\tACTIVE")
+		for _, r := range registers {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%t\n", r.ID, r.Origin, r.VendRegisterID, r.FxlRegisterID, r.FxlSellerID, r.Region, r.Active)
+		}
+		return w.Flush()
+	case "show":
+		register, err := registerArg(args)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "ID\t%d\n", register.ID)
+		fmt.Fprintf(w, "Origin\t%s\n", register.Origin)
+		fmt.Fprintf(w, "Vend Register\t%s\n", register.VendRegisterID)
+		fmt.Fprintf(w, "Device\t%s\n", register.FxlRegisterID)
+		fmt.Fprintf(w, "Merchant\t%s\n", register.FxlSellerID)
+		fmt.Fprintf(w, "Region\t%s\n", register.Region)
+		fmt.Fprintf(w, "Active\t%t\n", register.Active)
+		fmt.Fprintf(w, "Key Version\t%d\n", register.KeyVersion)
+		fmt.Fprintf(w, "Created\t%s by %s\n", register.CreatedDate.Format(time.RFC3339), register.CreatedBy)
+		if !register.ModifiedDate.IsZero() {
+			fmt.Fprintf(w, "Modified\t%s by %s\n", register.ModifiedDate.Format(time.RFC3339), register.ModifiedBy)
+		}
+		return w.Flush()
+	case "delete":
+		register, err := registerArg(args)
+		if err != nil {
+			return err
+		}
+		deleted, err := term.Delete(register.Origin, register.VendRegisterID)
+		if err != nil {
+			return err
+		}
+
+		entry := &audit.Entry{
+			Actor:          "vendproxy terminal delete",
+			Action:         audit.ActionDelete,
+			VendRegisterID: register.VendRegisterID,
+			Outcome:        statusAccepted,
+		}
+		if user := os.Getenv("USER"); user != "" {
+			entry.Actor += " (" + user + ")"
+		}
+		if !deleted {
+			entry.Outcome = statusFailed
+		}
+		if err = auditLog.Record(entry); err != nil {
+			log.Errorf("Unable to record the audit entry: %s", err)
+		}
+
+		if !deleted {
+			return fmt.Errorf("Register %d was not deleted", register.ID)
+		}
+		fmt.Fprintf(out, "Deleted register %d, %s %s\n", register.ID, register.Origin, register.VendRegisterID)
+		return nil
+	case "rekey":
+		rotated, err := term.RotateKeys()
+		if err != nil {
+			return fmt.Errorf("Unable to rotate signing keys after %d registers: %s", rotated, err)
+		}
+		fmt.Fprintf(out, "Re-encrypted %d signing keys with key version %d\n", rotated, term.Keys.Current())
+		return nil
+	}
+	return fmt.Errorf("Unknown terminal command %s, expected list, show, delete or rekey", command)
+}
+
+// registerArg returns the register with the ID in the first argument
+func registerArg(args []string) (*terminal.Register, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Expected the ID of a register, see terminal list")
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a register ID", args[0])
+	}
+	return term.GetByID(id)
+}
+
+// configCommand checks the configuration file without starting the proxy
+func configCommand(args []string) error {
+	if len(args) != 1 || (args[0] != "validate" && args[0] != "sources") {
+		return errors.New("Expected config validate or config sources")
+	}
+
+	appConfig, err := readCommandConfig()
+	if err != nil {
+		return err
+	}
+	if args[0] == "sources" {
+		// the values aren't printed as they include secrets
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tSOURCE")
+		for _, key := range appConfig.Sources.Keys() {
+			fmt.Fprintf(w, "%s\t%s\n", key, appConfig.Sources[key])
+		}
+		return w.Flush()
+	}
+	if err = validateConfig(appConfig); err != nil {
+		return err
+	}
+	fmt.Println("The configuration is valid")
+	return nil
+}
+
+// oxipayOptions converts the Oxipay configuration into client options, and
+// records the latency and errors of requests to the gateway
+func oxipayOptions(oxipayConfig config.OxipayConfig) ([]oxipay.Option, error) {
+	options := []oxipay.Option{oxipay.WithObserver(observeGateway)}
+
+	durations := []struct {
+		name   string
+		value  string
+		option func(time.Duration) oxipay.Option
+	}{
+		{"oxipay.connecttimeout", oxipayConfig.ConnectTimeout, oxipay.WithConnectTimeout},
+		{"oxipay.timeout", oxipayConfig.Timeout, oxipay.WithTimeout},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid duration: %s", d.name, err)
+		}
+		options = append(options, d.option(duration))
+	}
+
+	if oxipayConfig.MaxIdleConns > 0 {
+		options = append(options, oxipay.WithMaxIdleConns(oxipayConfig.MaxIdleConns))
+	}
+
+	if oxipayConfig.CAFile != "" {
+		pem, err := ioutil.ReadFile(oxipayConfig.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("oxipay.cafile %s doesn't contain any PEM certificates", oxipayConfig.CAFile)
+		}
+		options = append(options, oxipay.WithRootCAs(pool))
+	}
+
+	if oxipayConfig.Proxy != "" {
+		proxy, err := url.Parse(oxipayConfig.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("oxipay.proxy is not a valid URL: %s", err)
+		}
+		options = append(options, oxipay.WithProxy(proxy))
+	}
+
+	if oxipayConfig.Retries > 0 {
+		policy := oxipay.RetryPolicy{Attempts: oxipayConfig.Retries + 1}
+		if oxipayConfig.RetryBackoff != "" {
+			backoff, err := time.ParseDuration(oxipayConfig.RetryBackoff)
+			if err != nil {
+				return nil, fmt.Errorf("oxipay.retrybackoff is not a valid duration: %s", err)
+			}
+			policy.Backoff = backoff
+		}
+		options = append(options, oxipay.WithRetry(policy))
+	}
+
+	return options, nil
+}
+
+// observeGateway records each request to the gateway in the metrics
+func observeGateway(endpoint string, elapsed time.Duration, err error) {
+	metrics.GatewayLatency.WithLabelValues(endpoint).Observe(elapsed.Seconds())
+	if err != nil {
+		metrics.GatewayErrors.WithLabelValues(endpoint).Inc()
+	}
+}
+
+// validateConfig makes the checks that serve makes on startup, without
+// connecting to the database or the gateway, and returns every problem found.
+// readConfig has already run config.Validate.
+func validateConfig(appConfig config.HostConfig) error {
+	var errs config.Errors
+	if _, err := database.DSN(appConfig.Database); err != nil {
+		errs = append(errs, err)
+	}
+	clientOptions, err := oxipayOptions(appConfig.Oxipay)
+	if err != nil {
+		errs = append(errs, err)
+	} else if _, err = region.NewRouter(appConfig, log, clientOptions...); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err = keyring.Load(appConfig.Encryption); err != nil {
+		errs = append(errs, fmt.Errorf("Encryption Error: %s ", err))
+	}
+	if _, err = webhook.FromConfig(appConfig.Webhooks, nil, log); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// signCommand computes the Oxipay signature of a JSON payload read from a file
+// or stdin
+func signCommand(args []string) error {
+	flags := flag.NewFlagSet("sign", flag.ContinueOnError)
+	key := flags.String("key", "", "device signing key")
+	payloadType := flags.String("type", "authorisation", "authorisation, adjustment, registration or response")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *key == "" {
+		return errors.New("sign needs the device signing key, -key")
+	}
+
+	in := io.Reader(os.Stdin)
+	if flags.NArg() > 0 {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	return sign(in, os.Stdout, *key, *payloadType)
+}
+
+// sign writes the plain text and signature of the payload, and whether it
+// matches the signature already in the payload
+func sign(in io.Reader, out io.Writer, key string, payloadType string) error {
+	var payload interface{}
+	var signature *string
+
+	switch payloadType {
+	case "authorisation":
+		p := new(oxipay.AuthorisationPayload)
+		payload, signature = p, &p.Signature
+	case "adjustment":
+		p := new(oxipay.SalesAdjustmentPayload)
+		payload, signature = p, &p.Signature
+	case "registration":
+		p := new(oxipay.RegistrationPayload)
+		payload, signature = p, &p.Signature
+	case "response":
+		p := new(oxipay.Response)
+		payload, signature = p, &p.Signature
+	default:
+		return fmt.Errorf("Unknown payload type %s, expected authorisation, adjustment, registration or response", payloadType)
+	}
+
+	if err := json.NewDecoder(in).Decode(payload); err != nil {
+		return fmt.Errorf("Unable to read the %s payload: %s", payloadType, err)
+	}
+
+	plainText := oxipay.GeneratePlainTextSignature(payload)
+	expected := oxipay.SignMessage(plainText, key)
+	fmt.Fprintf(out, "Plain text: %s\n", plainText)
+	fmt.Fprintf(out, "Signature:  %s\n", expected)
+
+	switch *signature {
+	case "":
+	case expected:
+		fmt.Fprintln(out, "The signature in the payload matches")
+	default:
+		fmt.Fprintf(out, "The signature in the payload does not match: %s\n", *signature)
+	}
+	return nil
+}
+
 func retry(attempts int, sleep time.Duration, f func() error) error {
 	log.Info("Attempting DB connection")
 	if err := f(); err != nil {
@@ -234,102 +1201,229 @@ func getPaymentRequestFromSession(r *http.Request) (*vend.PaymentRequest, error)
 	return vendPaymentRequest, err
 }
 
-func getSession(r *http.Request, sessionName string) (*sessions.Session, error) {
-	if DbSessionStore == nil {
-		log.Error("Can't get session store")
-		return nil, errors.New("Can't get session store")
+// modifiedBy is the user recorded against a register change, the username
+// authenticated by adminOnly or the proxy itself
+func modifiedBy(r *http.Request) string {
+	if principal, ok := r.Context().Value(principalContextKey{}).(string); ok {
+		return principal
+	}
+	return proxyUser
+}
+
+// getRegisterFromForm returns the register named by the origin and
+// register_id of the form
+func getRegisterFromForm(r *http.Request) (*vend.PaymentRequest, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	vendPaymentRequest := &vend.PaymentRequest{
+		Origin:     r.Form.Get("origin"),
+		RegisterID: r.Form.Get("register_id"),
+	}
+	if vendPaymentRequest.Origin == "" || vendPaymentRequest.RegisterID == "" {
+		return nil, errors.New("The origin and register_id of the register are required")
+	}
+	return vendPaymentRequest, nil
+}
+
+func getSession(r *http.Request, sessionName string) (*sessions.Session, error) {
+	if DbSessionStore == nil {
+		log.Error("Can't get session store")
+		return nil, errors.New("Can't get session store")
+	}
+
+	// ensure that we have a session
+	session, err := DbSessionStore.Get(r, sessionName)
+	if err != nil {
+		return session, err
+	}
+	return session, nil
+}
+
+// RegisterHandler GET request. Prompt for the Merchant ID and Device Token
+func RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	browserResponse := &Response{}
+	switch r.Method {
+	case http.MethodPost:
+		browserResponse = registerDevice(r, getPaymentRequestFromSession, term.Save)
+	default:
+		browserResponse.HTTPStatus = http.StatusOK
+		browserResponse.file = filepath.Join(templateDir, "register.html")
+	}
+
+	log.Print(browserResponse.Message)
+	sendResponse(w, r, browserResponse)
+	return
+}
+
+// RekeyHandler registers the Vend register with Oxipay again using a new
+// Device Token and replaces the signing key of the existing registration
+func RekeyHandler(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	browserResponse := &Response{}
+	switch r.Method {
+	case http.MethodPost:
+		browserResponse = registerDevice(r, getRegisterFromForm, term.Update)
+	default:
+		browserResponse.HTTPStatus = http.StatusMethodNotAllowed
+		browserResponse.Message = "Method not allowed"
+	}
+
+	log.Print(browserResponse.Message)
+	sendResponse(w, r, browserResponse)
+	return
+}
+
+// DeactivateHandler stops the Vend register in the form from processing
+// payments without removing its registration
+func DeactivateHandler(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	browserResponse := changeRegister(r, func(vReq *vend.PaymentRequest) (bool, error) {
+		return term.Deactivate(modifiedBy(r), vReq.Origin, vReq.RegisterID)
+	})
+	browserResponse.Message = "Register deactivated"
+	if browserResponse.Status != statusAccepted {
+		browserResponse.Message = "Unable to deactivate the register"
+	}
+	sendResponse(w, r, browserResponse)
+}
+
+// DeleteRegisterHandler removes the registration of the Vend register in the
+// form so that it can be paired from scratch
+func DeleteRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	browserResponse := changeRegister(r, func(vReq *vend.PaymentRequest) (bool, error) {
+		return term.Delete(vReq.Origin, vReq.RegisterID)
+	})
+	browserResponse.Message = "Register deleted"
+	if browserResponse.Status != statusAccepted {
+		browserResponse.Message = "Unable to delete the register"
+	}
+	sendResponse(w, r, browserResponse)
+}
+
+// changeRegister applies a change to the register in the origin and
+// register_id of the form, the route must be wrapped in adminOnly
+func changeRegister(r *http.Request, change func(*vend.PaymentRequest) (bool, error)) *Response {
+	browserResponse := &Response{}
+
+	if r.Method != http.MethodPost {
+		browserResponse.HTTPStatus = http.StatusMethodNotAllowed
+		return browserResponse
 	}
 
-	// ensure that we have a session
-	session, err := DbSessionStore.Get(r, sessionName)
+	vendPaymentRequest, err := getRegisterFromForm(r)
 	if err != nil {
-		return session, err
+		log.Error(err)
+		browserResponse.HTTPStatus = http.StatusBadRequest
+		browserResponse.Message = err.Error()
+		return browserResponse
 	}
-	return session, nil
+	browserResponse.RegisterID = vendPaymentRequest.RegisterID
+
+	_, err = change(vendPaymentRequest)
+	switch {
+	case err == terminal.ErrNotFound:
+		browserResponse.HTTPStatus = http.StatusNotFound
+		browserResponse.Status = statusFailed
+	case err != nil:
+		log.Error(err)
+		browserResponse.HTTPStatus = http.StatusServiceUnavailable
+		browserResponse.Status = statusFailed
+	default:
+		browserResponse.HTTPStatus = http.StatusOK
+		browserResponse.Status = statusAccepted
+	}
+	return browserResponse
 }
 
-// RegisterHandler GET request. Prompt for the Merchant ID and Device Token
-func RegisterHandler(w http.ResponseWriter, r *http.Request) {
-	logRequest(r)
+// registerDevice registers the device with Oxipay using the Merchant ID and
+// Device Token in the request, then persists the signing key of the register
+// from target using the supplied function
+func registerDevice(r *http.Request, target func(*http.Request) (*vend.PaymentRequest, error), persist func(user string, register *terminal.Register) (bool, error)) *Response {
 	browserResponse := &Response{}
-	switch r.Method {
-	case http.MethodPost:
 
-		// Bind the request from the browser to an Oxipay Registration Payload
-		registrationPayload, err := bindToRegistrationPayload(r)
+	// Bind the request from the browser to an Oxipay Registration Payload
+	registrationPayload, err := bindToRegistrationPayload(r)
 
-		if err != nil {
-			browserResponse.HTTPStatus = http.StatusBadRequest
-			browserResponse.Message = err.Error()
-			sendResponse(w, r, browserResponse)
-		}
+	if err != nil {
+		browserResponse.HTTPStatus = http.StatusBadRequest
+		browserResponse.Message = err.Error()
+		return browserResponse
+	}
 
-		err = registrationPayload.Validate()
-		if err != nil {
-			browserResponse.HTTPStatus = http.StatusBadRequest
-			browserResponse.Message = err.Error()
-			sendResponse(w, r, browserResponse)
-			return
-		}
+	err = registrationPayload.Validate()
+	if err != nil {
+		browserResponse.HTTPStatus = http.StatusBadRequest
+		browserResponse.Message = err.Error()
+		return browserResponse
+	}
 
-		vendPaymentRequest, err := getPaymentRequestFromSession(r)
-		if err == nil {
+	vendPaymentRequest, err := target(r)
+	if err != nil {
+		log.Error(err.Error())
+		browserResponse.Message = "Sorry. We are unable to process this registration. Please contact support"
+		browserResponse.HTTPStatus = http.StatusBadRequest
+		return browserResponse
+	}
 
-			// sign the message
-			registrationPayload.Signature = oxipay.SignMessage(oxipay.GeneratePlainTextSignature(registrationPayload), registrationPayload.DeviceToken)
+	// sign the message
+	registrationPayload.Signature = oxipay.SignMessage(oxipay.GeneratePlainTextSignature(registrationPayload), registrationPayload.DeviceToken)
 
-			// submit to oxipay
-			response, err := oxipayClient.RegisterPosDevice(registrationPayload)
+	// submit to the gateway for the Host, the register stays in that region
+	gateway := regions().ForHost(r.Host)
+	response, err := gateway.Client.RegisterPosDeviceWithContext(requestContext(r), registrationPayload)
 
-			if err != nil {
-				log.Error(err)
-				browserResponse.Message = "We are unable to process this request "
-				browserResponse.HTTPStatus = http.StatusBadGateway
-			}
+	if err != nil {
+		log.Error(err)
+		browserResponse.Message = "We are unable to process this request "
+		browserResponse.HTTPStatus = http.StatusBadGateway
+		return browserResponse
+	}
+
+	// ensure the response came from Oxipay
+	signedResponse, err := response.Authenticate(registrationPayload.DeviceToken)
+	if !signedResponse || err != nil {
+		metrics.SignatureFailures.Inc()
+		browserResponse.Message = "The signature returned from Oxipay does not match the expected signature"
+		browserResponse.HTTPStatus = http.StatusBadRequest
+		return browserResponse
+	}
+
+	if code := responseCode(oxipay.Registration, response.Code); code != nil {
+		metrics.ObserveTransaction(registrationType, code.TxnStatus, response.Code)
+	}
+
+	// process the response
+	browserResponse = processOxipayResponse(response, oxipay.Registration, "")
+	browserResponse.Message = gateway.Message(browserResponse.Message)
+	if browserResponse.Status == statusAccepted {
+		log.Info("Device Successfully Registered in Oxipay")
+
+		register := terminal.NewRegister(
+			response.Key,
+			registrationPayload.DeviceID,
+			registrationPayload.MerchantID,
+			vendPaymentRequest.Origin,
+			vendPaymentRequest.RegisterID,
+		)
+		register.Region = gateway.Name
+
+		_, err := persist(modifiedBy(r), register)
+		if err == terminal.ErrNotFound {
+			browserResponse.Message = "This register has not been paired with Oxipay"
+			browserResponse.HTTPStatus = http.StatusNotFound
+		} else if err != nil {
+			log.Error(err)
+			browserResponse.Message = "Unable to process request"
+			browserResponse.HTTPStatus = http.StatusServiceUnavailable
 
-			// ensure the response came from Oxipay
-			signedResponse, err := response.Authenticate(registrationPayload.DeviceToken)
-			if !signedResponse || err != nil {
-				browserResponse.Message = "The signature returned from Oxipay does not match the expected signature"
-				browserResponse.HTTPStatus = http.StatusBadRequest
-			} else {
-				// process the response
-				browserResponse = processOxipayResponse(response, oxipay.Registration, "")
-				if browserResponse.Status == statusAccepted {
-					log.Info("Device Successfully Registered in Oxipay")
-
-					register := terminal.NewRegister(
-						response.Key,
-						registrationPayload.DeviceID,
-						registrationPayload.MerchantID,
-						vendPaymentRequest.Origin,
-						vendPaymentRequest.RegisterID,
-					)
-
-					_, err := term.Save("vend-proxy", register)
-					if err != nil {
-						log.Error(err)
-						browserResponse.Message = "Unable to process request"
-						browserResponse.HTTPStatus = http.StatusServiceUnavailable
-
-					} else {
-						browserResponse.file = "../assets/templates/register_success.html"
-					}
-				}
-			}
 		} else {
-			log.Error(err.Error())
-			browserResponse.Message = "Sorry. We are unable to process this registration. Please contact support"
-			browserResponse.HTTPStatus = http.StatusBadRequest
+			browserResponse.file = filepath.Join(templateDir, "register_success.html")
 		}
-	default:
-		browserResponse.HTTPStatus = http.StatusOK
-		browserResponse.file = "../assets/templates/register.html"
 	}
-
-	log.Print(browserResponse.Message)
-	sendResponse(w, r, browserResponse)
-	return
+	return browserResponse
 }
 
 func processOxipayResponse(oxipayResponse *oxipay.Response, responseType oxipay.ResponseType, amount string) *Response {
@@ -342,15 +1436,7 @@ func processOxipayResponse(oxipayResponse *oxipay.Response, responseType oxipay.
 	// register that originally sent the payment.
 	response := &Response{}
 
-	var oxipayResponseCode *oxipay.ResponseCode
-	switch responseType {
-	case oxipay.Authorisation:
-		oxipayResponseCode = oxipay.ProcessAuthorisationResponses()(oxipayResponse.Code)
-	case oxipay.Adjustment:
-		oxipayResponseCode = oxipay.ProcessSalesAdjustmentResponse()(oxipayResponse.Code)
-	case oxipay.Registration:
-		oxipayResponseCode = oxipay.ProcessRegistrationResponse()(oxipayResponse.Code)
-	}
+	oxipayResponseCode := responseCode(responseType, oxipayResponse.Code)
 
 	if oxipayResponseCode == nil || oxipayResponseCode.TxnStatus == "" {
 
@@ -361,7 +1447,7 @@ func processOxipayResponse(oxipayResponse *oxipay.Response, responseType oxipay.
 
 	switch oxipayResponseCode.TxnStatus {
 	case oxipay.StatusApproved:
-		log.Infof("Status: %f", oxipayResponseCode.LogMessage)
+		log.Infof("Status: %s", oxipayResponseCode.LogMessage)
 		response.Amount = amount
 		response.ID = oxipayResponse.PurchaseNumber
 		response.Status = statusAccepted
@@ -387,6 +1473,46 @@ func processOxipayResponse(oxipayResponse *oxipay.Response, responseType oxipay.
 	return response
 }
 
+// responseCode maps an Oxipay x_code to a ResponseCode for the type of request that was made
+func responseCode(responseType oxipay.ResponseType, code string) *oxipay.ResponseCode {
+	switch responseType {
+	case oxipay.Authorisation:
+		return oxipay.ProcessAuthorisationResponses()(code)
+	case oxipay.Adjustment:
+		return oxipay.ProcessSalesAdjustmentResponse()(code)
+	case oxipay.Registration:
+		return oxipay.ProcessRegistrationResponse()(code)
+	}
+	return nil
+}
+
+// completeTransaction records the outcome of a gateway call in the ledger.
+// The payment has already been processed by Oxipay at this point so a failure
+// to record it is logged rather than returned to the browser.
+func completeTransaction(txn *transaction.Transaction, oxipayResponse *oxipay.Response, responseType oxipay.ResponseType) {
+	if oxipayResponse != nil {
+		txn.Code = oxipayResponse.Code
+		txn.Message = oxipayResponse.Message
+		// adjustments keep the purchase they refund
+		if oxipayResponse.PurchaseNumber != "" {
+			txn.PurchaseNumber = oxipayResponse.PurchaseNumber
+		}
+
+		if code := responseCode(responseType, oxipayResponse.Code); code != nil {
+			txn.Status = code.TxnStatus
+		}
+	}
+
+	if err := ledger.Complete(txn); err != nil {
+		log.WithFields(logrus.Fields{
+			"module":         "proxy",
+			"call":           "completeTransaction",
+			"transaction_id": txn.ID,
+			"status":         txn.Status,
+		}).Error(err)
+	}
+}
+
 func bindToRegistrationPayload(r *http.Request) (*oxipay.RegistrationPayload, error) {
 
 	if err := r.ParseForm(); err != nil {
@@ -403,28 +1529,27 @@ func bindToRegistrationPayload(r *http.Request) (*oxipay.RegistrationPayload, er
 		DeviceID:        FxlDeviceID,
 		DeviceToken:     deviceToken,
 		OperatorID:      "unknown",
-		FirmwareVersion: "version " + oxipayClient.GetVersion(),
+		FirmwareVersion: "version " + regions().Default.Client.GetVersion(),
 		POSVendor:       "Vend-Proxy",
 	}
 
 	return register, nil
 }
 
-func logRequest(r *http.Request) {
-	dump, _ := httputil.DumpRequest(r, true)
-	log.Debugf("%q ", dump)
-	// if r.Body != nil {
-	// 	// we need to copy the bytes out of the buffer
-	// 	// we we can inspect the contents without draining the buffer
-
-	// 	body, _ := ioutil.ReadAll(r.Body)
-	// 	log.Printf(colour.GDarkGray("Body: %s \n"), body)
-	// }
-	if r.RequestURI != "" {
-		query := r.RequestURI
-		log.Debugf("Query  %s", query)
+// requestContext returns the context for calls made on behalf of the request,
+// carrying the request ID sent by the client or a new one
+func requestContext(r *http.Request) context.Context {
+	id := r.Header.Get(oxipay.RequestIDHeader)
+	if id == "" {
+		id, _ = shortid.Generate()
 	}
+	return oxipay.WithRequestID(r.Context(), id)
+}
 
+// logRequest logs the request at debug level. The body isn't logged and the
+// query has the device tokens, payment codes and signing keys redacted.
+func logRequest(r *http.Request) {
+	log.Debugf("%s %s from %s %v", r.Method, r.URL.Path, trustedProxies.ClientIP(r), audit.Redact(r.URL.Query()))
 }
 
 // Index displays the main payment processing page, giving the user options of
@@ -444,24 +1569,30 @@ func Index(w http.ResponseWriter, r *http.Request) {
 	origin, _ = url.PathUnescape(origin)
 
 	vReq := &vend.PaymentRequest{
-		Amount:     r.Form.Get("amount"),
 		Origin:     origin,
 		RegisterID: r.Form.Get("register_id"),
 	}
 
-	log.Debugf("Received %s from %s for register %s", vReq.Amount, vReq.Origin, vReq.RegisterID)
-	vReq, err = validPaymentRequest(vReq)
+	log.Debugf("Received %s from %s for register %s", r.Form.Get("amount"), vReq.Origin, vReq.RegisterID)
 
+	// the amount is in the currency of the region the register was paired
+	// in, a register that isn't paired yet will be paired in the host's region
+	gateway := regions().ForHost(r.Host)
+	register, registerErr := term.GetRegister(vReq.Origin, vReq.RegisterID)
+	if registerErr == nil {
+		gateway = regions().ForRegister(register.Region, r.Host)
+	}
+
+	vReq.Amount = r.Form.Get("amount")
+	amount, err := parseAmount(vReq.Amount, gateway.Currency)
 	if err != nil {
 		w.Write([]byte("Not a valid request"))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	// we just want to ensure there is a terminal available
-	_, err = term.GetRegister(vReq.Origin, vReq.RegisterID)
 
 	// register the device if needed
-	if err != nil {
+	if registerErr != nil {
 		saveToSession(w, r, vReq)
 
 		// redirect
@@ -470,15 +1601,15 @@ func Index(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// refunds are triggered by a negative amount
-	if vReq.AmountFloat > 0 {
+	if amount.IsPositive() {
 		// payment
-		http.ServeFile(w, r, "../assets/templates/index.html")
+		http.ServeFile(w, r, filepath.Join(templateDir, "index.html"))
 	} else {
 		// save the details of the original request
 		saveToSession(w, r, vReq)
 
 		// refund
-		http.ServeFile(w, r, "../assets/templates/refund.html")
+		http.ServeFile(w, r, filepath.Join(templateDir, "refund.html"))
 	}
 }
 
@@ -498,23 +1629,24 @@ func saveToSession(w http.ResponseWriter, r *http.Request, vReq *vend.PaymentReq
 	log.Infof("Session initiated: %s ", session.ID)
 }
 
+// bindToPaymentPayload binds the payment sent by Vend, the amount is parsed by
+// parseAmount once the region of the register is known
 func bindToPaymentPayload(r *http.Request) (*vend.PaymentRequest, error) {
-	r.ParseForm()
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
 	origin := r.Form.Get("origin")
 	origin, _ = url.PathUnescape(origin)
 
 	vReq := &vend.PaymentRequest{
-		Amount:     r.Form.Get("amount"),
 		Origin:     origin,
 		SaleID:     strings.Trim(r.Form.Get("sale_id"), ""),
 		RegisterID: r.Form.Get("register_id"),
 		Code:       strings.Trim(r.Form.Get("paymentcode"), ""),
 	}
 
-	log.Debugf("Payment: %s from %s for register %s", vReq.Amount, vReq.Origin, vReq.RegisterID)
-	vReq, err := validPaymentRequest(vReq)
-
-	return vReq, err
+	log.Debugf("Payment: %s from %s for register %s", r.Form.Get("amount"), vReq.Origin, vReq.RegisterID)
+	return vReq, nil
 }
 
 // RefundHandler handles performing a refund
@@ -544,14 +1676,11 @@ func RefundHandler(w http.ResponseWriter, r *http.Request) {
 		SaleID:         strings.Trim(r.Form.Get("sale_id"), ""),
 		PurchaseNumber: strings.Trim(r.Form.Get("purchaseno"), ""),
 		RegisterID:     x.RegisterID,
-		AmountFloat:    x.AmountFloat,
 	}
 	cxFields["register_id"] = x.RegisterID
 	cxFields["origin"] = x.Origin
 
-	terminal := terminal.NewTerminal(db)
-
-	register, err := terminal.GetRegister(vReq.Origin, vReq.RegisterID)
+	register, err := term.GetRegister(vReq.Origin, vReq.RegisterID)
 	if err != nil {
 		cxLog.Info("Register Not Found, redirecting to /register")
 		// redirect to registration page
@@ -560,9 +1689,40 @@ func RefundHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	cxFields["merchant_id"] = register.FxlSellerID
 
+	// the amount is in the currency of the register's region
+	gateway := regions().ForRegister(register.Region, r.Host)
+	amount, err := parseAmount(vReq.Amount, gateway.Currency)
+	if err != nil {
+		cxLog.Errorf("Unable to parse the refund of %s in %s: %s", vReq.Amount, gateway.Currency, err)
+		http.Error(w, "There was a problem processing the request, please start the refund again", http.StatusBadRequest)
+		return
+	}
+
+	// the purchase number only has to be entered for sales that weren't paid
+	// through the proxy
+	if vReq.PurchaseNumber == "" {
+		purchase, err := findPurchase(register, r.Form.Get("original_sale_id"), vReq.SaleID)
+		if err != nil {
+			cxLog.Error(err)
+			http.Error(w, "There was a problem processing the request", http.StatusServiceUnavailable)
+			return
+		}
+		if purchase == nil {
+			sendResponse(w, r, &Response{
+				Status:     statusDeclined,
+				Message:    "Unable to find the Oxipay purchase for this sale, please enter the Oxipay Purchase #",
+				HTTPStatus: http.StatusOK,
+			})
+			return
+		}
+		vReq.PurchaseNumber = purchase.PurchaseNumber
+	}
+
+	refund := amount.Abs()
+
 	txnRef, err := shortid.Generate()
 	var oxipayPayload = &oxipay.SalesAdjustmentPayload{
-		Amount:            strings.Replace(vReq.Amount, "-", "", 1),
+		Amount:            refund.Cents(),
 		MerchantID:        register.FxlSellerID,
 		DeviceID:          register.FxlRegisterID,
 		FirmwareVersion:   "vend_integration_v0.0.1",
@@ -579,12 +1739,56 @@ func RefundHandler(w http.ResponseWriter, r *http.Request) {
 	oxipayPayload.Signature = oxipay.SignMessage(plainText, register.FxlDeviceSigningKey)
 	log.Infof("Oxipay signature: %s \n", oxipayPayload.Signature)
 
+	// check the refund against what is left of the purchase, then record the
+	// adjustment before it is sent so that we have a trace of it even if we
+	// never hear back from Oxipay
+	txn := &transaction.Transaction{
+		Type:              transaction.TypeAdjustment,
+		SaleID:            vReq.SaleID,
+		Origin:            vReq.Origin,
+		VendRegisterID:    vReq.RegisterID,
+		FxlRegisterID:     register.FxlRegisterID,
+		FxlSellerID:       register.FxlSellerID,
+		Amount:            refund.Minor,
+		PosTransactionRef: oxipayPayload.PosTransactionRef,
+		PurchaseNumber:    vReq.PurchaseNumber,
+	}
+
+	remaining, found, err := ledger.BeginRefund(txn)
+	if err == nil && !found {
+		// purchases made before the ledger was added can't be checked
+		cxLog.Warnf("No approved authorisation recorded for purchase %s, unable to check the refundable balance", vReq.PurchaseNumber)
+	}
+	if err == transaction.ErrExceedsBalance {
+		balance := vend.NewMoney(remaining, gateway.Currency)
+		sendResponse(w, r, &Response{
+			Status:     statusDeclined,
+			Message:    fmt.Sprintf("The refund of %s is more than the %s remaining on purchase %s", refund, balance, vReq.PurchaseNumber),
+			Remaining:  balance.String(),
+			HTTPStatus: http.StatusOK,
+		})
+		return
+	}
+	if err != nil {
+		cxLog.Error(err)
+		http.Error(w, "There was a problem processing the request", http.StatusServiceUnavailable)
+		return
+	}
+
 	// send authorisation to oxipay
-	oxipayResponse, err := oxipayClient.ProcessSalesAdjustment(oxipayPayload)
+	oxipayResponse, err := gateway.Client.ProcessSalesAdjustmentWithContext(requestContext(r), oxipayPayload)
 
 	if err != nil {
-		// log the raw response
-		log.Errorf("Error Processing: %s", oxipayResponse)
+		cxLog.Errorf("Error Processing refund %s: %s", txn.ID, err)
+		txn.Status = transaction.StatusError
+		completeTransaction(txn, nil, oxipay.Adjustment)
+
+		sendResponse(w, r, &Response{
+			Reference:  txn.ID,
+			Status:     statusFailed,
+			Message:    "Unable to reach Oxipay. Please check the Oxipay portal before trying the refund again",
+			HTTPStatus: http.StatusBadGateway,
+		})
 		return
 	}
 
@@ -593,24 +1797,152 @@ func RefundHandler(w http.ResponseWriter, r *http.Request) {
 	validSignature, err = oxipayResponse.Authenticate(register.FxlDeviceSigningKey)
 
 	if !validSignature || err != nil {
+		metrics.SignatureFailures.Inc()
 		browserResponse.Message = "The signature does not match the expected signature"
 		browserResponse.HTTPStatus = http.StatusBadRequest
+		txn.Status = transaction.StatusError
+		completeTransaction(txn, nil, oxipay.Adjustment)
 	} else {
+		completeTransaction(txn, oxipayResponse, oxipay.Adjustment)
+
 		// Return a response to the browser bases on the response from Oxipay
 		browserResponse = processOxipayResponse(oxipayResponse, oxipay.Adjustment, oxipayPayload.Amount)
 		browserResponse.Amount = "0" // this is set because the payload
+		browserResponse.Message = gateway.Message(browserResponse.Message)
+		if found && browserResponse.Status == statusAccepted {
+			browserResponse.Remaining = vend.NewMoney(remaining-refund.Minor, gateway.Currency).String()
+		}
 	}
 
 	sendResponse(w, r, browserResponse)
 	return
 }
 
+// RefundPurchaseHandler finds the Oxipay purchase for the sale being refunded,
+// so that the cashier doesn't have to enter the purchase number
+func RefundPurchaseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	vReq, err := getPaymentRequestFromSession(r)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "There was a problem processing the request", http.StatusBadRequest)
+		return
+	}
+
+	register, err := term.GetRegister(vReq.Origin, vReq.RegisterID)
+	if err != nil {
+		http.Redirect(w, r, "/register", http.StatusFound)
+		return
+	}
+
+	query := r.URL.Query()
+	purchase, err := findPurchase(register, query.Get("original_sale_id"), query.Get("sale_id"))
+	if err == nil && purchase == nil {
+		sendResponse(w, r, &Response{
+			Message:    "Unable to find the purchase",
+			HTTPStatus: http.StatusNotFound,
+		})
+		return
+	}
+
+	var remaining int64
+	if err == nil {
+		remaining, err = ledger.RefundableBalance(register.FxlSellerID, purchase.PurchaseNumber)
+	}
+	if err != nil {
+		log.Error(err)
+		sendResponse(w, r, &Response{
+			Message:    "There was a problem processing the request",
+			HTTPStatus: http.StatusServiceUnavailable,
+		})
+		return
+	}
+
+	gateway := regions().ForRegister(register.Region, r.Host)
+	sendResponse(w, r, &Response{
+		ID:         purchase.PurchaseNumber,
+		Amount:     vend.NewMoney(purchase.Amount, gateway.Currency).String(),
+		Remaining:  vend.NewMoney(remaining, gateway.Currency).String(),
+		HTTPStatus: http.StatusOK,
+	})
+}
+
+// findPurchase returns the approved authorisation for the first of the Vend
+// sales that was paid through the proxy by the same merchant as the register,
+// or nil for legacy sales. A return in Vend is a new sale, so the original sale
+// is checked before the refund's own sale.
+func findPurchase(register *terminal.Register, saleIDs ...string) (*transaction.Transaction, error) {
+	for _, saleID := range saleIDs {
+		if saleID == "" {
+			continue
+		}
+		purchase, err := ledger.GetPurchase(register.Origin, saleID)
+		if err != nil {
+			return nil, err
+		}
+		if purchase != nil && purchase.FxlSellerID == register.FxlSellerID {
+			return purchase, nil
+		}
+	}
+	return nil, nil
+}
+
+// RefundBalanceHandler returns the amount that can still be refunded on an
+// Oxipay purchase made by the register in the session
+func RefundBalanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	vReq, err := getPaymentRequestFromSession(r)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "There was a problem processing the request", http.StatusBadRequest)
+		return
+	}
+
+	register, err := term.GetRegister(vReq.Origin, vReq.RegisterID)
+	if err != nil {
+		http.Redirect(w, r, "/register", http.StatusFound)
+		return
+	}
+
+	purchaseNumber := strings.TrimSpace(r.URL.Query().Get("purchaseno"))
+	remaining, err := ledger.RefundableBalance(register.FxlSellerID, purchaseNumber)
+	if err == transaction.ErrNotFound {
+		sendResponse(w, r, &Response{
+			Message:    "Unable to find the purchase",
+			HTTPStatus: http.StatusNotFound,
+		})
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		sendResponse(w, r, &Response{
+			Message:    "There was a problem processing the request",
+			HTTPStatus: http.StatusServiceUnavailable,
+		})
+		return
+	}
+
+	gateway := regions().ForRegister(register.Region, r.Host)
+	sendResponse(w, r, &Response{
+		ID:         purchaseNumber,
+		Remaining:  vend.NewMoney(remaining, gateway.Currency).String(),
+		HTTPStatus: http.StatusOK,
+	})
+}
+
 // PaymentHandler receives the payment request from Vend and sends it to the
 // payment gateway.
 func PaymentHandler(w http.ResponseWriter, r *http.Request) {
 	var vReq *vend.PaymentRequest
 	var err error
-	browserResponse := new(Response)
 
 	logRequest(r)
 
@@ -618,6 +1950,7 @@ func PaymentHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Error(err)
 		http.Error(w, "There was a problem processing the request", http.StatusBadRequest)
+		return
 	}
 
 	// looks up the database to get the fake Oxipay terminal
@@ -632,16 +1965,196 @@ func PaymentHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Infof("Processing Payment using Oxipay register %s ", terminal.FxlRegisterID)
 
+	// the amount is in the currency of the region the register was paired in
+	gateway := regions().ForRegister(terminal.Region, r.Host)
+	vReq.Amount = r.Form.Get("amount")
+	amount, err := parseAmount(vReq.Amount, gateway.Currency)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, "There was a problem processing the request", http.StatusBadRequest)
+		return
+	}
+
+	if gateway.BelowMinimum(amount.Minor) {
+		minimum := vend.NewMoney(gateway.MinimumAmount, gateway.Currency)
+		sendResponse(w, r, &Response{
+			Status:     statusDeclined,
+			Message:    fmt.Sprintf("The minimum Oxipay purchase is %s %s", minimum, gateway.Currency),
+			HTTPStatus: http.StatusOK,
+		})
+		return
+	}
+
+	ctx := requestContext(r)
+
+	// without a sale ID we have nothing to detect a duplicate with
+	if vReq.SaleID == "" {
+		browserResponse := authorise(ctx, gateway, vReq, amount, terminal)
+		browserResponse.Message = gateway.Message(browserResponse.Message)
+		sendResponse(w, r, browserResponse)
+		return
+	}
+
+	// a double tap or a re-post from the Vend iframe will share the same key,
+	// so only the first request is sent to Oxipay and the rest wait for its
+	// result. The call is made on behalf of all of them so it isn't abandoned
+	// when the first cashier closes the window, it is once every window is closed.
+	key := transaction.Key(vReq.Origin, vReq.RegisterID, vReq.SaleID)
+	requestID := oxipay.RequestID(ctx)
+	result, collapsed, err := payments.Do(ctx, key, func(shared context.Context) interface{} {
+		return authoriseOnce(oxipay.WithRequestID(shared, requestID), gateway, vReq, amount, terminal)
+	})
+	if collapsed {
+		log.Infof("Duplicate payment request for sale %s collapsed into the in-flight request", vReq.SaleID)
+	}
+	if err != nil && ctx.Err() != nil {
+		// nobody is waiting for the response
+		log.Warnf("Duplicate payment request for sale %s was abandoned: %s", vReq.SaleID, err)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		sendResponse(w, r, &Response{
+			Message:    "There was a problem processing the request",
+			HTTPStatus: http.StatusInternalServerError,
+		})
+		return
+	}
+
+	// copy the response so that concurrent duplicates don't share the same value
+	browserResponse := *result.(*Response)
+	browserResponse.Message = gateway.Message(browserResponse.Message)
+	sendResponse(w, r, &browserResponse)
+	return
+}
+
+// authoriseOnce returns the original response if Oxipay has already approved
+// the sale, otherwise the authorisation is sent to Oxipay
+func authoriseOnce(ctx context.Context, gateway *region.Region, vReq *vend.PaymentRequest, amount vend.Money, terminal *terminal.Register) *Response {
+	txn, err := ledger.GetApprovedAuthorisation(vReq.Origin, vReq.RegisterID, vReq.SaleID)
+	if err != nil {
+		log.Error(err)
+		return &Response{
+			Message:    "There was a problem processing the request",
+			HTTPStatus: http.StatusServiceUnavailable,
+		}
+	}
+
+	if txn != nil {
+		log.Infof("Sale %s has already been approved as purchase %s, returning the original response", vReq.SaleID, txn.PurchaseNumber)
+		return transactionResponse(txn)
+	}
+
+	// the sale may have been paid, sending it again would be rejected by Oxipay
+	txn, err = ledger.GetUnknownAuthorisation(vReq.Origin, vReq.RegisterID, vReq.SaleID)
+	if err != nil {
+		log.Error(err)
+		return &Response{
+			Message:    "There was a problem processing the request",
+			HTTPStatus: http.StatusServiceUnavailable,
+		}
+	}
+	if txn != nil {
+		log.Infof("Sale %s is being reconciled as %s, returning the reference", vReq.SaleID, txn.ID)
+		return transactionResponse(txn)
+	}
+
+	// InFlight only collapses duplicates within this process, the AU and NZ
+	// proxies share the database so check for one sent by another instance
+	txn, err = ledger.GetPendingAuthorisation(vReq.Origin, vReq.RegisterID, vReq.SaleID)
+	if err != nil {
+		log.Error(err)
+		return &Response{
+			Message:    "There was a problem processing the request",
+			HTTPStatus: http.StatusServiceUnavailable,
+		}
+	}
+	if txn != nil && time.Since(txn.CreatedDate) < pendingTimeout {
+		log.Infof("Sale %s is waiting on Oxipay as %s, returning the reference", vReq.SaleID, txn.ID)
+		return transactionResponse(txn)
+	}
+	if txn != nil {
+		log.Warnf("Sale %s has been pending as %s since %s, sending it again", vReq.SaleID, txn.ID, txn.CreatedDate)
+	}
+
+	return authorise(ctx, gateway, vReq, amount, terminal)
+}
+
+// PaymentStatusHandler lets the browser poll for the outcome of a payment that
+// was UNKNOWN when the payment request returned
+func PaymentStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	txn, err := ledger.Get(query.Get("reference"))
+	if err == transaction.ErrNotFound ||
+		(err == nil && (txn.Type != transaction.TypeAuthorisation ||
+			txn.Origin != query.Get("origin") ||
+			txn.VendRegisterID != query.Get("register_id"))) {
+		sendResponse(w, r, &Response{
+			Message:    "Unable to find the payment",
+			HTTPStatus: http.StatusNotFound,
+		})
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		sendResponse(w, r, &Response{
+			Message:    "There was a problem processing the request",
+			HTTPStatus: http.StatusServiceUnavailable,
+		})
+		return
+	}
+
+	sendResponse(w, r, transactionResponse(txn))
+}
+
+// transactionResponse builds the browser response for an authorisation recorded in the ledger
+func transactionResponse(txn *transaction.Transaction) *Response {
+	switch txn.Status {
+	case transaction.StatusPending, transaction.StatusUnknown:
+		return &Response{
+			Reference:  txn.ID,
+			Status:     statusUnknown,
+			Message:    "Waiting for Oxipay to confirm the payment",
+			HTTPStatus: http.StatusAccepted,
+		}
+	case transaction.StatusError:
+		return &Response{
+			Reference:  txn.ID,
+			Status:     statusTimeout,
+			Message:    "Oxipay did not confirm the payment. Please check the Oxipay portal before trying again",
+			HTTPStatus: http.StatusOK,
+		}
+	}
+
+	oxipayResponse := &oxipay.Response{
+		PurchaseNumber: txn.PurchaseNumber,
+		Code:           txn.Code,
+		Message:        txn.Message,
+	}
+	return processOxipayResponse(oxipayResponse, oxipay.Authorisation, strconv.FormatInt(txn.Amount, 10))
+}
+
+// authorise sends the payment to Oxipay and records the result in the ledger.
+// The call to Oxipay is abandoned if ctx is done, for example the cashier
+// closed the payment window.
+func authorise(ctx context.Context, gateway *region.Region, vReq *vend.PaymentRequest, amount vend.Money, terminal *terminal.Register) *Response {
+	browserResponse := new(Response)
+
 	// send off to Oxipay
 	//var oxipayPayload
 	var oxipayPayload = &oxipay.AuthorisationPayload{
 		DeviceID:          terminal.FxlRegisterID,
 		MerchantID:        terminal.FxlSellerID,
 		PosTransactionRef: vReq.SaleID,
-		FinanceAmount:     vReq.Amount,
+		FinanceAmount:     amount.Cents(),
 		FirmwareVersion:   "vend_integration_v0.0.1",
 		OperatorID:        "Vend",
-		PurchaseAmount:    vReq.Amount,
+		PurchaseAmount:    amount.Cents(),
 		PreApprovalCode:   vReq.Code,
 	}
 
@@ -653,33 +2166,75 @@ func PaymentHandler(w http.ResponseWriter, r *http.Request) {
 	oxipayPayload.Signature = oxipay.SignMessage(plainText, terminal.FxlDeviceSigningKey)
 	log.Debugf("Oxipay signature: %s \n", oxipayPayload.Signature)
 
+	// record the authorisation before it is sent so that we have a trace of it
+	// even if we never hear back from Oxipay
+	txn := &transaction.Transaction{
+		Type:              transaction.TypeAuthorisation,
+		SaleID:            vReq.SaleID,
+		Origin:            vReq.Origin,
+		VendRegisterID:    vReq.RegisterID,
+		FxlRegisterID:     terminal.FxlRegisterID,
+		FxlSellerID:       terminal.FxlSellerID,
+		Amount:            amount.Minor,
+		PosTransactionRef: oxipayPayload.PosTransactionRef,
+	}
+	if err := ledger.Begin(txn); err != nil {
+		log.Error(err)
+		browserResponse.Message = "There was a problem processing the request"
+		browserResponse.HTTPStatus = http.StatusServiceUnavailable
+		return browserResponse
+	}
+
 	// send authorisation to the Oxipay POS API
-	oxipayResponse, err := oxipayClient.ProcessAuthorisation(oxipayPayload)
+	oxipayResponse, err := gateway.Client.ProcessAuthorisationWithContext(ctx, oxipayPayload)
+
+	if err != nil && oxipay.MayHaveBeenProcessed(err) {
+		// the customer may have been charged, so rather than fail the payment
+		// find out what happened while the browser polls for the outcome
+		log.Warnf("Lost the response for transaction %s, reconciling: %s", txn.ID, err)
+		if err = reconciler.Reconcile(ctx, gateway.Client, txn, oxipayPayload, terminal.FxlDeviceSigningKey); err != nil {
+			log.Error(err)
+			browserResponse.Message = "There was a problem processing the request"
+			browserResponse.HTTPStatus = http.StatusInternalServerError
+			return browserResponse
+		}
+		return transactionResponse(txn)
+	}
 
 	if err != nil {
-		http.Error(w, "There was a problem processing the request", http.StatusInternalServerError)
 		// log the raw response
-
 		msg := fmt.Sprintf("Error Processing: %s", oxipayResponse)
 		log.Error(msg)
-		return
+		txn.Status = transaction.StatusError
+		completeTransaction(txn, nil, oxipay.Authorisation)
+
+		browserResponse.Message = "There was a problem processing the request"
+		browserResponse.HTTPStatus = http.StatusInternalServerError
+		return browserResponse
 	}
 
 	// ensure the response has come from Oxipay
 	validSignature, err := oxipayResponse.Authenticate(terminal.FxlDeviceSigningKey)
 	if !validSignature || err != nil {
+		metrics.SignatureFailures.Inc()
 		browserResponse.Message = "The signature does not match the expected signature"
 		browserResponse.HTTPStatus = http.StatusBadRequest
+		txn.Status = transaction.StatusError
+		completeTransaction(txn, nil, oxipay.Authorisation)
 	} else {
+		completeTransaction(txn, oxipayResponse, oxipay.Authorisation)
+
 		// Return a response to the browser bases on the response from Oxipay
 		browserResponse = processOxipayResponse(oxipayResponse, oxipay.Authorisation, oxipayPayload.PurchaseAmount)
 	}
 
-	sendResponse(w, r, browserResponse)
-	return
+	return browserResponse
 }
 
 func sendResponse(w http.ResponseWriter, r *http.Request, response *Response) {
+	if outcome, ok := r.Context().Value(auditContextKey{}).(*string); ok && response.Status != "" {
+		*outcome = response.Status
+	}
 
 	if len(response.file) > 0 {
 		// serve up the success page
@@ -718,22 +2273,11 @@ func sendResponse(w http.ResponseWriter, r *http.Request, response *Response) {
 	return
 }
 
-func validPaymentRequest(req *vend.PaymentRequest) (*vend.PaymentRequest, error) {
-	var err error
-
-	// convert the amount to cents and then go back to a string for
-	// the checksum
-	if len(req.Amount) < 1 {
-		return req, errors.New("Amount is required")
-	}
-	req.AmountFloat, err = strconv.ParseFloat(req.Amount, 64)
-	if err != nil {
-		return req, err
+// parseAmount parses the decimal amount sent by Vend in the currency of the
+// register, Oxipay deals with cents
+func parseAmount(amount string, currency string) (vend.Money, error) {
+	if len(amount) < 1 {
+		return vend.Money{}, errors.New("Amount is required")
 	}
-
-	// Oxipay deals with cents.
-	// Probably not great that we are mutating the value directly
-	// If it gets problematic we can return a copy
-	req.Amount = strconv.FormatFloat((req.AmountFloat * 100), 'f', 0, 64)
-	return req, err
+	return vend.ParseMoney(amount, currency)
 }
@@ -1,63 +1,128 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	uuid "github.com/nu7hatch/gouuid"
+	"github.com/oxipay/oxipay-vend/internal/pkg/audit"
 	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+	"github.com/oxipay/oxipay-vend/internal/pkg/database"
+	"github.com/oxipay/oxipay-vend/internal/pkg/drain"
+	"github.com/oxipay/oxipay-vend/internal/pkg/health"
+	"github.com/oxipay/oxipay-vend/internal/pkg/keyring"
+	"github.com/oxipay/oxipay-vend/internal/pkg/metrics"
+	"github.com/oxipay/oxipay-vend/internal/pkg/migrate"
 	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
+	"github.com/oxipay/oxipay-vend/internal/pkg/region"
+	"github.com/oxipay/oxipay-vend/internal/pkg/simulator"
 	"github.com/oxipay/oxipay-vend/internal/pkg/terminal"
+	"github.com/oxipay/oxipay-vend/internal/pkg/transaction"
 	"github.com/oxipay/oxipay-vend/internal/pkg/vend"
+	"github.com/oxipay/oxipay-vend/internal/pkg/webhook"
+	logrus "github.com/sirupsen/logrus"
 
 	shortid "github.com/ventu-io/go-shortid"
 )
 
 var Db *sql.DB
 
-var appConfig config.HostConfig
+// sim is the fake Oxipay gateway all of the tests run against
+var sim *simulator.Simulator
+
+var gateway *httptest.Server
 
 func TestMain(m *testing.M) {
-	appConfig, _ := config.ReadApplicationConfig("../configs/vendproxy.json")
-	// we need a"" database connection for most of the tests
+	testConfig, _ := config.ReadApplicationConfig("../configs/vendproxy.json")
+
+	log = initLogger(logrus.DebugLevel)
+
+	// the tests use an in-memory SQLite database so that they don't need a MariaDB container
+	testConfig.Database = config.DbConnection{
+		Driver: database.DriverSQLite,
+		Name:   ":memory:",
+	}
 
-	Db = connectToDatabase(appConfig.Database)
+	// we need a"" database connection for most of the tests
+	Db = connectToDatabase(testConfig.Database)
 
 	defer Db.Close()
 
+	migrator, err := migrate.NewMigrator(database.DriverSQLite, Db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err = migrator.Up(); err != nil {
+		log.Fatal(err)
+	}
+
 	// add vars to the seesion to simulate a redirect
-	DbSessionStore = initSessionStore(Db, appConfig.Session)
+	DbSessionStore = initSessionStore(Db, database.DriverSQLite, testConfig.Session)
 
-	terminal.Db = Db
+	term = terminal.NewTerminal(terminal.NewSQLiteStore(Db))
+	ledger = transaction.NewLedger(database.DriverSQLite, Db)
+	auditLog = audit.NewLog(database.DriverSQLite, Db)
 
-	// oxipay.GatewayURL = "https://testpos.oxipay.com.au/webapi/v1/Test"
+	// talk to the simulator rather than the sandbox so that the tests can run offline
+	sim = simulator.New(log)
+	gateway = simulator.NewServer(sim)
+	gateways.Store(newRouter())
+	reconciler = transaction.NewReconciler(ledger, log)
 
 	returnCode := m.Run()
+	reconciler.Stop(context.Background())
 
+	gateway.Close()
 	os.Exit(returnCode)
 }
 
+// newRouter returns a single region that talks to the simulator
+func newRouter(options ...oxipay.Option) *region.Router {
+	// record the gateway metrics like the clients built by serve
+	options = append([]oxipay.Option{oxipay.WithObserver(observeGateway)}, options...)
+	router, err := region.NewRouter(config.HostConfig{
+		Oxipay: config.OxipayConfig{GatewayURL: gateway.URL, Version: "1.1"},
+	}, log, options...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return router
+}
+
+// saveRegister registers a device with both the simulator and the local
+// database so that payments can be processed against it
+func saveRegister(t *testing.T, origin string, key string) *terminal.Register {
+	vendRegisterID, _ := uuid.NewV4()
+	deviceID, _ := shortid.Generate()
+
+	register := terminal.NewRegister(key, "Oxipos-"+deviceID, "30188105", origin, vendRegisterID.String())
+	saved, err := term.Save("unit-test", register)
+	if err != nil || saved != true {
+		t.Fatalf("Unable to save register: %v", err)
+	}
+
+	sim.AddDevice(register.FxlRegisterID, key)
+	return register
+}
+
 // TestTerminalSave tests saving a new terminal in the database for the registration phase
 func TestTerminalSave(t *testing.T) {
 	// { Success SCRK01 Success VK5NGgc7nFJp 481f1e4098465f5229b33d91e0687c6123b91078e5c727b6d8ebf9360af145e7}
 	var uniqueID, _ = shortid.Generate()
 
-	terminal := &terminal.Terminal{
-		FxlDeviceSigningKey: "VK5NGgc7nFJp",
-		FxlRegisterID:       "Oxipos",
-		FxlSellerID:         "30188105",
-		Origin:              "http://pos.example.com",
-		VendRegisterID:      uniqueID,
-	}
-	saved, err := terminal.Save("unit-test")
+	register := terminal.NewRegister("VK5NGgc7nFJp", "Oxipos", "30188105", "http://pos.example.com", uniqueID)
+	saved, err := term.Save("unit-test", register)
 
 	if err != nil || saved == false {
 		t.Fatal(err)
@@ -67,21 +132,100 @@ func TestTerminalSave(t *testing.T) {
 // TestTerminalUniqueSave ensures that we get an error if we try to save the same terminal twice
 func TestTerminalUniqueSave(t *testing.T) {
 	// { Success SCRK01 Success VK5NGgc7nFJp 481f1e4098465f5229b33d91e0687c6123b91078e5c727b6d8ebf9360af145e7}
+	var uniqueID, _ = shortid.Generate()
+
+	register := terminal.NewRegister("VK5NGgc7nFJp", "Oxipos", "30188105", "http://pos.oxipay.com.au", uniqueID)
 
-	terminal := &terminal.Terminal{
-		FxlDeviceSigningKey: "VK5NGgc7nFJp",
-		FxlRegisterID:       "Oxipos",
-		FxlSellerID:         "30188105",
-		Origin:              "http://pos.oxipay.com.au",
-		VendRegisterID:      "0d33b6af-7d33-4913-a310-7cd187ad4756",
-	}
 	// insert the same record twice so that we know it's erroring
-	saved, err := terminal.Save("unit-test")
-	saved, err = terminal.Save("unit-test")
+	term.Save("unit-test", register)
+	saved, err := term.Save("unit-test", register)
+
+	if err == nil || saved != false {
+		t.Fatal("Expected the second save to fail")
+	}
+}
 
-	if err != nil && saved != false {
+// TestTerminalList checks the admin queries against the database, including
+// that the signing key is never selected
+func TestTerminalList(t *testing.T) {
+	var origin, _ = shortid.Generate()
+	origin = "http://" + origin + ".vendhq.com"
+
+	first := saveRegister(t, origin, "1234567890")
+	second := saveRegister(t, origin, "0987654321")
+	term.Deactivate("unit-test", origin, second.VendRegisterID)
+
+	filter := terminal.Filter{OriginDomain: origin}
+	total, err := term.Count(filter)
+	if err != nil || total != 2 {
+		t.Fatalf("expected 2 registers got %d: %v", total, err)
+	}
+
+	filter.Limit = 1
+	filter.Offset = 1
+	registers, err := term.List(filter)
+	if err != nil || len(registers) != 1 {
+		t.Fatalf("expected a single register got %d: %v", len(registers), err)
+	}
+	if registers[0].VendRegisterID != second.VendRegisterID || registers[0].Active {
+		t.Errorf("expected the deactivated register got %+v", registers[0])
+	}
+	if registers[0].FxlDeviceSigningKey != "" || registers[0].CreatedDate.IsZero() {
+		t.Errorf("unexpected register %+v", registers[0])
+	}
+
+	register, err := term.GetByID(registers[0].ID - 1)
+	if err != nil {
 		t.Fatal(err)
+	}
+	if register.VendRegisterID != first.VendRegisterID || !register.Active || register.FxlDeviceSigningKey != "" {
+		t.Errorf("unexpected register %+v", register)
+	}
 
+	if _, err = term.GetByID(-1); err != terminal.ErrNotFound {
+		t.Errorf("expected ErrNotFound got %v", err)
+	}
+}
+
+// TestSessionKeyRotation ensures sessions signed with a retired key are still
+// read after a new key is added, but not once the old key is removed
+func TestSessionKeyRotation(t *testing.T) {
+	oldKey := config.SessionKey{Authentication: "old-authentication-key", Encryption: "0123456789abcdef"}
+	newKey := config.SessionKey{Authentication: "new-authentication-key", Encryption: "fedcba9876543210"}
+
+	oldStore := initSessionStore(Db, database.DriverSQLite, config.SessionConfig{Path: "/", Keys: []config.SessionKey{oldKey}})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rr := httptest.NewRecorder()
+	session, _ := oldStore.New(req, "oxipay")
+	session.Values["vReq"] = &vend.PaymentRequest{RegisterID: "rotated"}
+	if err := session.Save(req, rr); err != nil {
+		t.Fatal(err)
+	}
+	cookie := rr.Result().Cookies()[0]
+
+	var tests = []struct {
+		keys  []config.SessionKey
+		valid bool
+	}{
+		{[]config.SessionKey{newKey, oldKey}, true},
+		{[]config.SessionKey{newKey}, false},
+	}
+
+	for _, tt := range tests {
+		store := initSessionStore(Db, database.DriverSQLite, config.SessionConfig{Path: "/", Keys: tt.keys})
+
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookie)
+		session, err := store.New(req, "oxipay")
+
+		vReq, _ := session.Values["vReq"].(*vend.PaymentRequest)
+		if tt.valid && (err != nil || vReq == nil || vReq.RegisterID != "rotated") {
+			t.Errorf("expected the session to be read with %d keys: %v", len(tt.keys), err)
+		}
+		if !tt.valid && (err == nil || vReq != nil) {
+			t.Errorf("expected the session to be rejected with %d keys", len(tt.keys))
+		}
 	}
 }
 
@@ -93,7 +237,7 @@ func TestRegisterHandler(t *testing.T) {
 	// pass 'nil' as the third parameter.
 	form := url.Values{}
 	form.Add("MerchantID", "30188105")
-	form.Add("DeviceToken", "01SUCCES") // for this to work against sandbox or prod it needs a real token
+	form.Add("DeviceToken", "01SUCCES")
 
 	req, err := http.NewRequest(http.MethodPost, "/register", strings.NewReader(form.Encode()))
 
@@ -115,7 +259,7 @@ func TestRegisterHandler(t *testing.T) {
 	err = session.Save(req, rr)
 
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
 
 	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
@@ -130,37 +274,250 @@ func TestRegisterHandler(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %d want %d",
 			status, http.StatusOK)
 	}
+
+	if _, err := term.GetRegister(vReq.Origin, vReq.RegisterID); err != nil {
+		t.Errorf("Expected the register to be saved: %s", err)
+	}
 }
 
-// TestGeneratePayload generating oxipay payload assumes a registered device
-// with both Oxipay and the local database
-func TestProcessAuthorisationHandler(t *testing.T) {
+// TestRegisterAfterDeactivation pairs a deactivated register again from the
+// register page Vend is sent to
+func TestRegisterAfterDeactivation(t *testing.T) {
+	register := saveRegister(t, "http://pos.example.com", "1234567890")
+	if _, err := term.Deactivate("unit-test", register.Origin, register.VendRegisterID); err != nil {
+		t.Fatal(err)
+	}
 
-	var uniqueID, _ = uuid.NewV4()
-	log.Printf("Generated RegisterID of %s \n", uniqueID)
-	terminal := &terminal.Terminal{
-		FxlDeviceSigningKey: "1234567890", // use hardcoded signing key for dummy endpoint
-		FxlRegisterID:       "Oxipos",
-		FxlSellerID:         "30188105",
-		Origin:              "http://pos.example.com",
-		VendRegisterID:      uniqueID.String(),
-	}
-
-	// we do this to ensure that it's registered already,
-	// otherwise we are going to get a 302
-	saved, err := terminal.Save("unit-test")
-	if saved != true {
-		t.Error("Unable to save register")
-		return
+	form := url.Values{}
+	form.Add("MerchantID", "30188105")
+	form.Add("DeviceToken", "03SUCCES")
+	req, err := http.NewRequest(http.MethodPost, "/register", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+	session, err := getSession(req, "oxipay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["vReq"] = &vend.PaymentRequest{Origin: register.Origin, RegisterID: register.VendRegisterID}
+	if err = session.Save(req, rr); err != nil {
+		t.Fatal(err)
+	}
+
+	RegisterHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %d want %d", rr.Code, http.StatusOK)
+	}
+
+	reactivated, err := term.GetRegister(register.Origin, register.VendRegisterID)
+	if err != nil || !strings.HasPrefix(reactivated.FxlRegisterID, "03SUCCES") {
+		t.Errorf("expected the register to be reactivated with the new device got %+v: %v", reactivated, err)
+	}
+}
+
+// testAdmin the credentials required by the register change endpoints
+var testAdmin = config.AdminConfig{Username: "support", Password: "n7Qw2xLp9vRt4KzM"}
+
+// registerRequest builds a request for one of the register change endpoints
+// for the Vend register, signed in as the admin
+func registerRequest(t *testing.T, target string, form url.Values, register *terminal.Register) *http.Request {
+	if form == nil {
+		form = url.Values{}
+	}
+	form.Set("origin", register.Origin)
+	form.Set("register_id", register.VendRegisterID)
+
+	req, err := http.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
 	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(testAdmin.Username, testAdmin.Password)
+	return req
+}
+
+func TestRegisterLifecycle(t *testing.T) {
+	adminConfig = testAdmin
+	defer func() { adminConfig = config.AdminConfig{} }()
+
+	register := saveRegister(t, "http://pos.example.com", "1234567890")
+
+	form := url.Values{}
+	form.Add("MerchantID", "30188105")
+	form.Add("DeviceToken", "02SUCCES")
 
+	// re-key with a new device token
+	rr := httptest.NewRecorder()
+	adminOnly(RekeyHandler)(rr, registerRequest(t, "/register/rekey", form, register))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("rekey returned wrong status code: got %d want %d", rr.Code, http.StatusOK)
+	}
+
+	rekeyed, err := term.GetRegister(register.Origin, register.VendRegisterID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rekeyed.FxlDeviceSigningKey == register.FxlDeviceSigningKey || !strings.HasPrefix(rekeyed.FxlRegisterID, "02SUCCES") {
+		t.Errorf("expected the device and signing key to be replaced, got %+v", rekeyed)
+	}
+
+	// a deactivated register can't be used
+	rr = httptest.NewRecorder()
+	adminOnly(DeactivateHandler)(rr, registerRequest(t, "/register/deactivate", nil, register))
+	if rr.Code != http.StatusOK {
+		t.Errorf("deactivate returned wrong status code: got %d want %d", rr.Code, http.StatusOK)
+	}
+	if _, err = term.GetRegister(register.Origin, register.VendRegisterID); err != terminal.ErrNotFound {
+		t.Errorf("expected a deactivated register to be hidden, got %v", err)
+	}
+
+	// the change is recorded against the admin
+	registers, err := term.List(terminal.Filter{OriginDomain: register.Origin, VendRegisterID: register.VendRegisterID})
+	if err != nil || len(registers) != 1 || registers[0].ModifiedBy != testAdmin.Username {
+		t.Errorf("expected the register to be modified by %s got %v: %v", testAdmin.Username, registers, err)
+	}
+
+	// deleting removes it entirely
+	rr = httptest.NewRecorder()
+	adminOnly(DeleteRegisterHandler)(rr, registerRequest(t, "/register/delete", nil, register))
+	if rr.Code != http.StatusOK {
+		t.Errorf("delete returned wrong status code: got %d want %d", rr.Code, http.StatusOK)
+	}
+
+	rr = httptest.NewRecorder()
+	adminOnly(RekeyHandler)(rr, registerRequest(t, "/register/rekey", form, register))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("rekey of a deleted register returned wrong status code: got %d want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestRegisterChangeNeedsAdmin(t *testing.T) {
+	adminConfig = testAdmin
+	defer func() { adminConfig = config.AdminConfig{} }()
+
+	register := saveRegister(t, "http://pos.example.com", "1234567891")
+
+	// Index puts any register in the session, so the session isn't enough
+	req := registerRequest(t, "/register/delete", nil, register)
+	req.Header.Del("Authorization")
+	session, err := getSession(req, "oxipay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["vReq"] = &vend.PaymentRequest{Origin: register.Origin, RegisterID: register.VendRegisterID}
+
+	rr := httptest.NewRecorder()
+	adminOnly(DeleteRegisterHandler)(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("delete without credentials returned wrong status code: got %d want %d", rr.Code, http.StatusUnauthorized)
+	}
+
+	req = registerRequest(t, "/register/delete", nil, register)
+	req.SetBasicAuth(testAdmin.Username, "wrong")
+	rr = httptest.NewRecorder()
+	adminOnly(DeleteRegisterHandler)(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("delete with the wrong password returned wrong status code: got %d want %d", rr.Code, http.StatusUnauthorized)
+	}
+
+	// nobody can change registers without an admin password configured
+	adminConfig = config.AdminConfig{}
+	rr = httptest.NewRecorder()
+	adminOnly(DeleteRegisterHandler)(rr, registerRequest(t, "/register/delete", nil, register))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("delete without an admin password returned wrong status code: got %d want %d", rr.Code, http.StatusUnauthorized)
+	}
+
+	if _, err = term.GetRegister(register.Origin, register.VendRegisterID); err != nil {
+		t.Errorf("expected the register to be unchanged: %v", err)
+	}
+}
+
+// TestEncryptedSigningKeys checks that signing keys are encrypted in the
+// database and that rotating the master key re-encrypts every register. It
+// uses its own database as rotation touches every row.
+func TestEncryptedSigningKeys(t *testing.T) {
+	encryptedDb, err := database.Open(config.DbConnection{Driver: database.DriverSQLite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encryptedDb.Close()
+
+	migrator, _ := migrate.NewMigrator(database.DriverSQLite, encryptedDb)
+	if _, err = migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	keyOne := []byte("0123456789abcdef0123456789abcdef")
+	keyTwo := []byte("fedcba9876543210fedcba9876543210")
+
+	plainTerm := terminal.NewTerminal(terminal.NewSQLiteStore(encryptedDb))
+	legacy := terminal.NewRegister("JCjbPGtuniWr", "Oxipos", "30188105", "http://pos.example.com", "legacy")
+	if _, err = plainTerm.Save("unit-test", legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	encryptedTerm := terminal.NewTerminal(terminal.NewSQLiteStore(encryptedDb))
+	encryptedTerm.Keys, _ = keyring.NewKeyring(map[int][]byte{1: keyOne}, 1)
+
+	register := terminal.NewRegister("VK5NGgc7nFJp", "Oxipos", "30188105", "http://pos.example.com", "encrypted")
+	if _, err = encryptedTerm.Save("unit-test", register); err != nil {
+		t.Fatal(err)
+	}
+	if register.FxlDeviceSigningKey != "VK5NGgc7nFJp" {
+		t.Error("saving should not change the caller's register")
+	}
+
+	var stored string
+	var version int
+	row := encryptedDb.QueryRow("SELECT fxl_device_signing_key, key_version FROM oxipay_vend_map WHERE vend_register_id = 'encrypted'")
+	if err = row.Scan(&stored, &version); err != nil {
+		t.Fatal(err)
+	}
+	if stored == "VK5NGgc7nFJp" || version != 1 {
+		t.Errorf("expected an encrypted key with version 1 got %s %d", stored, version)
+	}
+
+	loaded, err := encryptedTerm.GetRegister(register.Origin, register.VendRegisterID)
+	if err != nil || loaded.FxlDeviceSigningKey != "VK5NGgc7nFJp" {
+		t.Fatalf("expected the decrypted key got %+v: %v", loaded, err)
+	}
+	if _, err = plainTerm.GetRegister(register.Origin, register.VendRegisterID); err != terminal.ErrNoKeyring {
+		t.Errorf("expected ErrNoKeyring got %v", err)
+	}
+
+	// rotate to a new master key, the legacy plaintext key is encrypted too
+	encryptedTerm.Keys, _ = keyring.NewKeyring(map[int][]byte{1: keyOne, 2: keyTwo}, 2)
+	rotated, err := encryptedTerm.RotateKeys()
+	if err != nil || rotated != 2 {
+		t.Fatalf("expected 2 registers to be rotated got %d: %v", rotated, err)
+	}
+	if rotated, _ = encryptedTerm.RotateKeys(); rotated != 0 {
+		t.Errorf("expected a second rotation to do nothing got %d", rotated)
+	}
+
+	// the old master key can now be retired
+	encryptedTerm.Keys, _ = keyring.NewKeyring(map[int][]byte{2: keyTwo}, 2)
+	for vendRegisterID, key := range map[string]string{"encrypted": "VK5NGgc7nFJp", "legacy": "JCjbPGtuniWr"} {
+		loaded, err = encryptedTerm.GetRegister("http://pos.example.com", vendRegisterID)
+		if err != nil || loaded.FxlDeviceSigningKey != key || loaded.KeyVersion != 2 {
+			t.Errorf("expected %s with version 2 got %+v: %v", key, loaded, err)
+		}
+	}
+}
+
+func paymentRequest(t *testing.T, register *terminal.Register, saleID string) *http.Request {
 	// Create a request to pass to our handler. We don't have any query parameters for now, so we'll
 	// pass 'nil' as the third parameter.
 	form := url.Values{}
-	form.Add("amount", "4400")
-	form.Add("origin", "http://pos.example.com")
-	form.Add("paymentcode", "01APPROV") // needs a real payment code to succeed against sandbox / prod
-	form.Add("register_id", uniqueID.String())
+	form.Add("amount", "44.00")
+	form.Add("origin", register.Origin)
+	form.Add("paymentcode", "01APPROV")
+	form.Add("register_id", register.VendRegisterID)
+	form.Add("sale_id", saleID)
 
 	req, err := http.NewRequest(http.MethodPost, "/pay", strings.NewReader(form.Encode()))
 
@@ -168,7 +525,10 @@ func TestProcessAuthorisationHandler(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
 
+func servePayment(t *testing.T, req *http.Request) (*httptest.ResponseRecorder, *Response) {
 	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(PaymentHandler)
@@ -176,6 +536,21 @@ func TestProcessAuthorisationHandler(t *testing.T) {
 	// directly and pass in our Request and ResponseRecorder.
 	handler.ServeHTTP(rr, req)
 
+	response := new(Response)
+	body, _ := ioutil.ReadAll(rr.Body)
+	json.Unmarshal(body, response)
+
+	return rr, response
+}
+
+// TestProcessAuthorisationHandler generating oxipay payload assumes a registered device
+// with both Oxipay and the local database
+func TestProcessAuthorisationHandler(t *testing.T) {
+	register := saveRegister(t, "http://pos.example.com", "1234567890")
+	saleID, _ := shortid.Generate()
+
+	rr, response := servePayment(t, paymentRequest(t, register, saleID))
+
 	// Check the status code is what we expect.
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("handler returned wrong status code: got %d want %d",
@@ -183,15 +558,628 @@ func TestProcessAuthorisationHandler(t *testing.T) {
 		return
 	}
 
-	// Check the response body is what we expect.
+	if response.Status != statusAccepted {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			response.Status, statusAccepted)
+	}
 
-	response := new(Response)
-	body, _ := ioutil.ReadAll(rr.Body)
-	err = json.Unmarshal(body, response)
+	// a re-post of the same sale returns the original purchase
+	_, duplicate := servePayment(t, paymentRequest(t, register, saleID))
+	if duplicate.Status != statusAccepted || duplicate.ID != response.ID {
+		t.Errorf("expected the original purchase %s to be returned, got %+v", response.ID, duplicate)
+	}
 
-	if response.Status != "ACCEPTED" {
-		t.Errorf("handler returned unexpected body: got %v want %v",
-			rr.Body.String(), "ACCEPTED")
+	// every call to the gateway is recorded first, so a second transaction
+	// would mean the duplicate was sent to Oxipay
+	if txns, err := ledger.GetBySale(register.Origin, register.VendRegisterID, saleID); err != nil || len(txns) != 1 {
+		t.Errorf("expected the duplicate not to be sent to Oxipay, got %d transactions: %v", len(txns), err)
+	}
+}
+
+// TestPendingOnAnotherInstance re-posts a sale that another proxy sharing the
+// database has sent to Oxipay, it must wait for that outcome
+func TestPendingOnAnotherInstance(t *testing.T) {
+	register := saveRegister(t, "http://pos.example.com", "1234567890")
+	saleID, _ := shortid.Generate()
+
+	pending := &transaction.Transaction{
+		Type:              transaction.TypeAuthorisation,
+		SaleID:            saleID,
+		Origin:            register.Origin,
+		VendRegisterID:    register.VendRegisterID,
+		FxlRegisterID:     register.FxlRegisterID,
+		FxlSellerID:       register.FxlSellerID,
+		Amount:            4400,
+		PosTransactionRef: saleID,
+	}
+	if err := ledger.Begin(pending); err != nil {
+		t.Fatal(err)
+	}
+
+	rr, response := servePayment(t, paymentRequest(t, register, saleID))
+	if rr.Code != http.StatusAccepted || response.Status != statusUnknown || response.Reference != pending.ID {
+		t.Errorf("expected the pending payment %s to be polled got %d %+v", pending.ID, rr.Code, response)
+	}
+	if txns, _ := ledger.GetBySale(register.Origin, register.VendRegisterID, saleID); len(txns) != 1 {
+		t.Errorf("expected the sale not to be sent again, got %d transactions", len(txns))
+	}
+}
+
+func TestRegionMinimumAmount(t *testing.T) {
+	original := regions()
+	defer gateways.Store(original)
+
+	router, err := region.NewRouter(config.HostConfig{
+		Oxipay: config.OxipayConfig{Version: "1.1"},
+		Regions: map[string]config.RegionConfig{
+			"au": {GatewayURL: gateway.URL, Currency: "AUD"},
+			"nz": {GatewayURL: gateway.URL, Currency: "NZD", MinimumAmount: 5000, Hosts: []string{"vend.oxipay.co.nz"}},
+		},
+		DefaultRegion: "au",
+	}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateways.Store(router)
+
+	register := saveRegister(t, "http://pos.example.com", "1234567890")
+
+	// $44 is below the NZ minimum of $50
+	req := paymentRequest(t, register, "")
+	req.Host = "vend.oxipay.co.nz"
+	_, response := servePayment(t, req)
+	if response.Status != statusDeclined || !strings.Contains(response.Message, "50.00 NZD") {
+		t.Errorf("expected the NZ minimum to decline the payment got %+v", response)
+	}
+
+	// the AU region has no minimum
+	req = paymentRequest(t, register, "")
+	req.Host = "vend.oxipay.com.au"
+	if _, response = servePayment(t, req); response.Status != statusAccepted {
+		t.Errorf("expected the payment to be accepted in AU got %+v", response)
+	}
+}
+
+// TestRegionCurrency opens a refund on the AU host for a register paired in NZ,
+// the amount is in the currency of the register's region
+func TestRegionCurrency(t *testing.T) {
+	original := regions()
+	defer gateways.Store(original)
+
+	router, err := region.NewRouter(config.HostConfig{
+		Oxipay: config.OxipayConfig{Version: "1.1"},
+		Regions: map[string]config.RegionConfig{
+			"au": {GatewayURL: gateway.URL, Currency: "AUD"},
+			"nz": {GatewayURL: gateway.URL, Currency: "NZD", Hosts: []string{"vend.oxipay.co.nz"}},
+		},
+		DefaultRegion: "au",
+	}, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateways.Store(router)
+
+	register := saveRegister(t, "http://pos.example.com", "1234567890")
+	register.Region = "nz"
+	if _, err = term.Update("unit-test", register); err != nil {
+		t.Fatal(err)
+	}
+
+	query := url.Values{}
+	query.Add("amount", "-10.00")
+	query.Add("origin", register.Origin)
+	query.Add("register_id", register.VendRegisterID)
+	req := httptest.NewRequest(http.MethodGet, "/?"+query.Encode(), nil)
+	req.Host = "vend.oxipay.com.au"
+	rr := httptest.NewRecorder()
+	Index(rr, req)
+
+	// the refund reads the amount back from the session and parses it in NZD
+	form := url.Values{}
+	form.Add("purchaseno", "41000002")
+	refund := httptest.NewRequest(http.MethodPost, "/refund", strings.NewReader(form.Encode()))
+	refund.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	refund.Host = req.Host
+	for _, cookie := range rr.Result().Cookies() {
+		refund.AddCookie(cookie)
+	}
+	if response := serveRefund(t, refund); response.Status != statusAccepted {
+		t.Fatalf("expected the refund to be accepted got %+v", response)
+	}
+
+	var refunded int64
+	if err = Db.QueryRow(`SELECT amount FROM oxipay_vend_transaction WHERE purchase_number = ?`, "41000002").Scan(&refunded); err != nil || refunded != 1000 {
+		t.Errorf("expected a refund of 10.00 NZD got %d: %v", refunded, err)
+	}
+}
+
+func TestWebhookNotification(t *testing.T) {
+	events := make(chan *webhook.Event, 1)
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := new(webhook.Event)
+		json.NewDecoder(r.Body).Decode(event)
+		events <- event
+	}))
+	defer subscriber.Close()
+
+	dispatcher := webhook.NewDispatcher(
+		webhook.NewQueue(database.DriverSQLite, Db),
+		[]webhook.Subscriber{{URL: subscriber.URL, Secret: "finance-secret", Events: []string{"payment.approved"}}},
+		log,
+	)
+	dispatcher.Start()
+	ledger.OnComplete = dispatcher.Publish
+	defer func() {
+		ledger.OnComplete = nil
+		dispatcher.Stop(context.Background())
+	}()
+
+	register := saveRegister(t, "http://pos.example.com", "1234567890")
+	saleID, _ := shortid.Generate()
+	_, response := servePayment(t, paymentRequest(t, register, saleID))
+
+	select {
+	case event := <-events:
+		if event.SaleID != saleID || event.PurchaseNumber != response.ID || event.Amount != 4400 {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the payment was not sent to the subscriber")
+	}
+}
+
+func TestAuditedPayment(t *testing.T) {
+	register := saveRegister(t, "http://pos.example.com", "1234567890")
+	saleID, _ := shortid.Generate()
+
+	// nginx is the only proxy trusted to set X-Forwarded-For
+	proxies, err := audit.ParseProxies([]string{"10.0.0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies = proxies
+	defer func() { trustedProxies = nil }()
+
+	req := paymentRequest(t, register, saleID)
+	req.RemoteAddr = "10.0.0.5:41234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.7")
+
+	rr := httptest.NewRecorder()
+	audited(audit.ActionPay, PaymentHandler)(rr, req)
+
+	entries, err := auditLog.List(audit.Filter{VendRegisterID: register.VendRegisterID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 audit entry got %d", len(entries))
+	}
+
+	entry := entries[0]
+	if entry.Action != audit.ActionPay || entry.Actor != anonymous || !strings.Contains(entry.Details, register.Origin) || entry.Outcome != statusAccepted {
+		t.Errorf("unexpected audit entry %+v", entry)
+	}
+	if entry.ClientIP != "198.51.100.7" {
+		t.Errorf("expected the address added by nginx got %s", entry.ClientIP)
+	}
+	if strings.Contains(entry.Details, "01APPROV") || !strings.Contains(entry.Details, audit.Redacted) {
+		t.Errorf("expected the payment code to be redacted got %s", entry.Details)
+	}
+}
+
+func TestMigrateCommand(t *testing.T) {
+	migrator, err := migrate.NewMigrator(database.DriverSQLite, Db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// TestMain has already applied every migration
+	pending, err := migrator.Pending()
+	if err != nil || len(pending) != 0 {
+		t.Errorf("expected no pending migrations got %d: %v", len(pending), err)
+	}
+	if err = runMigrate(migrator, "status"); err != nil {
+		t.Error(err)
+	}
+	if err = runMigrate(migrator, "sideways"); err == nil {
+		t.Error("expected an unknown command to be refused")
+	}
+}
+
+func TestTerminalCommand(t *testing.T) {
+	register := saveRegister(t, "https://terminal.vendhq.com", "1234567890")
+	saved, err := term.List(terminal.Filter{VendRegisterID: register.VendRegisterID})
+	if err != nil || len(saved) != 1 {
+		t.Fatalf("expected the register to be saved: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err = runTerminal(&out, "list", []string{"-origin", register.Origin}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), register.VendRegisterID) {
+		t.Errorf("expected the register to be listed got %s", out.String())
+	}
+
+	out.Reset()
+	id := strconv.FormatInt(saved[0].ID, 10)
+	if err = runTerminal(&out, "show", []string{id}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "1234567890") {
+		t.Error("the signing key must never be shown")
+	}
+
+	if err = runTerminal(&out, "delete", []string{id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = term.GetRegister(register.Origin, register.VendRegisterID); err == nil {
+		t.Error("expected the register to be deleted")
+	}
+	entries, _ := auditLog.List(audit.Filter{Action: audit.ActionDelete, VendRegisterID: register.VendRegisterID})
+	if len(entries) != 1 {
+		t.Errorf("expected the deletion to be audited got %d entries", len(entries))
+	}
+
+	if err = runTerminal(&out, "show", []string{"not-an-id"}); err == nil {
+		t.Error("expected an invalid ID to be refused")
+	}
+}
+
+func TestSign(t *testing.T) {
+	payload := &oxipay.AuthorisationPayload{
+		MerchantID:        "30188105",
+		DeviceID:          "Oxipos",
+		PosTransactionRef: "txn-1",
+		PreApprovalCode:   "01APPROV",
+		PurchaseAmount:    "4400",
+	}
+	expected := oxipay.SignMessage(oxipay.GeneratePlainTextSignature(payload), "1234567890")
+	payload.Signature = expected
+	body, _ := json.Marshal(payload)
+
+	var out bytes.Buffer
+	if err := sign(bytes.NewReader(body), &out, "1234567890", "authorisation"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), expected) || !strings.Contains(out.String(), "matches") {
+		t.Errorf("expected the signature to match got %s", out.String())
+	}
+
+	out.Reset()
+	if err := sign(bytes.NewReader(body), &out, "wrong-key", "authorisation"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "does not match") {
+		t.Errorf("expected the signature not to match got %s", out.String())
+	}
+
+	if err := sign(bytes.NewReader(body), &out, "1234567890", "invoice"); err == nil {
+		t.Error("expected an unknown payload type to be refused")
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	hostConfig := config.HostConfig{
+		Database: config.DbConnection{Driver: database.DriverSQLite, Name: ":memory:"},
+		Oxipay:   config.OxipayConfig{GatewayURL: gateway.URL},
+	}
+	checker := newHealthChecker(Db, hostConfig)
+
+	rr := httptest.NewRecorder()
+	checker.ReadyHandler(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	var report health.Report
+	json.Unmarshal(rr.Body.Bytes(), &report)
+	if rr.Code != http.StatusOK || len(report.Checks) != 3 {
+		t.Errorf("expected the database, gateway and templates to be ready got %d %+v", rr.Code, report)
+	}
+
+	// a gateway that can't be resolved isn't ready
+	hostConfig.Oxipay.GatewayURL = "https://gateway.invalid/webapi/v1/"
+	rr = httptest.NewRecorder()
+	newHealthChecker(Db, hostConfig).ReadyHandler(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %d for an unknown gateway got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+}
+
+// TestMetrics checks a payment is counted once it has been recorded
+func TestMetrics(t *testing.T) {
+	register := saveRegister(t, "http://pos.example.com", "1234567890")
+	saleID, _ := shortid.Generate()
+	servePayment(t, paymentRequest(t, register, saleID))
+
+	rr := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	expected := []string{
+		`vendproxy_oxipay_transactions_total{code="SPRA01",status="APPROVED",type="authorisation"}`,
+		`vendproxy_oxipay_request_duration_seconds_count{endpoint="ProcessAuthorisation"}`,
+		`vendproxy_register_lookup_duration_seconds_count`,
+	}
+	for _, metric := range expected {
+		if !strings.Contains(rr.Body.String(), metric) {
+			t.Errorf("expected %s to be exposed", metric)
+		}
+	}
+}
+
+// TestDrainablePayments ensures a shutdown waits for a payment that is with the
+// gateway and that new payments are refused once it has started
+func TestDrainablePayments(t *testing.T) {
+	defer func(group *drain.Group) { inFlight = group }(inFlight)
+	inFlight = drain.NewGroup()
+
+	register := saveRegister(t, "http://pos.example.com", "1234567890")
+	saleID, _ := shortid.Generate()
+	sim.Script(simulator.EndpointProcessAuthorisation, simulator.Behaviour{Delay: 50 * time.Millisecond})
+
+	handler := drainable(PaymentHandler)
+	req := paymentRequest(t, register, saleID)
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		done <- rr
+	}()
+
+	// wait for the payment to reach the gateway before shutting down
+	for i := 0; i < 100 && !inFlightPayment(register, saleID); i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := inFlight.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case rr := <-done:
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected the in-flight payment to complete got %d", rr.Code)
+		}
+	default:
+		t.Fatal("Drain returned before the in-flight payment completed")
+	}
+
+	approved, err := ledger.GetApprovedAuthorisation(register.Origin, register.VendRegisterID, saleID)
+	if err != nil || approved == nil {
+		t.Errorf("expected the approval to be recorded before shutting down: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler(rr, paymentRequest(t, register, "after-shutdown"))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %d once draining got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+}
+
+// inFlightPayment reports whether the sale has been sent to the gateway
+func inFlightPayment(register *terminal.Register, saleID string) bool {
+	txns, _ := ledger.GetBySale(register.Origin, register.VendRegisterID, saleID)
+	return len(txns) > 0
+}
+
+// withReconciler swaps in a client that gives up quickly and a reconciler that
+// retries straight away, the returned func restores the originals
+func withReconciler(timeout time.Duration) func() {
+	router, original := regions(), reconciler
+
+	gateways.Store(newRouter(oxipay.WithTimeout(timeout)))
+	reconciler = transaction.NewReconciler(ledger, log)
+	reconciler.Backoff = 50 * time.Millisecond
+	reconciler.MaxAttempts = 3
+
+	return func() {
+		reconciler.Stop(context.Background())
+		gateways.Store(router)
+		reconciler = original
+	}
+}
+
+// pollStatus polls /pay/status until the outcome of the payment is known
+func pollStatus(t *testing.T, register *terminal.Register, reference string) *Response {
+	query := url.Values{}
+	query.Add("reference", reference)
+	query.Add("origin", register.Origin)
+	query.Add("register_id", register.VendRegisterID)
+
+	for i := 0; i < 100; i++ {
+		rr := httptest.NewRecorder()
+		PaymentStatusHandler(rr, httptest.NewRequest(http.MethodGet, "/pay/status?"+query.Encode(), nil))
+
+		response := new(Response)
+		json.Unmarshal(rr.Body.Bytes(), response)
+		if rr.Code != http.StatusAccepted {
+			return response
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("the payment was never reconciled")
+	return nil
+}
+
+// TestLostResponseIsReconciled times out before Oxipay answers, the payment is
+// UNKNOWN until the replay is approved
+func TestLostResponseIsReconciled(t *testing.T) {
+	defer withReconciler(50 * time.Millisecond)()
+
+	register := saveRegister(t, "http://pos.example.com", "1234567890")
+	saleID, _ := shortid.Generate()
+	sim.Script(simulator.EndpointProcessAuthorisation, simulator.Behaviour{Delay: time.Second})
+
+	rr, response := servePayment(t, paymentRequest(t, register, saleID))
+	if rr.Code != http.StatusAccepted || response.Status != statusUnknown || response.Reference == "" {
+		t.Fatalf("expected an UNKNOWN payment got %d %+v", rr.Code, response)
+	}
+
+	// a re-post must not be sent to Oxipay while the payment is reconciled
+	_, duplicate := servePayment(t, paymentRequest(t, register, saleID))
+	if duplicate.Reference != response.Reference {
+		t.Errorf("expected reference %s got %+v", response.Reference, duplicate)
+	}
+
+	reconciled := pollStatus(t, register, response.Reference)
+	if reconciled.Status != statusAccepted || reconciled.ID == "" {
+		t.Errorf("expected the payment to be accepted got %+v", reconciled)
+	}
+
+	// the status belongs to the register that made the payment
+	rr = httptest.NewRecorder()
+	PaymentStatusHandler(rr, httptest.NewRequest(http.MethodGet, "/pay/status?reference="+response.Reference+"&origin=http://other.example.com", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected %d for another register got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+// TestClosedPaymentWindow closes the Vend window while the payment is with
+// Oxipay. A duplicate is waiting on the same call, so it isn't abandoned and
+// the duplicate receives the outcome.
+func TestClosedPaymentWindow(t *testing.T) {
+	register := saveRegister(t, "http://pos.example.com", "1234567890")
+	saleID, _ := shortid.Generate()
+	sim.Script(simulator.EndpointProcessAuthorisation, simulator.Behaviour{Delay: 200 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		servePayment(t, paymentRequest(t, register, saleID).WithContext(ctx))
+	}()
+
+	// the duplicate arrives before the first window is closed
+	time.Sleep(20 * time.Millisecond)
+	_, duplicate := servePayment(t, paymentRequest(t, register, saleID))
+	<-done
+
+	approved, err := ledger.GetApprovedAuthorisation(register.Origin, register.VendRegisterID, saleID)
+	if err != nil || approved == nil {
+		t.Fatalf("expected the payment to be approved: %v", err)
+	}
+	if duplicate.Status != statusAccepted || duplicate.ID != approved.PurchaseNumber {
+		t.Errorf("expected the duplicate to get purchase %s got %+v", approved.PurchaseNumber, duplicate)
+	}
+}
+
+// TestClosedSaleWindow closes the only Vend window waiting for a sale, the
+// call to Oxipay is abandoned with it
+func TestClosedSaleWindow(t *testing.T) {
+	defer withReconciler(time.Second)()
+
+	register := saveRegister(t, "http://pos.example.com", "1234567890")
+	saleID, _ := shortid.Generate()
+	sim.Script(simulator.EndpointProcessAuthorisation, simulator.Behaviour{Delay: 200 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	servePayment(t, paymentRequest(t, register, saleID).WithContext(ctx))
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Errorf("expected the gateway call to be abandoned with the window, took %s", elapsed)
+	}
+
+	txns, err := ledger.GetBySale(register.Origin, register.VendRegisterID, saleID)
+	if err != nil || len(txns) != 1 || txns[0].Status == oxipay.StatusApproved {
+		t.Errorf("expected the abandoned payment not to be approved got %+v: %v", txns, err)
+	}
+}
+
+// TestDroppedResponseIsApproved processes the payment but drops the response,
+// the replay is refused because Oxipay has already approved it
+func TestDroppedResponseIsApproved(t *testing.T) {
+	defer withReconciler(time.Second)()
+
+	register := saveRegister(t, "http://pos.example.com", "1234567890")
+	saleID, _ := shortid.Generate()
+	sim.Script(simulator.EndpointProcessAuthorisation, simulator.Behaviour{Drop: true})
+
+	rr, response := servePayment(t, paymentRequest(t, register, saleID))
+	if rr.Code != http.StatusAccepted || response.Status != statusUnknown {
+		t.Fatalf("expected an UNKNOWN payment got %d %+v", rr.Code, response)
+	}
+
+	reconciled := pollStatus(t, register, response.Reference)
+	if reconciled.Status != statusAccepted {
+		t.Errorf("expected the payment to be accepted got %+v", reconciled)
+	}
+
+	txn, err := ledger.Get(response.Reference)
+	if err != nil || txn.Status != oxipay.StatusApproved || txn.PurchaseNumber == "" {
+		t.Errorf("expected the ledger to record the approval and its purchase got %+v: %v", txn, err)
+	}
+}
+
+// TestAbandonedPayment cancels a payment without a sale ID while it is with
+// Oxipay, Oxipay may have processed it so it is reconciled
+func TestAbandonedPayment(t *testing.T) {
+	defer withReconciler(time.Second)()
+
+	register := saveRegister(t, "http://pos.example.com", "1234567890")
+	sim.Script(simulator.EndpointProcessAuthorisation, simulator.Behaviour{Delay: 200 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	servePayment(t, paymentRequest(t, register, "").WithContext(ctx))
+
+	// without a sale ID the transaction can only be found by its register
+	var id string
+	if err := Db.QueryRow(`SELECT id FROM oxipay_vend_transaction WHERE vend_register_id = ?`, register.VendRegisterID).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	reconciled := pollStatus(t, register, id)
+	if reconciled.Status != statusAccepted {
+		t.Errorf("expected the abandoned payment to be reconciled as accepted got %+v", reconciled)
+	}
+}
+
+func TestProcessAuthorisationDeclined(t *testing.T) {
+	register := saveRegister(t, "http://pos.example.com", "1234567890")
+	saleID, _ := shortid.Generate()
+
+	sim.Script(simulator.EndpointProcessAuthorisation, simulator.Behaviour{Code: "FPRA21"})
+
+	rr, response := servePayment(t, paymentRequest(t, register, saleID))
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %d want %d",
+			status, http.StatusOK)
+	}
+	if response.Status != statusDeclined {
+		t.Errorf("handler returned unexpected status: got %v want %v",
+			response.Status, statusDeclined)
+	}
+}
+
+func TestProcessAuthorisationBadSignature(t *testing.T) {
+	register := saveRegister(t, "http://pos.example.com", "1234567890")
+	saleID, _ := shortid.Generate()
+
+	sim.Script(simulator.EndpointProcessAuthorisation, simulator.Behaviour{BadSignature: true})
+
+	rr, _ := servePayment(t, paymentRequest(t, register, saleID))
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %d want %d",
+			status, http.StatusBadRequest)
+	}
+}
+
+func TestProcessAuthorisationMalformedResponse(t *testing.T) {
+	register := saveRegister(t, "http://pos.example.com", "1234567890")
+	saleID, _ := shortid.Generate()
+
+	sim.Script(simulator.EndpointProcessAuthorisation, simulator.Behaviour{Malformed: true})
+
+	rr, _ := servePayment(t, paymentRequest(t, register, saleID))
+
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %d want %d",
+			status, http.StatusInternalServerError)
 	}
 }
 
@@ -227,46 +1215,150 @@ func TestProcessAuthorisationRedirect(t *testing.T) {
 			status, http.StatusFound)
 	}
 
-	if location := rr.HeaderMap.Get("Location"); location != "/register" {
+	if location := rr.Header().Get("Location"); location != "/register" {
 		t.Errorf("Function redirects but redirects to %s rather than /register", location)
 	}
 }
 
-func TestProcessSalesAdjustmentHandler(t *testing.T) {
+// refundRequest builds a refund of amount cents against the purchase with the
+// amount and the register saved in the session
+func refundRequest(t *testing.T, register *terminal.Register, amount int64, purchaseNumber string, saleID string) *http.Request {
+	form := url.Values{}
+	form.Add("purchaseno", purchaseNumber)
+	form.Add("sale_id", saleID)
 
-	var uniqueID, _ = uuid.NewV4()
-	log.Printf("Generated Refund TxID of : %s \n", uniqueID)
+	req, err := http.NewRequest(http.MethodPost, "/refund", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	vendRegisterID := "0afa8de1-1442-11e8-edec-94863fd13a3c"
-	origin := "https://amtest.vendhq.com"
+	session, err := getSession(req, "oxipay")
+	if err != nil {
+		t.Fatal("Can't get the session")
+	}
+	session.Values["vReq"] = &vend.PaymentRequest{
+		Amount:     vend.NewMoney(-amount, regions().Default.Currency).String(),
+		Origin:     register.Origin,
+		RegisterID: register.VendRegisterID,
+	}
+	return req
+}
+
+func serveRefund(t *testing.T, req *http.Request) *Response {
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(RefundHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %d want %d", rr.Code, http.StatusOK)
+	}
+
+	response := new(Response)
+	if err := json.NewDecoder(rr.Body).Decode(response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestPartialRefunds(t *testing.T) {
+	register := saveRegister(t, "https://amtest.vendhq.com", "1234567890")
+	saleID, _ := shortid.Generate()
+
+	_, payment := servePayment(t, paymentRequest(t, register, saleID))
+	if payment.Status != statusAccepted {
+		t.Fatalf("expected the payment to be accepted got %+v", payment)
+	}
+
+	var refunds = []struct {
+		amount    int64
+		status    string
+		remaining string
+	}{
+		{2000, statusAccepted, "24.00"},
+		{2401, statusDeclined, "24.00"},
+		{2400, statusAccepted, "0.00"},
+		{1, statusDeclined, "0.00"},
+	}
+	for _, tt := range refunds {
+		response := serveRefund(t, refundRequest(t, register, tt.amount, payment.ID, ""))
+		if response.Status != tt.status || response.Remaining != tt.remaining {
+			t.Errorf("refund of %d: expected %s with %s remaining got %+v", tt.amount, tt.status, tt.remaining, response)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/refund/balance?purchaseno="+payment.ID, nil)
+	session, _ := getSession(req, "oxipay")
+	session.Values["vReq"] = &vend.PaymentRequest{Origin: register.Origin, RegisterID: register.VendRegisterID}
+	rr := httptest.NewRecorder()
+	RefundBalanceHandler(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"remaining":"0.00"`) {
+		t.Errorf("unexpected balance %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRefundPurchaseLookup(t *testing.T) {
+	register := saveRegister(t, "https://amtest.vendhq.com", "1234567890")
+	saleID, _ := shortid.Generate()
+
+	_, payment := servePayment(t, paymentRequest(t, register, saleID))
+	if payment.Status != statusAccepted {
+		t.Fatalf("expected the payment to be accepted got %+v", payment)
+	}
+
+	// the refund page finds the purchase from the original sale
+	returnID, _ := shortid.Generate()
+	req := httptest.NewRequest(http.MethodGet, "/refund/purchase?sale_id="+returnID+"&original_sale_id="+saleID, nil)
+	session, _ := getSession(req, "oxipay")
+	session.Values["vReq"] = &vend.PaymentRequest{Origin: register.Origin, RegisterID: register.VendRegisterID}
+	rr := httptest.NewRecorder()
+	RefundPurchaseHandler(rr, req)
+
+	purchase := new(Response)
+	json.NewDecoder(rr.Body).Decode(purchase)
+	if rr.Code != http.StatusOK || purchase.ID != payment.ID || purchase.Remaining != "44.00" {
+		t.Errorf("expected purchase %s with 44.00 remaining got %d %+v", payment.ID, rr.Code, purchase)
+	}
+
+	// a refund without a purchase number is matched to the sale
+	req = refundRequest(t, register, 1000, "", saleID)
+	if response := serveRefund(t, req); response.Status != statusAccepted || response.Remaining != "34.00" {
+		t.Errorf("expected the refund to be matched to purchase %s got %+v", payment.ID, response)
+	}
+
+	// legacy sales still need the purchase number
+	req = refundRequest(t, register, 1000, "", returnID)
+	if response := serveRefund(t, req); response.Status != statusDeclined {
+		t.Errorf("expected the refund to be declined got %+v", response)
+	}
+}
+
+func TestProcessSalesAdjustmentHandler(t *testing.T) {
+	register := saveRegister(t, "https://amtest.vendhq.com", "1234567890")
 
 	// establish the session and save the amount and the register in the session
 	vReq := &vend.PaymentRequest{
-		Amount:     "4401",
-		Origin:     origin,
-		RegisterID: vendRegisterID,
+		Amount:     vend.NewMoney(-4401, regions().Default.Currency).String(),
+		Origin:     register.Origin,
+		RegisterID: register.VendRegisterID,
 	}
 
-	// posTerminal, err := terminal.GetRegisteredTerminal("http://pos.example.com", vendRegisterID)
-
 	// Create a request to pass to our handler. We don't have any query parameters for now, so we'll
 	// pass 'nil' as the third parameter.
+	// the purchase wasn't made through the proxy, so its balance can't be checked
 	form := url.Values{}
-	form.Add("purchasenumber", "01APPROV") // needs a real payment code to succeed against sandbox / prod
+	form.Add("purchaseno", "41000001")
 
 	req, err := http.NewRequest(http.MethodPost, "/refund", strings.NewReader(form.Encode()))
-	session, err := getSession(req, "oxipay")
-
 	if err != nil {
-		t.Error("Can't get the session")
+		t.Fatal(err)
 	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	session.Values["vReq"] = vReq
-
+	session, err := getSession(req, "oxipay")
 	if err != nil {
-		t.Fatal(err)
+		t.Fatal("Can't get the session")
 	}
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	session.Values["vReq"] = vReq
 
 	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
 	rr := httptest.NewRecorder()
@@ -287,27 +1379,22 @@ func TestProcessSalesAdjustmentHandler(t *testing.T) {
 	body, _ := ioutil.ReadAll(rr.Body)
 	err = json.Unmarshal(body, response)
 
-	if response.Status != "ACCEPTED" {
+	if response.Status != statusAccepted {
 		t.Errorf("handler returned unexpected body: got %v want %v",
-			rr.Body.String(), "ACCEPTED")
+			rr.Body.String(), statusAccepted)
 	}
 }
 
 func TestProcessAuthorisationResponse(t *testing.T) {
 
-	terminal, err := terminal.GetRegisteredTerminal("https://amtest.vendhq.com", "0afa8de1-1442-11e8-edec-94863fd13a3c")
-	if err != nil {
-		t.Error(err)
-	}
+	reponse := `{"x_purchase_number":"52011913","x_status":"Success","x_code":"SPRA01","x_message":"Approved","signature":"5bd9c0980eae4340a17a3cb17a4e1be36e4b535cec11dee4981245743b6782ce","tracking_data":null}`
 
-	reponse := `{"x_purchase_number":"52011913","x_status":"Success","x_code":"SPRA01","x_message":"Approved","signature":"3b715be8fdd67decd299cbb14ceeec3c76667d48e3468e4d3f343602d9b7d690","tracking_data":null}`
-
-	oxipayResponse := new(oxipay.OxipayResponse)
-	err = json.Unmarshal([]byte(reponse), oxipayResponse)
+	oxipayResponse := new(oxipay.Response)
+	err := json.Unmarshal([]byte(reponse), oxipayResponse)
 	if err != nil {
 		t.Error(err)
 	}
-	isValid := oxipayResponse.Authenticate(terminal.FxlDeviceSigningKey)
+	isValid, _ := oxipayResponse.Authenticate("1234567890")
 
 	if isValid == false {
 		t.Error("Not a valid request")
@@ -325,16 +1412,16 @@ func TestRegistrationResponse(t *testing.T) {
 		"x_status": "Success",
 		"x_code": "SCRK01",
 		"x_message": "Success",
-		"signature": "ff05ed059e8008a3e8e1210faee30ce0064e492f34709151804a32725d8441db",
+		"signature": "f715b74ef9015c940ff639b2692c4ac44cc21466ca279c39139464c5ec108fb6",
 		"tracking_data": null
 	 }`
 
-	oxipayResponse := new(oxipay.OxipayResponse)
+	oxipayResponse := new(oxipay.Response)
 	err := json.Unmarshal([]byte(rawResponse), oxipayResponse)
 	if err != nil {
 		t.Error(err)
 	}
-	isValid := oxipayResponse.Authenticate("Voh4ig3eepeedai8")
+	isValid, _ := oxipayResponse.Authenticate("Voh4ig3eepeedai8")
 
 	if isValid == false {
 		t.Error("Not a valid request")
@@ -349,8 +1436,7 @@ func TestRegistrationResponse(t *testing.T) {
 
 func TestGeneratePayload(t *testing.T) {
 
-	log.Print("hello")
-	oxipayPayload := oxipay.OxipayPayload{
+	oxipayPayload := &oxipay.AuthorisationPayload{
 		DeviceID:        "foobar",
 		MerchantID:      "3342342",
 		FinanceAmount:   "1000",
@@ -364,9 +1450,86 @@ func TestGeneratePayload(t *testing.T) {
 	t.Log("Plaintext", plainText)
 
 	signature := oxipay.SignMessage(plainText, "TEST")
-	correctSig := "7dfd655530d41cee284b3e4cb7d08a058edf7b5641dffd15fdf1b61ff6a8699b"
+	correctSig := "db48103e40011d084b48f3772b8448ed77ac8597b78c97eb9574e05f67973892"
 
 	if signature != correctSig {
 		t.Fatalf("expected %s but got %s", correctSig, signature)
 	}
 }
+
+func TestReload(t *testing.T) {
+	original := regions()
+	defer gateways.Store(original)
+	defer log.SetLevel(logrus.DebugLevel)
+
+	// dev allows the simulator over http
+	os.Setenv("DEV", "true")
+	defer os.Unsetenv("DEV")
+
+	f, err := ioutil.TempFile("", "vendproxy*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	write := func(loglevel string) {
+		contents := `{
+			"database": {"driver": "sqlite3"},
+			"session": {"secret": "` + config.SampleSecret + `"},
+			"oxipay": {"gatewayurl": "` + gateway.URL + `"},
+			"loglevel": "` + loglevel + `"
+		}`
+		if err := ioutil.WriteFile(f.Name(), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("warn")
+	current := reload(config.HostConfig{File: f.Name()})
+	if log.GetLevel() != logrus.WarnLevel || current.LogLevel != "warn" {
+		t.Errorf("expected the log level to be reloaded got %s", log.GetLevel())
+	}
+	router := regions()
+	if router == original {
+		t.Error("expected the gateway clients to be replaced")
+	}
+
+	// an invalid configuration is rejected and the current one kept
+	write("verbose")
+	if reloaded := reload(current); reloaded.LogLevel != "warn" {
+		t.Errorf("expected the current configuration to be kept got %s", reloaded.LogLevel)
+	}
+	if log.GetLevel() != logrus.WarnLevel || regions() != router {
+		t.Error("expected an invalid configuration not to be applied")
+	}
+}
+
+func TestOxipayOptions(t *testing.T) {
+	options, err := oxipayOptions(config.OxipayConfig{
+		ConnectTimeout: "2s",
+		Timeout:        "30s",
+		MaxIdleConns:   4,
+		Proxy:          "http://proxy.internal:3128",
+		Retries:        2,
+		RetryBackoff:   "100ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the observer, both timeouts, idle connections, proxy and retries
+	if len(options) != 6 {
+		t.Errorf("expected 6 options got %d", len(options))
+	}
+
+	var invalid = []config.OxipayConfig{
+		{Timeout: "forever"},
+		{ConnectTimeout: "10"},
+		{Retries: 1, RetryBackoff: "soon"},
+		{CAFile: "/does/not/exist.pem"},
+	}
+	for _, oxipayConfig := range invalid {
+		if _, err = oxipayOptions(oxipayConfig); err == nil {
+			t.Errorf("expected an error for %+v", oxipayConfig)
+		}
+	}
+}
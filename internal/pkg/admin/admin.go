@@ -0,0 +1,410 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/audit"
+	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+	"github.com/oxipay/oxipay-vend/internal/pkg/terminal"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultLimit = 50
+	maxLimit     = 500
+)
+
+// Handler serves the admin API under /admin/. Every request must supply the
+// configured credentials using HTTP basic auth.
+type Handler struct {
+	Terminal *terminal.Terminal
+	Audit    AuditLog
+	Config   config.AdminConfig
+	Log      *logrus.Logger
+	mux      *http.ServeMux
+}
+
+// Register is the representation of a terminal.Register returned by the admin
+// API. It intentionally has no signing key.
+type Register struct {
+	ID             int64      `json:"id"`
+	OriginDomain   string     `json:"origin_domain"`
+	VendRegisterID string     `json:"vend_register_id"`
+	FxlSellerID    string     `json:"fxl_seller_id"`
+	FxlRegisterID  string     `json:"fxl_register_id"`
+	KeyVersion     int        `json:"key_version"`
+	Region         string     `json:"region,omitempty"`
+	Active         bool       `json:"active"`
+	CreatedDate    time.Time  `json:"created_date"`
+	CreatedBy      string     `json:"created_by"`
+	ModifiedDate   *time.Time `json:"modified_date,omitempty"`
+	ModifiedBy     string     `json:"modified_by,omitempty"`
+}
+
+// RegisterList is a single page of registers
+type RegisterList struct {
+	Registers []*Register `json:"registers"`
+	Total     int         `json:"total"`
+	Limit     int         `json:"limit"`
+	Offset    int         `json:"offset"`
+}
+
+// AuditLog is the part of audit.Log used by the admin API
+type AuditLog interface {
+	List(filter audit.Filter) ([]*audit.Entry, error)
+	Count(filter audit.Filter) (int, error)
+	Verify() (checked int, invalid int64, err error)
+}
+
+// AuditList is a single page of audit entries
+type AuditList struct {
+	Entries []*audit.Entry `json:"entries"`
+	Total   int            `json:"total"`
+	Limit   int            `json:"limit"`
+	Offset  int            `json:"offset"`
+}
+
+// AuditVerification is the result of checking the hash chain of the audit log
+type AuditVerification struct {
+	Valid     bool  `json:"valid"`
+	Checked   int   `json:"checked"`
+	InvalidID int64 `json:"invalid_id,omitempty"`
+}
+
+type errorResponse struct {
+	Message string `json:"message"`
+}
+
+// NewHandler returns the admin API handler
+func NewHandler(term *terminal.Terminal, auditLog AuditLog, adminConfig config.AdminConfig, log *logrus.Logger) *Handler {
+	h := &Handler{
+		Terminal: term,
+		Audit:    auditLog,
+		Config:   adminConfig,
+		Log:      log,
+		mux:      http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("/admin/registers", h.listRegisters)
+	h.mux.HandleFunc("/admin/registers.csv", h.exportRegisters)
+	h.mux.HandleFunc("/admin/registers/", h.getRegister)
+	h.mux.HandleFunc("/admin/audit", h.listAudit)
+	h.mux.HandleFunc("/admin/audit/verify", h.verifyAudit)
+
+	return h
+}
+
+// ServeHTTP implements http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authenticated(r) {
+		h.Log.WithFields(logrus.Fields{
+			"module": "admin",
+			"remote": r.RemoteAddr,
+			"path":   r.URL.Path,
+		}).Warn("Admin API authentication failed")
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="vendproxy admin"`)
+		sendJSON(w, http.StatusUnauthorized, errorResponse{Message: "Unauthorized"})
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		sendJSON(w, http.StatusMethodNotAllowed, errorResponse{Message: "Method not allowed"})
+		return
+	}
+
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) authenticated(r *http.Request) bool {
+	_, ok := Authenticate(h.Config, r)
+	return ok
+}
+
+// Authenticate checks the basic auth credentials of the request against the
+// admin credentials and returns the username. Nobody is authenticated when no
+// admin password is configured.
+func Authenticate(c config.AdminConfig, r *http.Request) (string, bool) {
+	username, password, ok := r.BasicAuth()
+	if !ok || c.Password == "" {
+		return "", false
+	}
+
+	// compare both so that the time taken doesn't reveal which was wrong
+	validUser := subtle.ConstantTimeCompare([]byte(username), []byte(c.Username))
+	validPassword := subtle.ConstantTimeCompare([]byte(password), []byte(c.Password))
+	if validUser&validPassword != 1 {
+		return "", false
+	}
+	return username, true
+}
+
+// listRegisters GET /admin/registers?origin_domain=&fxl_seller_id=&vend_register_id=&limit=&offset=
+func (h *Handler) listRegisters(w http.ResponseWriter, r *http.Request) {
+	filter, err := bindFilter(r)
+	if err != nil {
+		sendJSON(w, http.StatusBadRequest, errorResponse{Message: err.Error()})
+		return
+	}
+
+	registers, err := h.Terminal.List(filter)
+	if err != nil {
+		h.Log.Error(err)
+		sendJSON(w, http.StatusServiceUnavailable, errorResponse{Message: "Unable to list registers"})
+		return
+	}
+
+	total, err := h.Terminal.Count(filter)
+	if err != nil {
+		h.Log.Error(err)
+		sendJSON(w, http.StatusServiceUnavailable, errorResponse{Message: "Unable to list registers"})
+		return
+	}
+
+	list := &RegisterList{
+		Registers: make([]*Register, 0, len(registers)),
+		Total:     total,
+		Limit:     filter.Limit,
+		Offset:    filter.Offset,
+	}
+	for _, register := range registers {
+		list.Registers = append(list.Registers, newRegister(register))
+	}
+
+	sendJSON(w, http.StatusOK, list)
+}
+
+// getRegister GET /admin/registers/{id}
+func (h *Handler) getRegister(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/admin/registers/"), 10, 64)
+	if err != nil {
+		sendJSON(w, http.StatusNotFound, errorResponse{Message: "Register not found"})
+		return
+	}
+
+	register, err := h.Terminal.GetByID(id)
+	if err == terminal.ErrNotFound {
+		sendJSON(w, http.StatusNotFound, errorResponse{Message: "Register not found"})
+		return
+	}
+	if err != nil {
+		h.Log.Error(err)
+		sendJSON(w, http.StatusServiceUnavailable, errorResponse{Message: "Unable to fetch the register"})
+		return
+	}
+
+	sendJSON(w, http.StatusOK, newRegister(register))
+}
+
+// exportRegisters GET /admin/registers.csv, accepts the same filters as
+// listRegisters but is not paginated
+func (h *Handler) exportRegisters(w http.ResponseWriter, r *http.Request) {
+	filter, err := bindFilter(r)
+	if err != nil {
+		sendJSON(w, http.StatusBadRequest, errorResponse{Message: err.Error()})
+		return
+	}
+	filter.Limit = 0
+	filter.Offset = 0
+
+	registers, err := h.Terminal.List(filter)
+	if err != nil {
+		h.Log.Error(err)
+		sendJSON(w, http.StatusServiceUnavailable, errorResponse{Message: "Unable to export registers"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="registers.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	out := csv.NewWriter(w)
+	out.Write([]string{
+		"id",
+		"origin_domain",
+		"vend_register_id",
+		"fxl_seller_id",
+		"fxl_register_id",
+		"key_version",
+		"region",
+		"active",
+		"created_date",
+		"created_by",
+		"modified_date",
+		"modified_by",
+	})
+	for _, register := range registers {
+		var modified string
+		if !register.ModifiedDate.IsZero() {
+			modified = register.ModifiedDate.Format(time.RFC3339)
+		}
+
+		out.Write([]string{
+			strconv.FormatInt(register.ID, 10),
+			csvSafe(register.Origin),
+			csvSafe(register.VendRegisterID),
+			csvSafe(register.FxlSellerID),
+			csvSafe(register.FxlRegisterID),
+			strconv.Itoa(register.KeyVersion),
+			csvSafe(register.Region),
+			strconv.FormatBool(register.Active),
+			register.CreatedDate.Format(time.RFC3339),
+			csvSafe(register.CreatedBy),
+			modified,
+			csvSafe(register.ModifiedBy),
+		})
+	}
+	out.Flush()
+
+	if err = out.Error(); err != nil {
+		h.Log.Error(err)
+	}
+}
+
+// csvSafe stops a spreadsheet from running a value sent by a register as a
+// formula, by prefixing values that start with a formula character with '
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// listAudit GET /admin/audit?actor=&action=&vend_register_id=&since=&limit=&offset=
+// since is an RFC 3339 time, entries are returned newest first
+func (h *Handler) listAudit(w http.ResponseWriter, r *http.Request) {
+	filter, err := bindAuditFilter(r)
+	if err != nil {
+		sendJSON(w, http.StatusBadRequest, errorResponse{Message: err.Error()})
+		return
+	}
+
+	entries, err := h.Audit.List(filter)
+	if err != nil {
+		h.Log.Error(err)
+		sendJSON(w, http.StatusServiceUnavailable, errorResponse{Message: "Unable to list the audit log"})
+		return
+	}
+
+	total, err := h.Audit.Count(filter)
+	if err != nil {
+		h.Log.Error(err)
+		sendJSON(w, http.StatusServiceUnavailable, errorResponse{Message: "Unable to list the audit log"})
+		return
+	}
+
+	if entries == nil {
+		entries = []*audit.Entry{}
+	}
+	sendJSON(w, http.StatusOK, &AuditList{
+		Entries: entries,
+		Total:   total,
+		Limit:   filter.Limit,
+		Offset:  filter.Offset,
+	})
+}
+
+// verifyAudit GET /admin/audit/verify checks that no entry has been changed or removed
+func (h *Handler) verifyAudit(w http.ResponseWriter, r *http.Request) {
+	checked, invalid, err := h.Audit.Verify()
+	if err != nil {
+		h.Log.Error(err)
+		sendJSON(w, http.StatusServiceUnavailable, errorResponse{Message: "Unable to verify the audit log"})
+		return
+	}
+
+	sendJSON(w, http.StatusOK, &AuditVerification{
+		Valid:     invalid == 0,
+		Checked:   checked,
+		InvalidID: invalid,
+	})
+}
+
+func bindAuditFilter(r *http.Request) (audit.Filter, error) {
+	query := r.URL.Query()
+	filter := audit.Filter{
+		Actor:          query.Get("actor"),
+		Action:         query.Get("action"),
+		VendRegisterID: query.Get("vend_register_id"),
+	}
+
+	page, err := bindFilter(r)
+	if err != nil {
+		return filter, err
+	}
+	filter.Limit = page.Limit
+	filter.Offset = page.Offset
+
+	if since := query.Get("since"); since != "" {
+		filter.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return filter, errInvalidParameter("since")
+		}
+	}
+	return filter, nil
+}
+
+func bindFilter(r *http.Request) (terminal.Filter, error) {
+	query := r.URL.Query()
+	filter := terminal.Filter{
+		OriginDomain:   query.Get("origin_domain"),
+		FxlSellerID:    query.Get("fxl_seller_id"),
+		VendRegisterID: query.Get("vend_register_id"),
+		Limit:          defaultLimit,
+	}
+
+	var err error
+	if limit := query.Get("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit < 1 || filter.Limit > maxLimit {
+			return filter, errInvalidParameter("limit")
+		}
+	}
+	if offset := query.Get("offset"); offset != "" {
+		filter.Offset, err = strconv.Atoi(offset)
+		if err != nil || filter.Offset < 0 {
+			return filter, errInvalidParameter("offset")
+		}
+	}
+	return filter, nil
+}
+
+func newRegister(register *terminal.Register) *Register {
+	view := &Register{
+		ID:             register.ID,
+		OriginDomain:   register.Origin,
+		VendRegisterID: register.VendRegisterID,
+		FxlSellerID:    register.FxlSellerID,
+		FxlRegisterID:  register.FxlRegisterID,
+		KeyVersion:     register.KeyVersion,
+		Region:         register.Region,
+		Active:         register.Active,
+		CreatedDate:    register.CreatedDate,
+		CreatedBy:      register.CreatedBy,
+		ModifiedBy:     register.ModifiedBy,
+	}
+	if !register.ModifiedDate.IsZero() {
+		modified := register.ModifiedDate
+		view.ModifiedDate = &modified
+	}
+	return view
+}
+
+type errInvalidParameter string
+
+func (e errInvalidParameter) Error() string {
+	return "Invalid value for " + string(e)
+}
+
+func sendJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
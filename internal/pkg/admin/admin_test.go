@@ -0,0 +1,303 @@
+package admin
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/audit"
+	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+	"github.com/oxipay/oxipay-vend/internal/pkg/terminal"
+	"github.com/sirupsen/logrus"
+)
+
+// memoryStore is a RegisterStore that only supports the calls made by the admin API
+type memoryStore struct {
+	terminal.RegisterStore
+	registers []*terminal.Register
+}
+
+func (m *memoryStore) matches(filter terminal.Filter) []*terminal.Register {
+	var found []*terminal.Register
+	for _, register := range m.registers {
+		if filter.OriginDomain != "" && filter.OriginDomain != register.Origin {
+			continue
+		}
+		if filter.FxlSellerID != "" && filter.FxlSellerID != register.FxlSellerID {
+			continue
+		}
+		if filter.VendRegisterID != "" && filter.VendRegisterID != register.VendRegisterID {
+			continue
+		}
+		found = append(found, register)
+	}
+	return found
+}
+
+func (m *memoryStore) List(filter terminal.Filter) ([]*terminal.Register, error) {
+	found := m.matches(filter)
+	if filter.Offset > len(found) {
+		return nil, nil
+	}
+	found = found[filter.Offset:]
+	if filter.Limit > 0 && filter.Limit < len(found) {
+		found = found[:filter.Limit]
+	}
+	return found, nil
+}
+
+func (m *memoryStore) Count(filter terminal.Filter) (int, error) {
+	return len(m.matches(filter)), nil
+}
+
+func (m *memoryStore) GetByID(id int64) (*terminal.Register, error) {
+	for _, register := range m.registers {
+		if register.ID == id {
+			return register, nil
+		}
+	}
+	return nil, terminal.ErrNotFound
+}
+
+// memoryAudit is an AuditLog holding its entries newest first
+type memoryAudit struct {
+	entries []*audit.Entry
+	invalid int64
+}
+
+func (m *memoryAudit) List(filter audit.Filter) ([]*audit.Entry, error) {
+	var found []*audit.Entry
+	for _, e := range m.entries {
+		if filter.Action == "" || filter.Action == e.Action {
+			found = append(found, e)
+		}
+	}
+	return found, nil
+}
+
+func (m *memoryAudit) Count(filter audit.Filter) (int, error) {
+	found, _ := m.List(filter)
+	return len(found), nil
+}
+
+func (m *memoryAudit) Verify() (int, int64, error) {
+	return len(m.entries), m.invalid, nil
+}
+
+func newTestHandler() *Handler {
+	created := time.Date(2018, 7, 1, 9, 30, 0, 0, time.UTC)
+	store := &memoryStore{
+		registers: []*terminal.Register{
+			{ID: 1, Origin: "a.vendhq.com", VendRegisterID: "reg-1", FxlSellerID: "30188105", FxlRegisterID: "Oxipos-1", FxlDeviceSigningKey: "secret-1", Active: true, CreatedDate: created, CreatedBy: "vend-proxy"},
+			{ID: 2, Origin: "a.vendhq.com", VendRegisterID: "reg-2", FxlSellerID: "30188105", FxlRegisterID: "Oxipos-2", FxlDeviceSigningKey: "secret-2", Active: false, CreatedDate: created, CreatedBy: "vend-proxy"},
+			{ID: 3, Origin: "b.vendhq.com", VendRegisterID: "reg-1", FxlSellerID: "30199999", FxlRegisterID: "Oxipos-3", FxlDeviceSigningKey: "secret-3", Active: true, CreatedDate: created, CreatedBy: "vend-proxy"},
+		},
+	}
+	auditLog := &memoryAudit{
+		entries: []*audit.Entry{
+			{ID: 2, Actor: "a.vendhq.com", Action: audit.ActionPay, VendRegisterID: "reg-1", Outcome: "ACCEPTED", CreatedDate: created},
+			{ID: 1, Actor: "a.vendhq.com", Action: audit.ActionRegister, VendRegisterID: "reg-1", Outcome: "ACCEPTED", CreatedDate: created},
+		},
+	}
+	return NewHandler(
+		terminal.NewTerminal(store),
+		auditLog,
+		config.AdminConfig{Username: "admin", Password: "letmein"},
+		logrus.New(),
+	)
+}
+
+func get(h http.Handler, target string, authenticate bool) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if authenticate {
+		req.SetBasicAuth("admin", "letmein")
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAuthentication(t *testing.T) {
+	h := newTestHandler()
+
+	if rr := get(h, "/admin/registers", false); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d got %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/registers", nil)
+	req.SetBasicAuth("admin", "wrong")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d got %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	// an unconfigured password never authenticates
+	h.Config.Password = ""
+	req = httptest.NewRequest(http.MethodGet, "/admin/registers", nil)
+	req.SetBasicAuth("admin", "")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d got %d", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+func TestListRegisters(t *testing.T) {
+	h := newTestHandler()
+
+	var tests = []struct {
+		target string
+		ids    []int64
+		total  int
+	}{
+		{"/admin/registers", []int64{1, 2, 3}, 3},
+		{"/admin/registers?origin_domain=a.vendhq.com", []int64{1, 2}, 2},
+		{"/admin/registers?fxl_seller_id=30199999", []int64{3}, 1},
+		{"/admin/registers?vend_register_id=reg-1", []int64{1, 3}, 2},
+		{"/admin/registers?limit=1&offset=1", []int64{2}, 3},
+	}
+
+	for _, tt := range tests {
+		rr := get(h, tt.target, true)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected %d got %d", tt.target, http.StatusOK, rr.Code)
+		}
+		if strings.Contains(rr.Body.String(), "secret") {
+			t.Errorf("%s: response contains a signing key %s", tt.target, rr.Body.String())
+		}
+
+		list := new(RegisterList)
+		if err := json.Unmarshal(rr.Body.Bytes(), list); err != nil {
+			t.Fatal(err)
+		}
+		if list.Total != tt.total {
+			t.Errorf("%s: expected a total of %d got %d", tt.target, tt.total, list.Total)
+		}
+		if len(list.Registers) != len(tt.ids) {
+			t.Fatalf("%s: expected %d registers got %d", tt.target, len(tt.ids), len(list.Registers))
+		}
+		for i, id := range tt.ids {
+			if list.Registers[i].ID != id {
+				t.Errorf("%s: expected register %d got %d", tt.target, id, list.Registers[i].ID)
+			}
+		}
+	}
+
+	for _, target := range []string{"/admin/registers?limit=0", "/admin/registers?limit=501", "/admin/registers?offset=-1"} {
+		if rr := get(h, target, true); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected %d got %d", target, http.StatusBadRequest, rr.Code)
+		}
+	}
+}
+
+func TestGetRegister(t *testing.T) {
+	h := newTestHandler()
+
+	rr := get(h, "/admin/registers/2", true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d", http.StatusOK, rr.Code)
+	}
+	if strings.Contains(rr.Body.String(), "secret") {
+		t.Errorf("response contains a signing key %s", rr.Body.String())
+	}
+
+	register := new(Register)
+	if err := json.Unmarshal(rr.Body.Bytes(), register); err != nil {
+		t.Fatal(err)
+	}
+	if register.FxlRegisterID != "Oxipos-2" || register.Active {
+		t.Errorf("unexpected register %+v", register)
+	}
+
+	for _, target := range []string{"/admin/registers/9", "/admin/registers/abc"} {
+		if rr = get(h, target, true); rr.Code != http.StatusNotFound {
+			t.Errorf("%s: expected %d got %d", target, http.StatusNotFound, rr.Code)
+		}
+	}
+}
+
+func TestExportRegisters(t *testing.T) {
+	h := newTestHandler()
+
+	// the export ignores pagination
+	rr := get(h, "/admin/registers.csv?origin_domain=a.vendhq.com&limit=1", true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d", http.StatusOK, rr.Code)
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "text/csv" {
+		t.Errorf("expected text/csv got %s", contentType)
+	}
+
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected a header and 2 registers got %d rows", len(records))
+	}
+	if records[0][0] != "id" || records[1][0] != "1" || records[2][0] != "2" {
+		t.Errorf("unexpected rows %v", records)
+	}
+	for _, record := range records {
+		for _, value := range record {
+			if strings.HasPrefix(value, "secret") {
+				t.Errorf("export contains a signing key %v", record)
+			}
+		}
+	}
+}
+
+func TestExportFormulas(t *testing.T) {
+	store := &memoryStore{
+		registers: []*terminal.Register{
+			{ID: 1, Origin: "=HYPERLINK(\"http://evil.example.com\")", VendRegisterID: "+reg-1", FxlSellerID: "-30188105", FxlRegisterID: "@Oxipos-1", CreatedBy: "vend-proxy"},
+		},
+	}
+	h := NewHandler(terminal.NewTerminal(store), &memoryAudit{}, config.AdminConfig{Username: "admin", Password: "letmein"}, logrus.New())
+
+	records, err := csv.NewReader(get(h, "/admin/registers.csv", true).Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected a header and 1 register got %d rows", len(records))
+	}
+	for i, want := range []string{"1", `'=HYPERLINK("http://evil.example.com")`, "'+reg-1", "'-30188105", "'@Oxipos-1"} {
+		if records[1][i] != want {
+			t.Errorf("column %s: expected %s got %s", records[0][i], want, records[1][i])
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	h := newTestHandler()
+
+	rr := get(h, "/admin/audit?action=pay", true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected %d got %d", http.StatusOK, rr.Code)
+	}
+	list := new(AuditList)
+	if err := json.NewDecoder(rr.Body).Decode(list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 1 || list.Entries[0].Action != audit.ActionPay || list.Limit != defaultLimit {
+		t.Errorf("unexpected audit log %+v", list)
+	}
+
+	if rr = get(h, "/admin/audit?since=yesterday", true); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected %d got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	h.Audit.(*memoryAudit).invalid = 2
+	rr = get(h, "/admin/audit/verify", true)
+	verification := new(AuditVerification)
+	json.NewDecoder(rr.Body).Decode(verification)
+	if verification.Valid || verification.InvalidID != 2 || verification.Checked != 2 {
+		t.Errorf("unexpected verification %+v", verification)
+	}
+}
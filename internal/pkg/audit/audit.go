@@ -0,0 +1,420 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/database"
+)
+
+const (
+	// ActionRegister pairs a Vend register with an Oxipay device
+	ActionRegister = "register"
+	// ActionRekey replaces the signing key of a register
+	ActionRekey = "rekey"
+	// ActionDeactivate stops a register from processing payments
+	ActionDeactivate = "deactivate"
+	// ActionDelete removes the registration of a register
+	ActionDelete = "delete"
+	// ActionPay sends a payment to Oxipay
+	ActionPay = "pay"
+	// ActionRefund sends a refund to Oxipay
+	ActionRefund = "refund"
+)
+
+// recordTimeout limits how long a payment waits to append its entry while
+// another instance holds the chain head
+const recordTimeout = 2 * time.Second
+
+// Redacted replaces the value of a sensitive field
+const Redacted = "[REDACTED]"
+
+// sensitive are the fields that must never be written to the audit log or the
+// debug log, compared in lower case
+var sensitive = map[string]bool{
+	"devicetoken":            true,
+	"x_device_token":         true,
+	"paymentcode":            true,
+	"preapprovalcode":        true,
+	"x_pre_approval_code":    true,
+	"key":                    true,
+	"x_key":                  true,
+	"signingkey":             true,
+	"fxldevicesigningkey":    true,
+	"fxl_device_signing_key": true,
+	"signature":              true,
+	"password":               true,
+}
+
+// Redact returns the first value of each field with the sensitive ones replaced
+func Redact(values url.Values) map[string]string {
+	redacted := make(map[string]string, len(values))
+	for name := range values {
+		if sensitive[strings.ToLower(name)] {
+			redacted[name] = Redacted
+			continue
+		}
+		redacted[name] = values.Get(name)
+	}
+	return redacted
+}
+
+// Proxies are the addresses, such as nginx, trusted to set X-Forwarded-For
+type Proxies []*net.IPNet
+
+// ParseProxies parses IP addresses and CIDR ranges, e.g. 172.28.0.10 or
+// 10.0.0.0/8
+func ParseProxies(addresses []string) (Proxies, error) {
+	proxies := make(Proxies, 0, len(addresses))
+	for _, address := range addresses {
+		if !strings.Contains(address, "/") {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return nil, fmt.Errorf("%s is not an IP address or CIDR range", address)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not an IP address or CIDR range", address)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (p Proxies) trusted(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the browser. X-Forwarded-For is only read
+// when the request comes from a trusted proxy, and then the address before the
+// last trusted proxy is used as earlier entries are supplied by the client.
+func (p Proxies) ClientIP(r *http.Request) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remote = host
+	}
+	if !p.trusted(remote) {
+		return remote
+	}
+
+	forwarded := r.Header.Get("X-Forwarded-For")
+	if forwarded == "" {
+		return remote
+	}
+	hops := strings.Split(forwarded, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if !p.trusted(hop) || i == 0 {
+			return hop
+		}
+	}
+	return remote
+}
+
+// Entry is a single action recorded in the audit log
+type Entry struct {
+	ID             int64     `json:"id"`
+	Actor          string    `json:"actor"`
+	Action         string    `json:"action"`
+	VendRegisterID string    `json:"vend_register_id,omitempty"`
+	Outcome        string    `json:"outcome"`
+	ClientIP       string    `json:"client_ip,omitempty"`
+	Details        string    `json:"details,omitempty"`
+	CreatedDate    time.Time `json:"created_date"`
+	PrevHash       string    `json:"prev_hash,omitempty"`
+	Hash           string    `json:"hash"`
+}
+
+// NewDetails encodes the redacted fields for Entry.Details
+func NewDetails(fields map[string]string) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	details, _ := json.Marshal(fields)
+	return string(details)
+}
+
+// sum is the hash of the entry, it covers the previous hash so that changing
+// or removing an entry breaks every hash after it
+func (e *Entry) sum() string {
+	h := sha256.New()
+	for _, field := range []string{
+		e.PrevHash,
+		e.Actor,
+		e.Action,
+		e.VendRegisterID,
+		e.Outcome,
+		e.ClientIP,
+		e.Details,
+		e.CreatedDate.UTC().Format(time.RFC3339),
+	} {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Filter narrows the entries returned by List and Count
+type Filter struct {
+	Actor          string
+	Action         string
+	VendRegisterID string
+	Since          time.Time
+	Limit          int
+	Offset         int
+}
+
+// Log is the append-only audit log. Entries are never updated or deleted,
+// the table has triggers that refuse both.
+type Log struct {
+	Db     *sql.DB
+	Driver string
+}
+
+// NewLog Used to marshall the DB connection
+func NewLog(driver string, db *sql.DB) *Log {
+	return &Log{
+		Db:     db,
+		Driver: driver,
+	}
+}
+
+// Record appends an entry, chaining its hash from the previous entry. The
+// chain head row is locked while the entry is inserted, so that two proxies
+// sharing the database can't chain from the same entry. The lock is only held
+// for the transaction, and an entry that can't get it within recordTimeout
+// isn't recorded rather than holding up the payment.
+func (l *Log) Record(e *Entry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), recordTimeout)
+	defer cancel()
+
+	tx, err := l.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// SQLite doesn't support FOR UPDATE, it only has the one connection
+	query := `SELECT hash FROM oxipay_vend_audit_head WHERE id = 1`
+	if l.Driver != database.DriverSQLite {
+		query += ` FOR UPDATE`
+	}
+	var prev sql.NullString
+	if err = tx.QueryRowContext(ctx, query).Scan(&prev); err != nil {
+		return err
+	}
+
+	// the database may not keep fractions of a second
+	e.CreatedDate = time.Now().UTC().Truncate(time.Second)
+	e.PrevHash = prev.String
+	e.Hash = e.sum()
+
+	query = `INSERT INTO
+		oxipay_vend_audit
+		(
+			actor,
+			action,
+			vend_register_id,
+			outcome,
+			client_ip,
+			details,
+			created_date,
+			prev_hash,
+			hash
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) `
+
+	_, err = tx.ExecContext(ctx,
+		database.Rebind(l.Driver, query),
+		e.Actor,
+		e.Action,
+		newNullString(e.VendRegisterID),
+		e.Outcome,
+		newNullString(e.ClientIP),
+		newNullString(e.Details),
+		e.CreatedDate,
+		newNullString(e.PrevHash),
+		e.Hash,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, database.Rebind(l.Driver, `UPDATE oxipay_vend_audit_head SET hash = ? WHERE id = 1`), e.Hash)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// List returns the entries matching the filter, newest first
+func (l *Log) List(filter Filter) ([]*Entry, error) {
+	where, args := filter.where()
+	query := `SELECT
+			id,
+			actor,
+			action,
+			vend_register_id,
+			outcome,
+			client_ip,
+			details,
+			created_date,
+			prev_hash,
+			hash
+		FROM
+			oxipay_vend_audit` + where + `
+		ORDER BY id DESC`
+	if filter.Limit > 0 {
+		query += ` LIMIT ? OFFSET ?`
+		args = append(args, filter.Limit, filter.Offset)
+	}
+
+	rows, err := l.Db.Query(database.Rebind(l.Driver, query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*Entry
+	for rows.Next() {
+		e, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Count returns the number of entries matching the filter
+func (l *Log) Count(filter Filter) (int, error) {
+	where, args := filter.where()
+	var total int
+	err := l.Db.QueryRow(database.Rebind(l.Driver, `SELECT COUNT(*) FROM oxipay_vend_audit`+where), args...).Scan(&total)
+	return total, err
+}
+
+// Verify walks the log from the first entry and returns the ID of the first
+// entry whose hash doesn't match, or 0 if the chain is intact
+func (l *Log) Verify() (checked int, invalid int64, err error) {
+	rows, err := l.Db.Query(`SELECT
+			id,
+			actor,
+			action,
+			vend_register_id,
+			outcome,
+			client_ip,
+			details,
+			created_date,
+			prev_hash,
+			hash
+		FROM
+			oxipay_vend_audit
+		ORDER BY id`)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	prev := ""
+	for rows.Next() {
+		e, err := scan(rows)
+		if err != nil {
+			return checked, 0, err
+		}
+		checked++
+		if e.PrevHash != prev || e.sum() != e.Hash {
+			return checked, e.ID, nil
+		}
+		prev = e.Hash
+	}
+	return checked, 0, rows.Err()
+}
+
+func (f Filter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if f.Actor != "" {
+		conditions = append(conditions, "actor = ?")
+		args = append(args, f.Actor)
+	}
+	if f.Action != "" {
+		conditions = append(conditions, "action = ?")
+		args = append(args, f.Action)
+	}
+	if f.VendRegisterID != "" {
+		conditions = append(conditions, "vend_register_id = ?")
+		args = append(args, f.VendRegisterID)
+	}
+	if !f.Since.IsZero() {
+		conditions = append(conditions, "created_date >= ?")
+		args = append(args, f.Since.UTC())
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func scan(rows *sql.Rows) (*Entry, error) {
+	var vendRegisterID, clientIP, details, prevHash sql.NullString
+
+	e := new(Entry)
+	err := rows.Scan(
+		&e.ID,
+		&e.Actor,
+		&e.Action,
+		&vendRegisterID,
+		&e.Outcome,
+		&clientIP,
+		&details,
+		&e.CreatedDate,
+		&prevHash,
+		&e.Hash,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	e.VendRegisterID = vendRegisterID.String
+	e.ClientIP = clientIP.String
+	e.Details = details.String
+	e.PrevHash = prevHash.String
+	return e, nil
+}
+
+func newNullString(s string) sql.NullString {
+	if len(s) == 0 {
+		return sql.NullString{}
+	}
+	return sql.NullString{
+		String: s,
+		Valid:  true,
+	}
+}
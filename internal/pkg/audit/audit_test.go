@@ -0,0 +1,188 @@
+package audit
+
+import (
+	"database/sql"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/oxipay/oxipay-vend/internal/pkg/database"
+	"github.com/oxipay/oxipay-vend/internal/pkg/migrate"
+)
+
+func newLog(t *testing.T) *Log {
+	db, err := sql.Open(database.DriverSQLite, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: is a new database
+	db.SetMaxOpenConns(1)
+
+	migrator, err := migrate.NewMigrator(database.DriverSQLite, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	return NewLog(database.DriverSQLite, db)
+}
+
+func TestRedact(t *testing.T) {
+	redacted := Redact(url.Values{
+		"DeviceToken": {"02SUCCES"},
+		"paymentcode": {"01APPROV"},
+		"MerchantID":  {"30188105"},
+	})
+	if redacted["DeviceToken"] != Redacted || redacted["paymentcode"] != Redacted {
+		t.Errorf("expected the token and payment code to be redacted %v", redacted)
+	}
+	if redacted["MerchantID"] != "30188105" {
+		t.Errorf("expected the merchant ID to be kept %v", redacted)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseProxies([]string{"172.28.0.10", "10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.5:41000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	// reached directly, so the client could have set X-Forwarded-For
+	if ip := proxies.ClientIP(req); ip != "10.0.0.5" {
+		t.Errorf("expected 10.0.0.5 got %s", ip)
+	}
+
+	// only the address added by nginx is trusted
+	req.RemoteAddr = "172.28.0.10:41000"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.9")
+	if ip := proxies.ClientIP(req); ip != "203.0.113.9" {
+		t.Errorf("expected 203.0.113.9 got %s", ip)
+	}
+
+	// addresses added by a chain of trusted proxies are skipped
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 203.0.113.9, 10.1.4.2")
+	if ip := proxies.ClientIP(req); ip != "203.0.113.9" {
+		t.Errorf("expected 203.0.113.9 got %s", ip)
+	}
+
+	// without trusted proxies X-Forwarded-For is ignored
+	if ip := Proxies(nil).ClientIP(req); ip != "172.28.0.10" {
+		t.Errorf("expected 172.28.0.10 got %s", ip)
+	}
+
+	if _, err = ParseProxies([]string{"nginx"}); err == nil {
+		t.Error("expected a host name to be rejected")
+	}
+}
+
+func TestAppendOnly(t *testing.T) {
+	log := newLog(t)
+
+	for _, action := range []string{ActionRegister, ActionPay, ActionRefund} {
+		err := log.Record(&Entry{Actor: "amtest.vendhq.com", Action: action, VendRegisterID: "reg-1", Outcome: "ACCEPTED"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := log.List(Filter{Action: ActionPay})
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected a single payment got %d: %v", len(entries), err)
+	}
+	if entries[0].PrevHash == "" || entries[0].Hash == "" {
+		t.Errorf("expected the entry to be chained %+v", entries[0])
+	}
+
+	if total, _ := log.Count(Filter{VendRegisterID: "reg-1"}); total != 3 {
+		t.Errorf("expected 3 entries got %d", total)
+	}
+
+	checked, invalid, err := log.Verify()
+	if err != nil || checked != 3 || invalid != 0 {
+		t.Errorf("expected an intact chain of 3 got %d %d %v", checked, invalid, err)
+	}
+
+	// the table refuses changes
+	_, err = log.Db.Exec(`UPDATE oxipay_vend_audit SET outcome = 'DECLINED'`)
+	if err == nil || !strings.Contains(err.Error(), "append-only") {
+		t.Errorf("expected the update to be refused got %v", err)
+	}
+	if _, err = log.Db.Exec(`DELETE FROM oxipay_vend_audit`); err == nil {
+		t.Error("expected the delete to be refused")
+	}
+
+	// an entry changed behind the triggers' back breaks the chain
+	log.Db.Exec(`DROP TRIGGER oxipay_vend_audit_no_update`)
+	if _, err = log.Db.Exec(`UPDATE oxipay_vend_audit SET outcome = 'DECLINED' WHERE action = 'pay'`); err != nil {
+		t.Fatal(err)
+	}
+	if _, invalid, _ = log.Verify(); invalid != entries[0].ID {
+		t.Errorf("expected entry %d to fail verification got %d", entries[0].ID, invalid)
+	}
+}
+
+// TestConcurrentRecord appends from two logs sharing the database, like the AU
+// and NZ proxies, and checks that the chain doesn't fork
+func TestConcurrentRecord(t *testing.T) {
+	au := newLog(t)
+	nz := NewLog(database.DriverSQLite, au.Db)
+
+	var wg sync.WaitGroup
+	for _, log := range []*Log{au, nz} {
+		wg.Add(1)
+		go func(log *Log) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if err := log.Record(&Entry{Actor: "anonymous", Action: ActionPay, VendRegisterID: "reg-1", Outcome: "ACCEPTED"}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(log)
+	}
+	wg.Wait()
+
+	checked, invalid, err := au.Verify()
+	if err != nil || checked != 40 || invalid != 0 {
+		t.Errorf("expected 40 chained entries got %d, first invalid %d: %v", checked, invalid, err)
+	}
+
+	entries, err := au.List(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := make(map[string]bool)
+	for _, e := range entries {
+		if prev[e.PrevHash] {
+			t.Fatalf("entry %d chains from the same entry as another", e.ID)
+		}
+		prev[e.PrevHash] = true
+	}
+}
+
+// TestRecordTimeout holds the chain head in another transaction, the entry
+// isn't recorded rather than waiting for it
+func TestRecordTimeout(t *testing.T) {
+	log := newLog(t)
+
+	tx, err := log.Db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	start := time.Now()
+	if err = log.Record(&Entry{Actor: "anonymous", Action: ActionPay, Outcome: "ACCEPTED"}); err == nil {
+		t.Error("expected the entry not to be recorded while the chain head is held")
+	}
+	if elapsed := time.Since(start); elapsed > recordTimeout+time.Second {
+		t.Errorf("expected Record to give up after %s, took %s", recordTimeout, elapsed)
+	}
+}
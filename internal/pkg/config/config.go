@@ -1,10 +1,15 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	micro "github.com/micro/go-config"
-	"github.com/micro/go-config/source/env"
 	"github.com/micro/go-config/source/file"
 )
 
@@ -12,6 +17,12 @@ import (
 type WebserverConfig struct {
 	Port    string `json:"port"`
 	Address string `json:"address"`
+	// ShutdownTimeout is how long to wait for in-flight payments and refunds
+	// when shutting down, e.g. 30s
+	ShutdownTimeout string `json:"shutdowntimeout"`
+	// TrustedProxies are the IP addresses or CIDR ranges, such as nginx,
+	// allowed to set X-Forwarded-For. It is ignored from any other address.
+	TrustedProxies []string `json:"trustedproxies"`
 }
 
 // SessionConfig configuration for the session
@@ -21,80 +32,441 @@ type SessionConfig struct {
 	MaxAge   int    `json:"maxage"`
 	HTTPOnly bool   `json:"httponly"`
 	Secret   string `json:"secret"`
+	// Keys are ordered newest first. New sessions are signed with the first
+	// pair, the rest are only used to read existing sessions. Secret is used
+	// when there are no keys.
+	Keys []SessionKey `json:"keys"`
+}
+
+// SessionKey is an authentication key used to sign the session cookie and an
+// optional encryption key, which must be 16, 24 or 32 bytes to select AES-128,
+// AES-192 or AES-256
+type SessionKey struct {
+	Authentication string `json:"authentication"`
+	Encryption     string `json:"encryption"`
+}
+
+// KeyPairs returns the session keys in the form expected by gorilla/sessions
+func (s SessionConfig) KeyPairs() ([][]byte, error) {
+	if len(s.Keys) == 0 {
+		if s.Secret == "" {
+			return nil, fmt.Errorf("Session config needs a secret or at least one key")
+		}
+		return [][]byte{[]byte(s.Secret)}, nil
+	}
+
+	pairs := make([][]byte, 0, len(s.Keys)*2)
+	for i, key := range s.Keys {
+		if key.Authentication == "" {
+			return nil, fmt.Errorf("Session key %d is missing an authentication key", i)
+		}
+
+		var encryption []byte
+		switch len(key.Encryption) {
+		case 0:
+			// cookies are signed but not encrypted
+		case 16, 24, 32:
+			encryption = []byte(key.Encryption)
+		default:
+			return nil, fmt.Errorf("Session key %d has an encryption key of %d bytes, it must be 16, 24 or 32", i, len(key.Encryption))
+		}
+		pairs = append(pairs, []byte(key.Authentication), encryption)
+	}
+	return pairs, nil
 }
 
 // DbConnection stores connection information for the database
 type DbConnection struct {
 	// @todo pull from config
+	// Driver is one of mysql (default), postgres or sqlite3
+	Driver   string `json:"driver"`
 	Username string `json:"username"`
 	Password string `json:"password"`
 	Host     string `json:"host"`
-	Name     string `json:"name"`
-	Timeout  string `json:"timeout"`
+	// Name is the database name, or the path to the database file for sqlite3
+	Name    string `json:"name"`
+	Timeout string `json:"timeout"`
+	// SSLMode is only used by postgres
+	SSLMode string `json:"sslmode"`
+	// Migrate applies pending migrations on startup, otherwise they are only
+	// reported and have to be applied with vendproxy migrate up
+	Migrate bool `json:"migrate"`
+}
+
+// AdminConfig credentials for the admin API, the API is disabled when the
+// password is empty
+type AdminConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// EncryptionConfig master keys used to encrypt device signing keys at rest.
+// Signing keys are stored in plaintext when no keys are configured.
+type EncryptionConfig struct {
+	// Keys maps the key version to a base64 encoded 32 byte key
+	Keys map[string]string `json:"keys"`
+	// KeyFile is read in addition to Keys and contains version:key lines
+	KeyFile string `json:"keyfile"`
+	// Version of the key used to encrypt new signing keys, defaults to the
+	// highest version
+	Version int `json:"version"`
 }
 
 // HostConfig data structure that represent a valid configuration file
 type HostConfig struct {
-	Webserver  WebserverConfig `json:"webserver"`
-	Database   DbConnection    `json:"database"`
-	Session    SessionConfig   `json:"session"`
-	Oxipay     OxipayConfig    `json:"oxipay"`
-	Background bool            `json:"background"`
-	LogLevel   string          `json:"loglevel"`
+	Webserver  WebserverConfig  `json:"webserver"`
+	Database   DbConnection     `json:"database"`
+	Session    SessionConfig    `json:"session"`
+	Oxipay     OxipayConfig     `json:"oxipay"`
+	Admin      AdminConfig      `json:"admin"`
+	Encryption EncryptionConfig `json:"encryption"`
+	// Regions are the gateway profiles keyed by name, e.g. au and nz. When
+	// empty, oxipay.gatewayurl is used for every request.
+	Regions map[string]RegionConfig `json:"regions"`
+	// DefaultRegion handles requests whose Host doesn't match a region
+	DefaultRegion string        `json:"defaultregion"`
+	Webhooks      WebhookConfig `json:"webhooks"`
+	Assets        AssetsConfig  `json:"assets"`
+	Background    bool          `json:"background"`
+	LogLevel      string        `json:"loglevel"`
+
+	// File is the configuration file that was read
+	File string `json:"-"`
+	// Sources reports where each value came from, see ReadApplicationConfig
+	Sources Sources `json:"-"`
+}
+
+// AssetsConfig locates the files served by the proxy. Relative paths are
+// relative to the working directory.
+type AssetsConfig struct {
+	// Root is served under /assets/
+	Root string `json:"root"`
+	// Templates holds the pages served by the proxy, defaults to the
+	// templates directory in Root
+	Templates string `json:"templates"`
+}
+
+// TemplateDir returns the directory of the page templates
+func (a AssetsConfig) TemplateDir() string {
+	if a.Templates != "" {
+		return a.Templates
+	}
+	return filepath.Join(a.Root, "templates")
+}
+
+// WebhookConfig configures the events sent when a payment or refund completes
+type WebhookConfig struct {
+	Subscribers []SubscriberConfig `json:"subscribers"`
+	// Interval between checks of the retry queue, e.g. 30s
+	Interval string `json:"interval"`
+	// Backoff is the wait before the first retry, it doubles for each retry
+	Backoff string `json:"backoff"`
+	// MaxAttempts is the number of deliveries before an event is given up on
+	MaxAttempts int `json:"maxattempts"`
+	// Timeout limits how long a subscriber has to respond
+	Timeout string `json:"timeout"`
+}
+
+// SubscriberConfig is an endpoint the events are POSTed to
+type SubscriberConfig struct {
+	URL string `json:"url"`
+	// Secret signs the body of each event, the subscriber uses it to check
+	// the event came from the proxy
+	Secret string `json:"secret"`
+	// Events limits the event types sent, e.g. payment.approved. Every event
+	// is sent when empty.
+	Events []string `json:"events"`
+}
+
+// DefaultRegionName is the name of the region built from oxipay.gatewayurl
+// when no regions are configured
+const DefaultRegionName = "default"
+
+// RegionConfig is the gateway profile for a country Oxipay operates in
+type RegionConfig struct {
+	GatewayURL   string `json:"gatewayurl"`
+	Currency     string `json:"currency"`
+	SupportEmail string `json:"supportemail"`
+	// MinimumAmount is the smallest payment accepted, in cents
+	MinimumAmount int64 `json:"minimumamount"`
+	// Hosts are the Host headers routed to this region, e.g. vend.oxipay.co.nz
+	Hosts []string `json:"hosts"`
+}
+
+// GatewayRegions returns the configured regions, or a single region using
+// oxipay.gatewayurl when none are configured
+func (c HostConfig) GatewayRegions() map[string]RegionConfig {
+	if len(c.Regions) > 0 {
+		return c.Regions
+	}
+	return map[string]RegionConfig{
+		DefaultRegionName: {GatewayURL: c.Oxipay.GatewayURL},
+	}
 }
 
 // OxipayConfig data structure that represents a valid Oxipay configuration file entry
 type OxipayConfig struct {
 	GatewayURL string `json:"gatewayurl"`
 	Version    string
+	// ConnectTimeout limits connecting to the gateway, e.g. 5s
+	ConnectTimeout string `json:"connecttimeout"`
+	// Timeout limits the whole request including reading the response, e.g. 60s
+	Timeout string `json:"timeout"`
+	// MaxIdleConns is the number of keep-alive connections to the gateway
+	MaxIdleConns int `json:"maxidleconns"`
+	// CAFile is a PEM bundle used instead of the system CAs to verify the gateway
+	CAFile string `json:"cafile"`
+	// Proxy is the URL of a proxy for requests to the gateway, the
+	// HTTPS_PROXY environment variable is used when empty
+	Proxy string `json:"proxy"`
+	// Retries is the number of times to retry a request that failed before
+	// reaching the gateway, e.g. because the connection was refused
+	Retries int `json:"retries"`
+	// RetryBackoff is the wait before the first retry, doubling each time
+	RetryBackoff string `json:"retrybackoff"`
 }
 
-// ReadApplicationConfig will load the application configuration from known places on the disk or environment
-func ReadApplicationConfig(configFile string) (HostConfig, error) {
+// The layers a configuration value can come from, each one overrides the
+// ones before it
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
 
-	conf := micro.NewConfig()
-	// Load json file with encoder
-	err := conf.Load(
-		file.NewSource(file.WithPath(configFile)),
-		// allow env overrides,
-		// keys can't have _ as this is how it deals with nesting
-		env.NewSource(),
-	)
+const (
+	// DefaultPath is the configuration file used in production
+	DefaultPath = "/etc/vendproxy/vendproxy.json"
+	// DevPath is used when the DEV environment variable is set
+	DevPath = "../configs/vendproxy.json"
+	// PathEnv names the configuration file, it is overridden by the -config flag
+	PathEnv = "VENDPROXY_CONFIG"
+)
+
+// FilePath returns the configuration file to read, the -config flag when set,
+// then $VENDPROXY_CONFIG, then DevPath when $DEV is set, otherwise DefaultPath
+func FilePath(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if path := os.Getenv(PathEnv); path != "" {
+		return path
+	}
+	if Dev() {
+		return DevPath
+	}
+	return DefaultPath
+}
+
+// Override sets a configuration value from the command line, the key is the
+// dotted path of the value, e.g. webserver.port
+type Override struct {
+	Key   string
+	Value string
+}
+
+// Sources maps the dotted path of each configuration value to the layer it
+// came from
+type Sources map[string]string
+
+// Keys returns the paths in order
+func (s Sources) Keys() []string {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Defaults are used for the values that aren't set by the configuration file,
+// the environment or the command line
+func Defaults() HostConfig {
+	return HostConfig{
+		Webserver: WebserverConfig{
+			Port:            "5000",
+			ShutdownTimeout: "30s",
+		},
+		Database: DbConnection{
+			Driver:  "mysql",
+			Timeout: "20s",
+		},
+		Session: SessionConfig{
+			Path:     "/",
+			MaxAge:   3600,
+			HTTPOnly: true,
+		},
+		Assets: AssetsConfig{
+			Root: "../assets",
+		},
+		LogLevel: "info",
+	}
+}
+
+// ReadApplicationConfig loads the configuration in layers, each overriding the
+// last: the defaults, the configuration file, the environment and then the
+// command line. An environment variable is the path of the value with _
+// between the keys, in upper or lower case, e.g. DATABASE_HOST or
+// database_host for database.host, so keys can't contain _. Lists can be set from the environment as JSON. Values are only
+// read from the environment if they are in the defaults or the file, so a
+// region has to be in the file for REGIONS_NZ_GATEWAYURL to be used.
+// HostConfig.Sources reports where each value came from.
+func ReadApplicationConfig(configFile string, overrides ...Override) (HostConfig, error) {
 	var hostConfiguration HostConfig
 
+	values, err := toMap(Defaults())
 	if err != nil {
 		return hostConfiguration, err
 	}
+	sources := make(Sources)
+	merge(values, values, "", SourceDefault, sources)
+
+	// Load json file with encoder
+	conf := micro.NewConfig()
+	if err = conf.Load(file.NewSource(file.WithPath(configFile))); err != nil {
+		return hostConfiguration, err
+	}
+	merge(values, conf.Map(), "", SourceFile, sources)
 
-	errs := validate(conf)
-	if len(errs) > 0 {
-		return hostConfiguration, errs[0]
+	for _, key := range sources.Keys() {
+		name := strings.Replace(key, ".", "_", -1)
+		raw, ok := os.LookupEnv(strings.ToUpper(name))
+		if !ok {
+			raw, ok = os.LookupEnv(name)
+		}
+		if !ok {
+			continue
+		}
+		if err = set(values, key, raw); err != nil {
+			return hostConfiguration, err
+		}
+		sources[key] = SourceEnv
+	}
+
+	for _, o := range overrides {
+		if _, ok := sources[o.Key]; !ok {
+			return hostConfiguration, fmt.Errorf("%s is not a configuration value", o.Key)
+		}
+		if err = set(values, o.Key, o.Value); err != nil {
+			return hostConfiguration, err
+		}
+		sources[o.Key] = SourceFlag
+	}
+
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return hostConfiguration, err
 	}
-	err = conf.Scan(&hostConfiguration)
+	if err = json.Unmarshal(encoded, &hostConfiguration); err != nil {
+		return hostConfiguration, err
+	}
+	hostConfiguration.File = configFile
+	hostConfiguration.Sources = sources
 
 	// hardcode this for now
 	// should load from a non-config file
 	hostConfiguration.Oxipay.Version = "1.1"
 
-	return hostConfiguration, err
+	return hostConfiguration, nil
 }
 
-// Validate ensure we have some basic validation of the configuration
-func validate(myconfig micro.Config) []error {
-	required := [3]string{"webserver", "database", "session"}
-	var errs []error
+// Watch calls changed each time the configuration file changes until stop is
+// closed. It only reports the change, the caller reads the file again with
+// ReadApplicationConfig.
+func Watch(configFile string, stop <-chan struct{}, changed func()) error {
+	conf := micro.NewConfig()
+	if err := conf.Load(file.NewSource(file.WithPath(configFile))); err != nil {
+		return err
+	}
+	watcher, err := conf.Watch()
+	if err != nil {
+		return err
+	}
 
-	// We need to do more error checking here but let's at least make an
-	// attempt
-	for _, entry := range required {
-		var tmpMap map[string]string
-		configValue := myconfig.Get(entry).StringMap(tmpMap)
-		if configValue == nil {
-			newErr := fmt.Errorf("Config is missing a definition for %s", entry)
-			errs = append(errs, newErr)
+	go func() {
+		<-stop
+		watcher.Stop()
+	}()
+	go func() {
+		// Next returns an error once the watcher is stopped
+		for {
+			if _, err := watcher.Next(); err != nil {
+				return
+			}
+			changed()
 		}
+	}()
+	return nil
+}
+
+func toMap(c HostConfig) (map[string]interface{}, error) {
+	encoded, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
 	}
+	values := make(map[string]interface{})
+	return values, json.Unmarshal(encoded, &values)
+}
+
+// merge copies src over dst, recording the source of every value that isn't
+// an object. Objects are merged key by key, anything else is replaced.
+func merge(dst map[string]interface{}, src map[string]interface{}, prefix string, source string, sources Sources) {
+	for k, v := range src {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
 
-	// check the ensure the log level works
-	return errs
+		if object, ok := v.(map[string]interface{}); ok {
+			existing, ok := dst[k].(map[string]interface{})
+			if !ok {
+				existing = make(map[string]interface{})
+				dst[k] = existing
+			}
+			merge(existing, object, key, source, sources)
+			continue
+		}
+		dst[k] = v
+		sources[key] = source
+	}
+}
+
+// set replaces the value at the dotted path with raw, parsed to the type of
+// the value it replaces
+func set(values map[string]interface{}, key string, raw string) error {
+	path := strings.Split(key, ".")
+	for _, k := range path[:len(path)-1] {
+		next, ok := values[k].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s is not a configuration value", key)
+		}
+		values = next
+	}
+
+	name := path[len(path)-1]
+	switch values[name].(type) {
+	case bool:
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false, not %s", key, raw)
+		}
+		values[name] = value
+	case float64:
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, not %s", key, raw)
+		}
+		values[name] = value
+	case []interface{}, nil:
+		// lists aren't in the defaults so they are nil unless set by the file
+		var value interface{}
+		if err := json.Unmarshal([]byte(raw), &value); err != nil {
+			return fmt.Errorf("%s must be JSON: %s", key, err)
+		}
+		values[name] = value
+	default:
+		values[name] = raw
+	}
+	return nil
 }
@@ -1,6 +1,9 @@
 package config
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -12,3 +15,122 @@ func TestLoadConfig(t *testing.T) {
 	}
 	_ = myconfig
 }
+
+func TestPrecedence(t *testing.T) {
+	f, err := ioutil.TempFile("", "vendproxy*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{
+		"webserver": {"port": "5001"},
+		"database": {"host": "file-host"},
+		"session": {"maxage": 60, "httponly": false},
+		"loglevel": "debug"
+	}`)
+	f.Close()
+
+	// the docker env files use lower case
+	os.Setenv("database_host", "env-host")
+	os.Setenv("SESSION_MAXAGE", "120")
+	os.Setenv("LOGLEVEL", "warn")
+	defer os.Unsetenv("database_host")
+	defer os.Unsetenv("SESSION_MAXAGE")
+	defer os.Unsetenv("LOGLEVEL")
+
+	c, err := ReadApplicationConfig(f.Name(), Override{Key: "loglevel", Value: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]struct {
+		value  interface{}
+		source string
+	}{
+		"webserver.shutdowntimeout": {c.Webserver.ShutdownTimeout, SourceDefault},
+		"webserver.port":            {c.Webserver.Port, SourceFile},
+		"session.httponly":          {c.Session.HTTPOnly, SourceFile},
+		"database.host":             {c.Database.Host, SourceEnv},
+		"session.maxage":            {c.Session.MaxAge, SourceEnv},
+		"loglevel":                  {c.LogLevel, SourceFlag},
+	}
+	values := map[string]interface{}{
+		"webserver.shutdowntimeout": "30s",
+		"webserver.port":            "5001",
+		"session.httponly":          false,
+		"database.host":             "env-host",
+		"session.maxage":            120,
+		"loglevel":                  "error",
+	}
+	for key, e := range expected {
+		if c.Sources[key] != e.source {
+			t.Errorf("expected %s from the %s got %s", key, e.source, c.Sources[key])
+		}
+		if fmt.Sprint(e.value) != fmt.Sprint(values[key]) {
+			t.Errorf("expected %s to be %v got %v", key, values[key], e.value)
+		}
+	}
+
+	if c.Assets.TemplateDir() != "../assets/templates" {
+		t.Errorf("expected the templates in the assets root got %s", c.Assets.TemplateDir())
+	}
+
+	if _, err = ReadApplicationConfig(f.Name(), Override{Key: "webserver.missing", Value: "x"}); err == nil {
+		t.Error("expected an unknown key to error")
+	}
+
+	os.Setenv("SESSION_MAXAGE", "an hour")
+	if _, err = ReadApplicationConfig(f.Name()); err == nil {
+		t.Error("expected a max age that isn't a number to error")
+	}
+}
+
+func TestFilePath(t *testing.T) {
+	os.Unsetenv("DEV")
+	os.Setenv(PathEnv, "/tmp/from-env.json")
+	defer os.Unsetenv(PathEnv)
+
+	if path := FilePath("/tmp/from-flag.json"); path != "/tmp/from-flag.json" {
+		t.Errorf("expected the flag to win got %s", path)
+	}
+	if path := FilePath(""); path != "/tmp/from-env.json" {
+		t.Errorf("expected $%s got %s", PathEnv, path)
+	}
+	os.Unsetenv(PathEnv)
+	if path := FilePath(""); path != DefaultPath {
+		t.Errorf("expected %s got %s", DefaultPath, path)
+	}
+}
+
+func TestSessionKeyPairs(t *testing.T) {
+	session := SessionConfig{Secret: "SxXcr8n9xFzsfUowQsyMUaou"}
+	pairs, err := session.KeyPairs()
+	if err != nil || len(pairs) != 1 || string(pairs[0]) != session.Secret {
+		t.Errorf("expected the secret to be used when there are no keys, got %q: %v", pairs, err)
+	}
+
+	session.Keys = []SessionKey{
+		{Authentication: "new-authentication-key", Encryption: "0123456789abcdef"},
+		{Authentication: "old-authentication-key"},
+	}
+	pairs, err = session.KeyPairs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 4 || string(pairs[0]) != "new-authentication-key" || string(pairs[1]) != "0123456789abcdef" {
+		t.Errorf("expected the newest pair first, got %q", pairs)
+	}
+	if string(pairs[2]) != "old-authentication-key" || pairs[3] != nil {
+		t.Errorf("expected the old pair without encryption, got %q", pairs)
+	}
+
+	session.Keys = []SessionKey{{Authentication: "new-authentication-key", Encryption: "too-short"}}
+	if _, err = session.KeyPairs(); err == nil {
+		t.Error("expected an invalid encryption key length to error")
+	}
+
+	session.Keys = []SessionKey{{Encryption: "0123456789abcdef"}}
+	if _, err = session.KeyPairs(); err == nil {
+		t.Error("expected a missing authentication key to error")
+	}
+}
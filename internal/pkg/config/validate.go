@@ -0,0 +1,210 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SampleSecret is the session secret in configs/vendproxy.json, it is public
+// so it is only accepted in dev
+const SampleSecret = "SxXcr8n9xFzsfUowQsyMUaou"
+
+const (
+	// minSecretLength is the shortest session secret or authentication key
+	// accepted outside dev, gorilla/sessions recommends 32 or 64 bytes
+	minSecretLength = 32
+	// minSecretBits is a rough lower bound on the entropy of a secret, to
+	// catch secrets like a repeated character or a word
+	minSecretBits = 96
+	// maxSessionAge is a week, sessions only need to last while a register
+	// is being paired or a payment is in progress
+	maxSessionAge = 7 * 24 * 60 * 60
+)
+
+// Errors is every problem found in the configuration
+type Errors []error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = "  " + err.Error()
+	}
+	return fmt.Sprintf("The configuration has %d errors:\n%s", len(e), strings.Join(messages, "\n"))
+}
+
+// Dev reports whether the proxy is running in dev, set by the DEV environment
+// variable
+func Dev() bool {
+	return os.Getenv("DEV") != ""
+}
+
+// Validate checks every value in the configuration and returns Errors with
+// all of the problems found, or nil. Outside dev the database host, https
+// gateways and a strong session secret other than the sample are required.
+func Validate(c HostConfig, dev bool) error {
+	var errs Errors
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	duration := func(key string, value string) {
+		if value == "" {
+			return
+		}
+		if d, err := time.ParseDuration(value); err != nil {
+			add("%s %s is not a duration, e.g. 30s", key, value)
+		} else if d <= 0 {
+			add("%s must be more than 0", key)
+		}
+	}
+
+	if port, err := strconv.Atoi(c.Webserver.Port); err != nil || port < 1 || port > 65535 {
+		add("webserver.port %s must be between 1 and 65535", c.Webserver.Port)
+	}
+	duration("webserver.shutdowntimeout", c.Webserver.ShutdownTimeout)
+	for _, proxy := range c.Webserver.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			add("webserver.trustedproxies %s is not an IP address or CIDR range", proxy)
+		}
+	}
+
+	switch c.Database.Driver {
+	case "", "mysql", "postgres":
+		if c.Database.Host == "" && !dev {
+			add("database.host is required")
+		}
+		if c.Database.Name == "" {
+			add("database.name is required")
+		}
+	case "sqlite3":
+	default:
+		add("database.driver %s must be mysql, postgres or sqlite3", c.Database.Driver)
+	}
+	duration("database.timeout", c.Database.Timeout)
+
+	if c.Session.MaxAge < 0 || c.Session.MaxAge > maxSessionAge {
+		add("session.maxage %d must be between 0 and %d seconds", c.Session.MaxAge, maxSessionAge)
+	}
+	if _, err := c.Session.KeyPairs(); err != nil {
+		add("%s", err)
+	}
+	if len(c.Session.Keys) == 0 {
+		errs = append(errs, checkSecret("session.secret", c.Session.Secret, dev)...)
+	}
+	for i, key := range c.Session.Keys {
+		errs = append(errs, checkSecret(fmt.Sprintf("session.keys.%d.authentication", i), key.Authentication, dev)...)
+	}
+
+	for name, profile := range c.GatewayRegions() {
+		key := "regions." + name + ".gatewayurl"
+		if name == DefaultRegionName && len(c.Regions) == 0 {
+			key = "oxipay.gatewayurl"
+		}
+		checkURL(key, profile.GatewayURL, dev, add)
+		if profile.MinimumAmount < 0 {
+			add("regions.%s.minimumamount must not be negative", name)
+		}
+	}
+	if c.DefaultRegion != "" {
+		if _, ok := c.Regions[c.DefaultRegion]; !ok {
+			add("defaultregion %s is not one of the regions", c.DefaultRegion)
+		}
+	}
+	duration("oxipay.connecttimeout", c.Oxipay.ConnectTimeout)
+	duration("oxipay.timeout", c.Oxipay.Timeout)
+	duration("oxipay.retrybackoff", c.Oxipay.RetryBackoff)
+	if c.Oxipay.Retries < 0 {
+		add("oxipay.retries must not be negative")
+	}
+	if c.Oxipay.MaxIdleConns < 0 {
+		add("oxipay.maxidleconns must not be negative")
+	}
+
+	if c.Admin.Password != "" && c.Admin.Username == "" {
+		add("admin.username is required when admin.password is set")
+	}
+
+	for i, s := range c.Webhooks.Subscribers {
+		checkURL(fmt.Sprintf("webhooks.subscribers.%d.url", i), s.URL, dev, add)
+		if s.Secret == "" {
+			add("webhooks.subscribers.%d.secret is required", i)
+		}
+	}
+	duration("webhooks.interval", c.Webhooks.Interval)
+	duration("webhooks.backoff", c.Webhooks.Backoff)
+	duration("webhooks.timeout", c.Webhooks.Timeout)
+	if c.Webhooks.MaxAttempts < 0 {
+		add("webhooks.maxattempts must not be negative")
+	}
+
+	if c.Assets.Root == "" {
+		add("assets.root is required")
+	}
+
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		add("loglevel %s must be one of panic, fatal, error, warn, info, debug or trace, try info in production", c.LogLevel)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// checkURL requires an absolute URL, which must be https outside dev so that
+// the simulator can be used over http
+func checkURL(key string, value string, dev bool, add func(string, ...interface{})) {
+	if value == "" {
+		add("%s is required", key)
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		add("%s %s must be an absolute URL", key, value)
+		return
+	}
+	if u.Scheme != "https" && !dev {
+		add("%s %s must use https", key, value)
+	}
+}
+
+// checkSecret rejects the sample secret and weak secrets outside dev
+func checkSecret(key string, secret string, dev bool) []error {
+	if secret == "" || dev {
+		// KeyPairs reports a missing secret
+		return nil
+	}
+
+	var errs []error
+	if secret == SampleSecret {
+		errs = append(errs, fmt.Errorf("%s is the sample secret from configs/vendproxy.json, which is only allowed with DEV set", key))
+	}
+	if len(secret) < minSecretLength {
+		errs = append(errs, fmt.Errorf("%s must be at least %d characters", key, minSecretLength))
+	} else if bits := entropy(secret); bits < minSecretBits {
+		errs = append(errs, fmt.Errorf("%s is too predictable, use a random value", key))
+	}
+	return errs
+}
+
+// entropy estimates the bits of entropy in s from the frequency of each byte
+func entropy(s string) float64 {
+	counts := make(map[byte]int)
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+
+	var perByte float64
+	for _, n := range counts {
+		p := float64(n) / float64(len(s))
+		perByte -= p * math.Log2(p)
+	}
+	return perByte * float64(len(s))
+}
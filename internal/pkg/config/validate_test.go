@@ -0,0 +1,72 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func validConfig() HostConfig {
+	c := Defaults()
+	c.Database.Host = "database-vend"
+	c.Database.Name = "vend"
+	c.Session.Secret = "4kTq9vZr2LmXw7NcP0sYh3JdB8fGe6Ua"
+	c.Oxipay.GatewayURL = "https://sandboxpos.oxipay.com.au/webapi/v1/"
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	if err := Validate(validConfig(), false); err != nil {
+		t.Fatalf("expected the configuration to be valid: %s", err)
+	}
+
+	c := validConfig()
+	c.Webserver.Port = "70000"
+	c.Webserver.TrustedProxies = []string{"172.28.0.10", "nginx"}
+	c.Database.Host = ""
+	c.Session.MaxAge = -1
+	c.Oxipay.GatewayURL = "http://sandboxpos.oxipay.com.au/webapi/v1/"
+	c.LogLevel = "verbose"
+
+	err := Validate(c, false)
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("expected Errors got %v", err)
+	}
+	for _, key := range []string{"webserver.port", "webserver.trustedproxies nginx", "database.host", "session.maxage", "oxipay.gatewayurl", "loglevel"} {
+		if !strings.Contains(errs.Error(), key) {
+			t.Errorf("expected an error for %s in %s", key, errs)
+		}
+	}
+	if len(errs) != 6 {
+		t.Errorf("expected 6 errors got %d: %s", len(errs), errs)
+	}
+
+	// dev allows a local database and the simulator over http
+	c = validConfig()
+	c.Database.Host = ""
+	c.Oxipay.GatewayURL = "http://localhost:5001/"
+	if err = Validate(c, true); err != nil {
+		t.Errorf("expected dev to allow http and no database host: %s", err)
+	}
+}
+
+func TestValidateSecret(t *testing.T) {
+	c := validConfig()
+	c.Session.Secret = SampleSecret
+	if err := Validate(c, false); err == nil || !strings.Contains(err.Error(), "sample secret") {
+		t.Errorf("expected the sample secret to be refused, got %v", err)
+	}
+	if err := Validate(c, true); err != nil {
+		t.Errorf("expected the sample secret to be allowed in dev: %s", err)
+	}
+
+	c.Session.Secret = strings.Repeat("ab", 16)
+	if err := Validate(c, false); err == nil || !strings.Contains(err.Error(), "predictable") {
+		t.Errorf("expected a repetitive secret to be refused, got %v", err)
+	}
+
+	c.Session.Keys = []SessionKey{{Authentication: SampleSecret}}
+	if err := Validate(c, false); err == nil || !strings.Contains(err.Error(), "session.keys.0.authentication") {
+		t.Errorf("expected the sample secret to be refused as a key, got %v", err)
+	}
+}
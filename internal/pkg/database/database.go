@@ -0,0 +1,108 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+)
+
+const (
+	// DriverMySQL MySQL or MariaDB, the default
+	DriverMySQL = "mysql"
+	// DriverPostgres PostgreSQL
+	DriverPostgres = "postgres"
+	// DriverSQLite SQLite, use a name of :memory: for an in-memory database
+	DriverSQLite = "sqlite3"
+)
+
+// Driver returns the database/sql driver name for the connection
+func Driver(params config.DbConnection) string {
+	if params.Driver == "" {
+		return DriverMySQL
+	}
+	return params.Driver
+}
+
+// DSN builds the data source name for the configured driver
+func DSN(params config.DbConnection) (string, error) {
+	switch Driver(params) {
+	case DriverMySQL:
+		return fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true&loc=Local&timeout=%s",
+			params.Username,
+			params.Password,
+			params.Host,
+			params.Name,
+			params.Timeout,
+		), nil
+	case DriverPostgres:
+		query := url.Values{}
+		sslMode := params.SSLMode
+		if sslMode == "" {
+			sslMode = "require"
+		}
+		query.Set("sslmode", sslMode)
+		if timeout, err := time.ParseDuration(params.Timeout); err == nil {
+			query.Set("connect_timeout", strconv.Itoa(int(timeout.Seconds())))
+		}
+		dsn := url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(params.Username, params.Password),
+			Host:     params.Host,
+			Path:     "/" + params.Name,
+			RawQuery: query.Encode(),
+		}
+		return dsn.String(), nil
+	case DriverSQLite:
+		if params.Name == "" {
+			return ":memory:", nil
+		}
+		return params.Name, nil
+	}
+	return "", fmt.Errorf("Database driver %s is not supported", params.Driver)
+}
+
+// Open returns a handle to the configured database. Like sql.Open it does not
+// establish a connection.
+func Open(params config.DbConnection) (*sql.DB, error) {
+	dsn, err := DSN(params)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(Driver(params), dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if Driver(params) == DriverSQLite {
+		// every connection to :memory: is a new database, and SQLite only allows
+		// a single writer anyway
+		db.SetMaxOpenConns(1)
+	}
+	return db, nil
+}
+
+// Rebind converts a query written with ? placeholders to the placeholder
+// syntax used by the driver
+func Rebind(driver string, query string) string {
+	if driver != DriverPostgres {
+		return query
+	}
+
+	var buffer strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			buffer.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		buffer.WriteRune(c)
+	}
+	return buffer.String()
+}
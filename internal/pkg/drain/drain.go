@@ -0,0 +1,66 @@
+package drain
+
+import (
+	"context"
+	"sync"
+)
+
+// Group tracks in-flight work so that a shutdown can wait for it to finish.
+// Once the group starts draining no new work is accepted.
+type Group struct {
+	mu       sync.Mutex
+	draining bool
+	wg       sync.WaitGroup
+}
+
+// NewGroup returns a group that is accepting work
+func NewGroup() *Group {
+	return &Group{}
+}
+
+// Acquire registers a unit of work. It returns false once the group is
+// draining, in which case the work must not be started and Release must not
+// be called.
+func (g *Group) Acquire() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.draining {
+		return false
+	}
+	g.wg.Add(1)
+	return true
+}
+
+// Release marks a unit of work started with Acquire as finished
+func (g *Group) Release() {
+	g.wg.Done()
+}
+
+// Draining reports whether the group has stopped accepting work
+func (g *Group) Draining() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.draining
+}
+
+// Drain stops accepting work and waits for the in-flight work to finish. It
+// returns the context error if the context is done first.
+func (g *Group) Drain(ctx context.Context) error {
+	g.mu.Lock()
+	g.draining = true
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,47 @@
+package drain
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDrainWaitsForInFlightWork(t *testing.T) {
+	g := NewGroup()
+	if !g.Acquire() {
+		t.Fatal("expected a new group to accept work")
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(finished)
+		g.Release()
+	}()
+
+	if err := g.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-finished:
+	default:
+		t.Error("Drain returned before the work finished")
+	}
+
+	if g.Acquire() || !g.Draining() {
+		t.Error("expected a drained group to refuse new work")
+	}
+}
+
+func TestDrainDeadline(t *testing.T) {
+	g := NewGroup()
+	g.Acquire()
+	defer g.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := g.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded got %v", err)
+	}
+}
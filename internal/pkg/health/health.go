@@ -0,0 +1,175 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// StatusOK every check passed
+	StatusOK = "ok"
+	// StatusUnavailable at least one check failed
+	StatusUnavailable = "unavailable"
+)
+
+// DefaultTimeout limits how long all of the checks can take
+const DefaultTimeout = 5 * time.Second
+
+// CheckFunc returns an error if the dependency it checks isn't usable
+type CheckFunc func(ctx context.Context) error
+
+// Result is the outcome of a single check
+type Result struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is the outcome of every check
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks,omitempty"`
+}
+
+type check struct {
+	name string
+	fn   CheckFunc
+}
+
+// Checker runs the checks that decide whether the proxy is ready to take payments
+type Checker struct {
+	Timeout time.Duration
+	Log     *logrus.Logger
+	checks  []check
+	ready   int32
+}
+
+// NewChecker returns a Checker without any checks
+func NewChecker(log *logrus.Logger) *Checker {
+	return &Checker{
+		Timeout: DefaultTimeout,
+		Log:     log,
+	}
+}
+
+// Add registers a check, it is reported under name
+func (c *Checker) Add(name string, fn CheckFunc) {
+	c.checks = append(c.checks, check{name: name, fn: fn})
+}
+
+// Run runs every check concurrently
+func (c *Checker) Run(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	report := Report{
+		Status: StatusOK,
+		Checks: make(map[string]Result, len(c.checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, chk := range c.checks {
+		wg.Add(1)
+		go func(chk check) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := chk.fn(ctx)
+			result := Result{
+				Status:   StatusOK,
+				Duration: time.Since(start).String(),
+			}
+			if err != nil {
+				result.Status = StatusUnavailable
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[chk.name] = result
+			if err != nil {
+				report.Status = StatusUnavailable
+			}
+		}(chk)
+	}
+	wg.Wait()
+
+	return report
+}
+
+// Ready reports whether the checks have passed since the proxy started
+func (c *Checker) Ready() bool {
+	return atomic.LoadInt32(&c.ready) == 1
+}
+
+// WaitUntilReady runs the checks every interval until they all pass or ctx is done
+func (c *Checker) WaitUntilReady(ctx context.Context, interval time.Duration) error {
+	for {
+		report := c.Run(ctx)
+		if report.Status == StatusOK {
+			atomic.StoreInt32(&c.ready, 1)
+			return nil
+		}
+
+		for name, result := range report.Checks {
+			if result.Status != StatusOK {
+				c.Log.Warnf("Not ready, %s check failed: %s", name, result.Error)
+			}
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// LiveHandler reports that the process is running
+func LiveHandler(w http.ResponseWriter, r *http.Request) {
+	sendJSON(w, http.StatusOK, Report{Status: StatusOK})
+}
+
+// ReadyHandler runs the checks, responding with a 503 if any of them fail
+func (c *Checker) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	report := c.Run(r.Context())
+
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	sendJSON(w, status, report)
+}
+
+// Gate refuses every request with a 503 until the checks have passed, apart
+// from the paths in exempt
+func (c *Checker) Gate(next http.Handler, exempt ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.Ready() {
+			allowed := false
+			for _, path := range exempt {
+				allowed = allowed || r.URL.Path == path
+			}
+			if !allowed {
+				w.Header().Set("Retry-After", "5")
+				sendJSON(w, http.StatusServiceUnavailable, Report{Status: StatusUnavailable})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func sendJSON(w http.ResponseWriter, status int, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
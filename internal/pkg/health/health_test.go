@@ -0,0 +1,70 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestReadyHandler(t *testing.T) {
+	checker := NewChecker(logrus.New())
+	checker.Add("database", func(ctx context.Context) error { return nil })
+	checker.Add("templates", func(ctx context.Context) error { return errors.New("index.html is missing") })
+
+	rr := httptest.NewRecorder()
+	checker.ReadyHandler(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %d got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+
+	var report Report
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Status != StatusUnavailable || report.Checks["database"].Status != StatusOK {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if report.Checks["templates"].Error != "index.html is missing" {
+		t.Errorf("expected the failure to be reported got %+v", report.Checks["templates"])
+	}
+}
+
+func TestGate(t *testing.T) {
+	failures := 2
+	checker := NewChecker(logrus.New())
+	checker.Add("database", func(ctx context.Context) error {
+		if failures > 0 {
+			failures--
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+
+	handler := checker.Gate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), "/healthz")
+
+	for path, expected := range map[string]int{"/pay": http.StatusServiceUnavailable, "/healthz": http.StatusOK} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != expected {
+			t.Errorf("expected %d for %s before ready got %d", expected, path, rr.Code)
+		}
+	}
+
+	if err := checker.WaitUntilReady(context.Background(), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/pay", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected %d once ready got %d", http.StatusOK, rr.Code)
+	}
+}
@@ -0,0 +1,239 @@
+package keyring
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+)
+
+// KeySize master keys and data keys are AES-256 keys
+const KeySize = 32
+
+// Plaintext is the key version recorded against values that are not encrypted
+const Plaintext = 0
+
+// ErrUnknownVersion the value was encrypted with a master key that is not in the keyring
+var ErrUnknownVersion = errors.New("The value was encrypted with an unknown key version")
+
+// Keyring holds the versioned master keys used for envelope encryption. Each
+// value is encrypted with a random data key, and the data key is encrypted
+// with the current master key. Rotating the master key only needs the data
+// keys to be re-encrypted.
+type Keyring struct {
+	keys    map[int][]byte
+	current int
+}
+
+// NewKeyring returns a keyring that encrypts new values with the master key
+// for the current version
+func NewKeyring(keys map[int][]byte, current int) (*Keyring, error) {
+	for version, key := range keys {
+		if version <= Plaintext {
+			return nil, fmt.Errorf("Key version %d is invalid, versions start at 1", version)
+		}
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("Key version %d must be %d bytes", version, KeySize)
+		}
+	}
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("There is no key for the current version %d", current)
+	}
+	return &Keyring{keys: keys, current: current}, nil
+}
+
+// Load builds the keyring from the keys in the configuration and the key
+// file. It returns nil when no keys are configured.
+func Load(encryption config.EncryptionConfig) (*Keyring, error) {
+	encoded := make(map[string]string)
+	for version, key := range encryption.Keys {
+		encoded[version] = key
+	}
+
+	if encryption.KeyFile != "" {
+		fromFile, err := readKeyFile(encryption.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		for version, key := range fromFile {
+			encoded[version] = key
+		}
+	}
+
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+
+	keys := make(map[int][]byte, len(encoded))
+	current := encryption.Version
+	for v, key := range encoded {
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("Key version %s is not a number", v)
+		}
+		keys[version], err = base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("Key version %d is not valid base64", version)
+		}
+		if encryption.Version == 0 && version > current {
+			current = version
+		}
+	}
+	return NewKeyring(keys, current)
+}
+
+// readKeyFile reads a file of version:key lines. Blank lines and lines
+// starting with # are ignored.
+func readKeyFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Key file %s should contain version:key lines", path)
+		}
+		keys[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return keys, scanner.Err()
+}
+
+// Current returns the version of the master key used to encrypt new values
+func (k *Keyring) Current() int {
+	return k.current
+}
+
+// Encrypt seals the plaintext with a new data key and returns the envelope
+// along with the master key version that protects it
+func (k *Keyring) Encrypt(plaintext string) (string, int, error) {
+	dataKey := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", 0, err
+	}
+
+	wrappedKey, err := seal(k.keys[k.current], dataKey)
+	if err != nil {
+		return "", 0, err
+	}
+	ciphertext, err := seal(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", 0, err
+	}
+	return encode(wrappedKey, ciphertext), k.current, nil
+}
+
+// Decrypt opens an envelope created by Encrypt
+func (k *Keyring) Decrypt(envelope string, version int) (string, error) {
+	dataKey, ciphertext, err := k.unwrap(envelope, version)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(dataKey, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Rewrap re-encrypts the data key in the envelope with the current master
+// key. Values stored in plaintext are encrypted.
+func (k *Keyring) Rewrap(envelope string, version int) (string, int, error) {
+	if version == Plaintext {
+		return k.Encrypt(envelope)
+	}
+
+	dataKey, ciphertext, err := k.unwrap(envelope, version)
+	if err != nil {
+		return "", 0, err
+	}
+
+	wrappedKey, err := seal(k.keys[k.current], dataKey)
+	if err != nil {
+		return "", 0, err
+	}
+	return encode(wrappedKey, ciphertext), k.current, nil
+}
+
+func (k *Keyring) unwrap(envelope string, version int) ([]byte, []byte, error) {
+	masterKey, ok := k.keys[version]
+	if !ok {
+		return nil, nil, ErrUnknownVersion
+	}
+
+	parts := strings.SplitN(envelope, ".", 2)
+	if len(parts) != 2 {
+		return nil, nil, errors.New("The encrypted value is malformed")
+	}
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataKey, err := open(masterKey, wrappedKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dataKey, ciphertext, nil
+}
+
+func encode(wrappedKey []byte, ciphertext []byte) string {
+	return base64.RawStdEncoding.EncodeToString(wrappedKey) + "." + base64.RawStdEncoding.EncodeToString(ciphertext)
+}
+
+// seal encrypts with AES-GCM and prepends the random nonce
+func seal(key []byte, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(key []byte, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("The encrypted value is too short")
+	}
+	nonce := sealed[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, sealed[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,138 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+)
+
+var (
+	keyOne = bytes.Repeat([]byte{1}, KeySize)
+	keyTwo = bytes.Repeat([]byte{2}, KeySize)
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	keys, err := NewKeyring(map[int][]byte{1: keyOne}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelope, version, err := keys.Encrypt("VK5NGgc7nFJp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 || strings.Contains(envelope, "VK5NGgc7nFJp") {
+		t.Errorf("unexpected envelope %s for version %d", envelope, version)
+	}
+
+	// every value gets its own data key and nonce
+	if again, _, _ := keys.Encrypt("VK5NGgc7nFJp"); again == envelope {
+		t.Error("encrypting the same value twice should not give the same envelope")
+	}
+
+	plaintext, err := keys.Decrypt(envelope, version)
+	if err != nil || plaintext != "VK5NGgc7nFJp" {
+		t.Errorf("expected VK5NGgc7nFJp got %s: %v", plaintext, err)
+	}
+
+	if _, err = keys.Decrypt(envelope, 2); err != ErrUnknownVersion {
+		t.Errorf("expected ErrUnknownVersion got %v", err)
+	}
+
+	parts := strings.SplitN(envelope, ".", 2)
+	ciphertext, _ := base64.RawStdEncoding.DecodeString(parts[1])
+	ciphertext[len(ciphertext)-1] ^= 0xff
+	tampered := parts[0] + "." + base64.RawStdEncoding.EncodeToString(ciphertext)
+	if _, err = keys.Decrypt(tampered, version); err == nil {
+		t.Error("expected a tampered envelope to fail authentication")
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	old, _ := NewKeyring(map[int][]byte{1: keyOne}, 1)
+	envelope, _, _ := old.Encrypt("VK5NGgc7nFJp")
+
+	keys, err := NewKeyring(map[int][]byte{1: keyOne, 2: keyTwo}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewrapped, version, err := keys.Rewrap(envelope, 1)
+	if err != nil || version != 2 {
+		t.Fatalf("expected version 2 got %d: %v", version, err)
+	}
+
+	// the data is untouched, only the data key is re-encrypted
+	if strings.SplitN(rewrapped, ".", 2)[1] != strings.SplitN(envelope, ".", 2)[1] {
+		t.Error("expected the ciphertext to be unchanged")
+	}
+
+	retired, _ := NewKeyring(map[int][]byte{2: keyTwo}, 2)
+	if plaintext, err := retired.Decrypt(rewrapped, version); err != nil || plaintext != "VK5NGgc7nFJp" {
+		t.Errorf("expected VK5NGgc7nFJp got %s: %v", plaintext, err)
+	}
+
+	encrypted, version, err := keys.Rewrap("JCjbPGtuniWr", Plaintext)
+	if err != nil || version != 2 {
+		t.Fatalf("expected a plaintext key to be encrypted with version 2 got %d: %v", version, err)
+	}
+	if plaintext, _ := keys.Decrypt(encrypted, version); plaintext != "JCjbPGtuniWr" {
+		t.Errorf("expected JCjbPGtuniWr got %s", plaintext)
+	}
+}
+
+func TestNewKeyringValidation(t *testing.T) {
+	if _, err := NewKeyring(map[int][]byte{1: keyOne}, 2); err == nil {
+		t.Error("expected an error when the current version has no key")
+	}
+	if _, err := NewKeyring(map[int][]byte{1: keyOne[:16]}, 1); err == nil {
+		t.Error("expected an error for a short key")
+	}
+	if _, err := NewKeyring(map[int][]byte{0: keyOne}, 0); err == nil {
+		t.Error("expected an error for version 0")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	keys, err := Load(config.EncryptionConfig{})
+	if keys != nil || err != nil {
+		t.Errorf("expected no keyring got %v: %v", keys, err)
+	}
+
+	file, err := ioutil.TempFile("", "vendproxy-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("# retired once every register is rotated\n1:" + base64.StdEncoding.EncodeToString(keyOne) + "\n\n")
+	file.Close()
+
+	keys, err = Load(config.EncryptionConfig{
+		Keys:    map[string]string{"2": base64.StdEncoding.EncodeToString(keyTwo)},
+		KeyFile: file.Name(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.Current() != 2 {
+		t.Errorf("expected the highest version to be current got %d", keys.Current())
+	}
+
+	keys, err = Load(config.EncryptionConfig{
+		Keys:    map[string]string{"2": base64.StdEncoding.EncodeToString(keyTwo)},
+		KeyFile: file.Name(),
+		Version: 1,
+	})
+	if err != nil || keys.Current() != 1 {
+		t.Errorf("expected version 1 to be current: %v", err)
+	}
+
+	if _, err = Load(config.EncryptionConfig{Keys: map[string]string{"one": "abc"}}); err == nil {
+		t.Error("expected an error for a version that isn't a number")
+	}
+}
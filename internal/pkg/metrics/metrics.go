@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "vendproxy"
+
+// Registry holds every metric exposed by the proxy
+var Registry = prometheus.NewRegistry()
+
+var (
+	// Transactions counts each outcome recorded for a request to Oxipay by the
+	// type of request, the mapped TxnStatus and the raw x_code
+	Transactions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "oxipay_transactions_total",
+		Help:      "Outcomes of requests sent to Oxipay by type, status and x_code.",
+	}, []string{"type", "status", "code"})
+
+	// GatewayLatency is how long each request to the Oxipay gateway took
+	GatewayLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "oxipay_request_duration_seconds",
+		Help:      "Latency of requests to the Oxipay gateway by endpoint.",
+		Buckets:   []float64{.1, .25, .5, 1, 2.5, 5, 10, 20, 40, 60},
+	}, []string{"endpoint"})
+
+	// GatewayErrors counts requests to the Oxipay gateway that failed without a response
+	GatewayErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "oxipay_request_errors_total",
+		Help:      "Requests to the Oxipay gateway that failed without a response by endpoint.",
+	}, []string{"endpoint"})
+
+	// SignatureFailures counts responses that failed signature verification
+	SignatureFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "oxipay_signature_failures_total",
+		Help:      "Responses from Oxipay whose signature did not match.",
+	})
+
+	// RegisterLookupLatency is how long it takes to load a register from the database
+	RegisterLookupLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "register_lookup_duration_seconds",
+		Help:      "Latency of register lookups in the database.",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		Transactions,
+		GatewayLatency,
+		GatewayErrors,
+		SignatureFailures,
+		RegisterLookupLatency,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// ObserveTransaction counts the outcome of a request to Oxipay
+func ObserveTransaction(txnType string, status string, code string) {
+	Transactions.WithLabelValues(strings.ToLower(txnType), status, code).Inc()
+}
+
+// Since observes the time elapsed since start on the histogram
+func Since(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
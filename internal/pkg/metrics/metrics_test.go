@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	ObserveTransaction("AUTHORISATION", "APPROVED", "SPRA01")
+	Since(GatewayLatency.WithLabelValues("ProcessAuthorisation"), time.Now())
+	SignatureFailures.Inc()
+
+	rr := httptest.NewRecorder()
+	Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rr.Body)
+
+	expected := []string{
+		`vendproxy_oxipay_transactions_total{code="SPRA01",status="APPROVED",type="authorisation"} 1`,
+		`vendproxy_oxipay_request_duration_seconds_count{endpoint="ProcessAuthorisation"} 1`,
+		`vendproxy_oxipay_signature_failures_total 1`,
+		`vendproxy_register_lookup_duration_seconds_count 0`,
+	}
+	for _, metric := range expected {
+		if !strings.Contains(string(body), metric) {
+			t.Errorf("expected %s in\n%s", metric, body)
+		}
+	}
+}
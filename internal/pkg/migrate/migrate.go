@@ -0,0 +1,396 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/database"
+)
+
+// files holds a directory of migrations for each driver, named
+// NNNN_name.up.sql and NNNN_name.down.sql. The drivers share version numbers
+// so that the databases behind each region can be compared, a version that a
+// driver doesn't need, like the MySQL sessions table, is left out for it.
+//
+//go:embed migrations
+var files embed.FS
+
+// schemaTables creates the table recording the versions that have been
+// applied for each driver
+var schemaTables = map[string]string{
+	database.DriverMySQL: `CREATE TABLE IF NOT EXISTS oxipay_vend_schema (
+			version int NOT NULL,
+			name varchar(255) NOT NULL,
+			applied_date datetime NOT NULL,
+			primary key(version)
+		) engine=InnoDB`,
+	database.DriverPostgres: `CREATE TABLE IF NOT EXISTS oxipay_vend_schema (
+			version int NOT NULL,
+			name varchar(255) NOT NULL,
+			applied_date timestamp NOT NULL,
+			primary key(version)
+		)`,
+	database.DriverSQLite: `CREATE TABLE IF NOT EXISTS oxipay_vend_schema (
+			version int NOT NULL primary key,
+			name varchar(255) NOT NULL,
+			applied_date datetime NOT NULL
+		)`,
+}
+
+const (
+	// lockName is the MySQL named lock and lockID the Postgres advisory lock
+	// held while migrating, so that the AU and NZ proxies starting together
+	// don't both apply a migration
+	lockName = "oxipay_vend_schema"
+	lockID   = 7102018
+	// lockTimeout is how long to wait for another instance to finish migrating
+	lockTimeout = 60 * time.Second
+)
+
+// Migration is a single version of the schema
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status reports whether a migration has been applied. Versions recorded in
+// the database that this build doesn't know about are included with an empty Up.
+type Status struct {
+	*Migration
+	Applied     bool
+	AppliedDate time.Time
+}
+
+// Load returns the migrations for the driver in version order
+func Load(driver string) ([]*Migration, error) {
+	dir := path.Join("migrations", driver)
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, fmt.Errorf("There are no migrations for the %s driver", driver)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+
+		var up bool
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			up = true
+		case strings.HasSuffix(name, ".down.sql"):
+		default:
+			return nil, fmt.Errorf("Unexpected migration %s", name)
+		}
+
+		parts := strings.SplitN(strings.SplitN(name, ".", 2)[0], "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("Migration %s must be named NNNN_name.up.sql or NNNN_name.down.sql", name)
+		}
+
+		script, err := fs.ReadFile(files, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = m
+		}
+		if m.Name != parts[1] {
+			return nil, fmt.Errorf("Migration %04d is named both %s and %s", version, m.Name, parts[1])
+		}
+		if up {
+			m.Up = string(script)
+		} else {
+			m.Down = string(script)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("Migration %04d_%s needs both an up and a down script", m.Version, m.Name)
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Migrator applies the embedded migrations to a database and records each
+// version in the schema table
+type Migrator struct {
+	Db         *sql.DB
+	Driver     string
+	Migrations []*Migration
+}
+
+// NewMigrator returns a Migrator with the migrations for the driver
+func NewMigrator(driver string, db *sql.DB) (*Migrator, error) {
+	migrations, err := Load(driver)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{
+		Db:         db,
+		Driver:     driver,
+		Migrations: migrations,
+	}, nil
+}
+
+// Status returns every migration and whether it has been applied
+func (m *Migrator) Status() ([]Status, error) {
+	ctx := context.Background()
+	conn, err := m.Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []Status
+	for _, migration := range m.Migrations {
+		status := Status{Migration: migration}
+		if s, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedDate = s.AppliedDate
+			delete(applied, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+
+	// applied by a newer build
+	for _, s := range applied {
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, nil
+}
+
+// Pending returns the migrations that haven't been applied
+func (m *Migrator) Pending() ([]*Migration, error) {
+	statuses, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []*Migration
+	for _, s := range statuses {
+		if !s.Applied {
+			pending = append(pending, s.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// Up applies every pending migration in order and returns the ones applied.
+// It refuses to run against a database migrated by a newer build.
+func (m *Migrator) Up() ([]*Migration, error) {
+	ctx := context.Background()
+	conn, unlock, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	for version, s := range applied {
+		if m.find(version) == nil {
+			return nil, fmt.Errorf("The database has migration %04d_%s which is newer than this build", version, s.Name)
+		}
+	}
+
+	var done []*Migration
+	for _, migration := range m.Migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		err = m.apply(ctx, conn, migration.Up,
+			`INSERT INTO oxipay_vend_schema (version, name, applied_date) VALUES (?, ?, ?)`,
+			migration.Version, migration.Name, time.Now().UTC(),
+		)
+		if err != nil {
+			return done, fmt.Errorf("Migration %04d_%s failed: %s", migration.Version, migration.Name, err)
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Down reverts the latest applied migration and returns it, or nil when no
+// migrations have been applied
+func (m *Migrator) Down() (*Migration, error) {
+	ctx := context.Background()
+	conn, unlock, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := 0
+	for version := range applied {
+		if version > latest {
+			latest = version
+		}
+	}
+	if latest == 0 {
+		return nil, nil
+	}
+
+	migration := m.find(latest)
+	if migration == nil {
+		return nil, fmt.Errorf("Migration %04d_%s was applied by a newer build and can only be reverted by it", latest, applied[latest].Name)
+	}
+
+	err = m.apply(ctx, conn, migration.Down, `DELETE FROM oxipay_vend_schema WHERE version = ?`, migration.Version)
+	if err != nil {
+		return nil, fmt.Errorf("Reverting migration %04d_%s failed: %s", migration.Version, migration.Name, err)
+	}
+	return migration, nil
+}
+
+func (m *Migrator) find(version int) *Migration {
+	for _, migration := range m.Migrations {
+		if migration.Version == version {
+			return migration
+		}
+	}
+	return nil
+}
+
+// applied creates the schema table if needed and returns the recorded versions
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int]Status, error) {
+	if _, err := conn.ExecContext(ctx, schemaTables[m.Driver]); err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, `SELECT version, name, applied_date FROM oxipay_vend_schema`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]Status)
+	for rows.Next() {
+		s := Status{Migration: new(Migration), Applied: true}
+		if err = rows.Scan(&s.Version, &s.Name, &s.AppliedDate); err != nil {
+			return nil, err
+		}
+		applied[s.Version] = s
+	}
+	return applied, rows.Err()
+}
+
+// apply runs a script and records it in the schema table in a transaction.
+// MySQL commits DDL as it goes, so a MySQL migration that fails part way has
+// to be fixed by hand, which is why its scripts use IF NOT EXISTS.
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, script string, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, statement := range statements(m.Driver, script) {
+		if _, err = tx.ExecContext(ctx, statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err = tx.ExecContext(ctx, database.Rebind(m.Driver, record), args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// lock takes a connection holding the migration lock. SQLite only allows a
+// single connection so it doesn't need one.
+func (m *Migrator) lock(ctx context.Context) (*sql.Conn, func(), error) {
+	conn, err := m.Db.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var unlock string
+	switch m.Driver {
+	case database.DriverMySQL:
+		var locked sql.NullInt64
+		err = conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, lockName, int(lockTimeout.Seconds())).Scan(&locked)
+		if err == nil && locked.Int64 != 1 {
+			err = errors.New("Timed out waiting for another instance to finish migrating")
+		}
+		unlock = `SELECT RELEASE_LOCK('` + lockName + `')`
+	case database.DriverPostgres:
+		lockCtx, cancel := context.WithTimeout(ctx, lockTimeout)
+		_, err = conn.ExecContext(lockCtx, `SELECT pg_advisory_lock($1)`, lockID)
+		cancel()
+		unlock = `SELECT pg_advisory_unlock(` + strconv.Itoa(lockID) + `)`
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, func() {
+		if unlock != "" {
+			conn.ExecContext(ctx, unlock)
+		}
+		conn.Close()
+	}, nil
+}
+
+// statements splits a script into the statements to execute. The MySQL driver
+// only runs one statement at a time, the other drivers run the whole script,
+// which lets SQLite triggers contain semicolons. Comments are dropped so a
+// script without any statements does nothing.
+func statements(driver string, script string) []string {
+	var found []string
+	var current strings.Builder
+
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+
+		if driver == database.DriverMySQL && strings.HasSuffix(trimmed, ";") {
+			found = append(found, current.String())
+			current.Reset()
+		}
+	}
+	if strings.TrimSpace(current.String()) != "" {
+		found = append(found, current.String())
+	}
+	return found
+}
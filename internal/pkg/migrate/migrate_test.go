@@ -0,0 +1,143 @@
+package migrate
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/oxipay/oxipay-vend/internal/pkg/database"
+)
+
+func newMigrator(t *testing.T) *Migrator {
+	db, err := sql.Open(database.DriverSQLite, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: is a new database
+	db.SetMaxOpenConns(1)
+
+	migrator, err := NewMigrator(database.DriverSQLite, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrator
+}
+
+// TestLoad checks that the drivers share versions, apart from the MySQL
+// sessions table, otherwise the databases behind each region can't be compared
+func TestLoad(t *testing.T) {
+	expected, err := Load(database.DriverMySQL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, driver := range []string{database.DriverPostgres, database.DriverSQLite} {
+		migrations, err := Load(driver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// only MySQL stores sessions in the database
+		if len(migrations) != len(expected)-1 {
+			t.Fatalf("%s has %d migrations, mysql has %d", driver, len(migrations), len(expected))
+		}
+		i := 0
+		for _, m := range expected {
+			if m.Name == "sessions" {
+				continue
+			}
+			if migrations[i].Version != m.Version || migrations[i].Name != m.Name {
+				t.Errorf("%s has %04d_%s where mysql has %04d_%s", driver, migrations[i].Version, migrations[i].Name, m.Version, m.Name)
+			}
+			i++
+		}
+	}
+
+	if _, err = Load("oracle"); err == nil {
+		t.Error("expected an error for a driver without migrations")
+	}
+}
+
+func TestUpAndDown(t *testing.T) {
+	migrator := newMigrator(t)
+
+	applied, err := migrator.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrator.Migrations) {
+		t.Fatalf("expected %d migrations to be applied got %d", len(migrator.Migrations), len(applied))
+	}
+	if _, err = migrator.Db.Exec(`SELECT region, key_version, active FROM oxipay_vend_map`); err != nil {
+		t.Errorf("expected the columns added by the migrations: %s", err)
+	}
+
+	// nothing left to do the second time
+	if applied, err = migrator.Up(); err != nil || len(applied) != 0 {
+		t.Errorf("expected no migrations to be applied got %d: %v", len(applied), err)
+	}
+
+	latest := migrator.Migrations[len(migrator.Migrations)-1]
+	reverted, err := migrator.Down()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reverted.Version != latest.Version {
+		t.Errorf("expected %04d to be reverted got %04d", latest.Version, reverted.Version)
+	}
+
+	pending, err := migrator.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Version != latest.Version {
+		t.Errorf("expected only %04d to be pending got %d", latest.Version, len(pending))
+	}
+
+	if applied, err = migrator.Up(); err != nil || len(applied) != 1 {
+		t.Errorf("expected the reverted migration to be applied again got %d: %v", len(applied), err)
+	}
+}
+
+func TestNewerDatabase(t *testing.T) {
+	migrator := newMigrator(t)
+	if _, err := migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// an older build doesn't know about the latest migration
+	latest := migrator.Migrations[len(migrator.Migrations)-1]
+	migrator.Migrations = migrator.Migrations[:len(migrator.Migrations)-1]
+
+	if _, err := migrator.Up(); err == nil {
+		t.Error("expected a database migrated by a newer build to be refused")
+	}
+
+	statuses, err := migrator.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := statuses[len(statuses)-1]
+	if last.Version != latest.Version || last.Name != latest.Name || !last.Applied {
+		t.Errorf("expected the newer migration in the status got %+v", last)
+	}
+}
+
+func TestStatements(t *testing.T) {
+	script := `-- a comment
+
+CREATE TABLE a (id int);
+CREATE TRIGGER b BEFORE DELETE ON a
+BEGIN
+    SELECT RAISE(ABORT, 'no');
+END;
+`
+	if got := statements(database.DriverMySQL, script); len(got) != 3 {
+		t.Errorf("expected mysql to run each statement on its own got %q", got)
+	}
+	if got := statements(database.DriverSQLite, script); len(got) != 1 {
+		t.Errorf("expected sqlite to run the whole script got %q", got)
+	}
+	if got := statements(database.DriverPostgres, "-- nothing to do\n"); len(got) != 0 {
+		t.Errorf("expected no statements got %q", got)
+	}
+}
@@ -0,0 +1,10 @@
+-- used by the MySQL session store
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id INT NOT NULL AUTO_INCREMENT,
+    session_data LONGBLOB,
+    created_on TIMESTAMP DEFAULT NOW(),
+    modified_on TIMESTAMP NOT NULL DEFAULT NOW() ON UPDATE CURRENT_TIMESTAMP,
+    expires_on TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY(id)
+) engine=InnoDB, COMMENT = 'This stores http sessions and is required by the session store handler';
@@ -0,0 +1,22 @@
+-- every request sent to Oxipay
+
+create table IF NOT EXISTS oxipay_vend_transaction (
+    id varchar(64) NOT NULL COMMENT 'Transaction ID generated by the proxy',
+    txn_type varchar(32) NOT NULL COMMENT 'AUTHORISATION or ADJUSTMENT',
+    vend_sale_id varchar(255) COMMENT 'Sale ID provided by Vend',
+    origin_domain varchar(255) NOT NULL COMMENT 'Vend origin provided in the initial request',
+    vend_register_id varchar(255) NOT NULL COMMENT 'Unique Register ID from Vend',
+    fxl_register_id varchar(255) NOT NULL COMMENT 'i.e oxipay/ezi-pay Device ID',
+    fxl_seller_id varchar(255) NOT NULL COMMENT 'i.e Merchant ID in oxipay/ezi-pay',
+    amount bigint NOT NULL COMMENT 'Amount sent to Oxipay in cents',
+    pos_transaction_ref varchar(255) NOT NULL COMMENT 'x_pos_transaction_ref sent to Oxipay',
+    purchase_number varchar(255) COMMENT 'x_purchase_number returned by Oxipay',
+    oxipay_code varchar(16) COMMENT 'x_code returned by Oxipay',
+    txn_status varchar(32) NOT NULL COMMENT 'PENDING until Oxipay responds, then the mapped TxnStatus',
+    message text COMMENT 'x_message returned by Oxipay',
+    created_date datetime DEFAULT CURRENT_TIMESTAMP,
+    modified_date datetime,
+    primary key(id),
+    index idx_vend_sale (origin_domain, vend_register_id, vend_sale_id),
+    index idx_purchase_number (purchase_number)
+) engine=InnoDB;
@@ -0,0 +1,5 @@
+-- allow registers to be deactivated
+
+ALTER TABLE oxipay_vend_map
+    ADD COLUMN IF NOT EXISTS active tinyint(1) NOT NULL DEFAULT 1 COMMENT '0 once the register has been deactivated'
+    AFTER vend_register_id;
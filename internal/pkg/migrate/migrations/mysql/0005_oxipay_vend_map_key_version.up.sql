@@ -0,0 +1,6 @@
+-- encrypt device signing keys at rest
+
+ALTER TABLE oxipay_vend_map
+    MODIFY COLUMN fxl_device_signing_key varchar(512) COMMENT 'i.e Device specific signing key allocated by CreateKey',
+    ADD COLUMN IF NOT EXISTS key_version int NOT NULL DEFAULT 0 COMMENT 'Version of the master key encrypting fxl_device_signing_key, 0 for plaintext'
+    AFTER fxl_device_signing_key;
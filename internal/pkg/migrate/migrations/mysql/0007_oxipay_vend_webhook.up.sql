@@ -0,0 +1,16 @@
+-- queue webhook events for delivery
+
+create table IF NOT EXISTS oxipay_vend_webhook (
+    id varchar(64) NOT NULL COMMENT 'Delivery ID, sent to the subscriber so that it can ignore duplicates',
+    subscriber_url varchar(255) NOT NULL COMMENT 'URL the event is POSTed to',
+    event_type varchar(64) NOT NULL COMMENT 'e.g. payment.approved or refund.approved',
+    payload text NOT NULL COMMENT 'JSON body of the event',
+    attempts int NOT NULL DEFAULT 0 COMMENT 'Number of deliveries attempted',
+    next_attempt datetime NOT NULL COMMENT 'When the next delivery is due',
+    delivery_status varchar(16) NOT NULL COMMENT 'PENDING until delivered, DELIVERED or FAILED once out of attempts',
+    last_error varchar(255) COMMENT 'Why the last delivery failed',
+    created_date datetime DEFAULT CURRENT_TIMESTAMP,
+    modified_date datetime,
+    primary key(id),
+    index idx_webhook_due (delivery_status, next_attempt)
+) engine=InnoDB;
@@ -0,0 +1,22 @@
+-- append-only audit log of registration and payment actions
+
+create table IF NOT EXISTS oxipay_vend_audit (
+    id bigint NOT NULL auto_increment,
+    actor varchar(255) NOT NULL COMMENT 'Vend site or admin user that made the request',
+    action varchar(32) NOT NULL COMMENT 'register, rekey, deactivate, delete, pay or refund',
+    vend_register_id varchar(255) COMMENT 'Register the action was applied to',
+    outcome varchar(64) NOT NULL COMMENT 'Status returned to the browser, or the HTTP status',
+    client_ip varchar(64) COMMENT 'Address of the browser',
+    details text COMMENT 'JSON of the request with device tokens, payment codes and keys redacted',
+    created_date datetime NOT NULL,
+    prev_hash varchar(64) COMMENT 'hash of the previous entry',
+    hash varchar(64) NOT NULL COMMENT 'SHA-256 of the entry and prev_hash, a changed entry breaks the chain',
+    primary key(id),
+    index idx_audit_register (vend_register_id),
+    index idx_audit_action (action, created_date)
+) engine=InnoDB;
+
+CREATE TRIGGER IF NOT EXISTS oxipay_vend_audit_no_update BEFORE UPDATE ON oxipay_vend_audit
+    FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'oxipay_vend_audit is append-only';
+CREATE TRIGGER IF NOT EXISTS oxipay_vend_audit_no_delete BEFORE DELETE ON oxipay_vend_audit
+    FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'oxipay_vend_audit is append-only';
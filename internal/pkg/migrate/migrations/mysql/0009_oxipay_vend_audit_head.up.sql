@@ -0,0 +1,12 @@
+-- the last entry of the audit chain, locked while an entry is appended
+
+create table IF NOT EXISTS oxipay_vend_audit_head (
+    id int NOT NULL COMMENT 'Always 1, there is a single chain',
+    hash varchar(64) COMMENT 'hash of the last entry, NULL until the first entry',
+    primary key(id)
+) engine=InnoDB;
+
+INSERT INTO oxipay_vend_audit_head (id, hash)
+    SELECT 1, (SELECT hash FROM oxipay_vend_audit ORDER BY id DESC LIMIT 1)
+    FROM DUAL
+    WHERE NOT EXISTS (SELECT id FROM oxipay_vend_audit_head WHERE id = 1);
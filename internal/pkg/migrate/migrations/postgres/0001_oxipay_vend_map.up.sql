@@ -0,0 +1,24 @@
+-- Vend registers paired with an Oxipay device
+
+create table IF NOT EXISTS oxipay_vend_map (
+    id serial NOT NULL,
+    fxl_register_id varchar(255) NOT NULL,
+    fxl_seller_id varchar(255) NOT NULL,
+    fxl_device_signing_key varchar(255),
+    origin_domain varchar(255) NOT NULL,
+    vend_register_id varchar(255) NOT NULL,
+    created_date timestamp DEFAULT CURRENT_TIMESTAMP,
+    created_by text NOT NULL,
+    modified_date timestamp,
+    modified_by text,
+    primary key(id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS unique_registration
+ON oxipay_vend_map (vend_register_id, fxl_seller_id, origin_domain);
+
+COMMENT ON COLUMN oxipay_vend_map.fxl_register_id IS 'i.e oxipay/ezi-pay Device ID';
+COMMENT ON COLUMN oxipay_vend_map.fxl_seller_id IS 'i.e Merchant ID in oxipay/ezi-pay';
+COMMENT ON COLUMN oxipay_vend_map.fxl_device_signing_key IS 'i.e Device specific signing key allocated by CreateKey';
+COMMENT ON COLUMN oxipay_vend_map.origin_domain IS 'Vend origin provided in the initial request';
+COMMENT ON COLUMN oxipay_vend_map.vend_register_id IS 'Unique Register ID from Vend';
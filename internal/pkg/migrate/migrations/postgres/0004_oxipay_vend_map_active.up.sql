@@ -0,0 +1,5 @@
+-- allow registers to be deactivated
+
+ALTER TABLE oxipay_vend_map ADD COLUMN IF NOT EXISTS active smallint NOT NULL DEFAULT 1;
+
+COMMENT ON COLUMN oxipay_vend_map.active IS '0 once the register has been deactivated';
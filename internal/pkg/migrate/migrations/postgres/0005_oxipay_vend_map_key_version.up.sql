@@ -0,0 +1,6 @@
+-- encrypt device signing keys at rest
+
+ALTER TABLE oxipay_vend_map ALTER COLUMN fxl_device_signing_key TYPE varchar(512);
+ALTER TABLE oxipay_vend_map ADD COLUMN IF NOT EXISTS key_version int NOT NULL DEFAULT 0;
+
+COMMENT ON COLUMN oxipay_vend_map.key_version IS 'Version of the master key encrypting fxl_device_signing_key, 0 for plaintext';
@@ -0,0 +1,5 @@
+-- route registers to their gateway region
+
+ALTER TABLE oxipay_vend_map ADD COLUMN IF NOT EXISTS region varchar(16);
+
+COMMENT ON COLUMN oxipay_vend_map.region IS 'Gateway region the merchant was registered in, NULL for the default region';
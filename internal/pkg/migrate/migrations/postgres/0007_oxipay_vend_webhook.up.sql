@@ -0,0 +1,20 @@
+-- queue webhook events for delivery
+
+create table IF NOT EXISTS oxipay_vend_webhook (
+    id varchar(64) NOT NULL,
+    subscriber_url varchar(255) NOT NULL,
+    event_type varchar(64) NOT NULL,
+    payload text NOT NULL,
+    attempts int NOT NULL DEFAULT 0,
+    next_attempt timestamp NOT NULL,
+    delivery_status varchar(16) NOT NULL,
+    last_error varchar(255),
+    created_date timestamp DEFAULT CURRENT_TIMESTAMP,
+    modified_date timestamp,
+    primary key(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_due ON oxipay_vend_webhook (delivery_status, next_attempt);
+
+COMMENT ON COLUMN oxipay_vend_webhook.id IS 'Delivery ID, sent to the subscriber so that it can ignore duplicates';
+COMMENT ON COLUMN oxipay_vend_webhook.delivery_status IS 'PENDING until delivered, DELIVERED or FAILED once out of attempts';
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS oxipay_vend_audit;
@@ -0,0 +1,25 @@
+-- append-only audit log of registration and payment actions
+
+create table IF NOT EXISTS oxipay_vend_audit (
+    id bigserial NOT NULL,
+    actor varchar(255) NOT NULL,
+    action varchar(32) NOT NULL,
+    vend_register_id varchar(255),
+    outcome varchar(64) NOT NULL,
+    client_ip varchar(64),
+    details text,
+    created_date timestamp NOT NULL,
+    prev_hash varchar(64),
+    hash varchar(64) NOT NULL,
+    primary key(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_register ON oxipay_vend_audit (vend_register_id);
+CREATE INDEX IF NOT EXISTS idx_audit_action ON oxipay_vend_audit (action, created_date);
+
+-- entries can't be changed or removed
+CREATE OR REPLACE RULE oxipay_vend_audit_no_update AS ON UPDATE TO oxipay_vend_audit DO INSTEAD NOTHING;
+CREATE OR REPLACE RULE oxipay_vend_audit_no_delete AS ON DELETE TO oxipay_vend_audit DO INSTEAD NOTHING;
+
+COMMENT ON COLUMN oxipay_vend_audit.details IS 'JSON of the request with device tokens, payment codes and keys redacted';
+COMMENT ON COLUMN oxipay_vend_audit.hash IS 'SHA-256 of the entry and prev_hash, a changed entry breaks the chain';
@@ -0,0 +1,17 @@
+-- Vend registers paired with an Oxipay device
+
+create table IF NOT EXISTS oxipay_vend_map (
+    id integer NOT NULL primary key autoincrement,
+    fxl_register_id varchar(255) NOT NULL,
+    fxl_seller_id varchar(255) NOT NULL,
+    fxl_device_signing_key varchar(255),
+    origin_domain varchar(255) NOT NULL,
+    vend_register_id varchar(255) NOT NULL,
+    created_date datetime DEFAULT CURRENT_TIMESTAMP,
+    created_by text NOT NULL,
+    modified_date datetime,
+    modified_by text
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS unique_registration
+ON oxipay_vend_map (vend_register_id, fxl_seller_id, origin_domain);
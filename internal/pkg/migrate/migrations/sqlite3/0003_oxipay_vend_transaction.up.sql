@@ -0,0 +1,22 @@
+-- every request sent to Oxipay
+
+create table IF NOT EXISTS oxipay_vend_transaction (
+    id varchar(64) NOT NULL primary key,
+    txn_type varchar(32) NOT NULL,
+    vend_sale_id varchar(255),
+    origin_domain varchar(255) NOT NULL,
+    vend_register_id varchar(255) NOT NULL,
+    fxl_register_id varchar(255) NOT NULL,
+    fxl_seller_id varchar(255) NOT NULL,
+    amount bigint NOT NULL,
+    pos_transaction_ref varchar(255) NOT NULL,
+    purchase_number varchar(255),
+    oxipay_code varchar(16),
+    txn_status varchar(32) NOT NULL,
+    message text,
+    created_date datetime DEFAULT CURRENT_TIMESTAMP,
+    modified_date datetime
+);
+
+CREATE INDEX IF NOT EXISTS idx_vend_sale ON oxipay_vend_transaction (origin_domain, vend_register_id, vend_sale_id);
+CREATE INDEX IF NOT EXISTS idx_purchase_number ON oxipay_vend_transaction (purchase_number);
@@ -0,0 +1 @@
+ALTER TABLE oxipay_vend_map DROP COLUMN active;
@@ -0,0 +1,3 @@
+-- allow registers to be deactivated
+
+ALTER TABLE oxipay_vend_map ADD COLUMN active smallint NOT NULL DEFAULT 1;
@@ -0,0 +1,3 @@
+-- encrypted signing keys can no longer be read once key_version is dropped
+
+ALTER TABLE oxipay_vend_map DROP COLUMN key_version;
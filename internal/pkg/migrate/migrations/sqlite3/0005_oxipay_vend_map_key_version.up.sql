@@ -0,0 +1,4 @@
+-- encrypt device signing keys at rest, SQLite doesn't enforce the length of
+-- fxl_device_signing_key
+
+ALTER TABLE oxipay_vend_map ADD COLUMN key_version int NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+-- registers fall back to the region of the Host they are used from
+
+ALTER TABLE oxipay_vend_map DROP COLUMN region;
@@ -0,0 +1,3 @@
+-- route registers to their gateway region
+
+ALTER TABLE oxipay_vend_map ADD COLUMN region varchar(16);
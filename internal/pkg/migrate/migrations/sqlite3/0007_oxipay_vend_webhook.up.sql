@@ -0,0 +1,16 @@
+-- queue webhook events for delivery
+
+create table IF NOT EXISTS oxipay_vend_webhook (
+    id varchar(64) NOT NULL primary key,
+    subscriber_url varchar(255) NOT NULL,
+    event_type varchar(64) NOT NULL,
+    payload text NOT NULL,
+    attempts int NOT NULL DEFAULT 0,
+    next_attempt datetime NOT NULL,
+    delivery_status varchar(16) NOT NULL,
+    last_error varchar(255),
+    created_date datetime DEFAULT CURRENT_TIMESTAMP,
+    modified_date datetime
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_due ON oxipay_vend_webhook (delivery_status, next_attempt);
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS oxipay_vend_audit_no_update;
+DROP TRIGGER IF EXISTS oxipay_vend_audit_no_delete;
+DROP TABLE IF EXISTS oxipay_vend_audit;
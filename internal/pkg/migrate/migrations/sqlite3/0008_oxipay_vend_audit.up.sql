@@ -0,0 +1,27 @@
+-- append-only audit log of registration and payment actions
+
+create table IF NOT EXISTS oxipay_vend_audit (
+    id integer NOT NULL primary key autoincrement,
+    actor varchar(255) NOT NULL,
+    action varchar(32) NOT NULL,
+    vend_register_id varchar(255),
+    outcome varchar(64) NOT NULL,
+    client_ip varchar(64),
+    details text,
+    created_date datetime NOT NULL,
+    prev_hash varchar(64),
+    hash varchar(64) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_register ON oxipay_vend_audit (vend_register_id);
+CREATE INDEX IF NOT EXISTS idx_audit_action ON oxipay_vend_audit (action, created_date);
+
+-- entries can't be changed or removed
+CREATE TRIGGER IF NOT EXISTS oxipay_vend_audit_no_update BEFORE UPDATE ON oxipay_vend_audit
+BEGIN
+    SELECT RAISE(ABORT, 'oxipay_vend_audit is append-only');
+END;
+CREATE TRIGGER IF NOT EXISTS oxipay_vend_audit_no_delete BEFORE DELETE ON oxipay_vend_audit
+BEGIN
+    SELECT RAISE(ABORT, 'oxipay_vend_audit is append-only');
+END;
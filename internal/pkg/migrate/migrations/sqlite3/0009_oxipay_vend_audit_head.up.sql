@@ -0,0 +1,10 @@
+-- the last entry of the audit chain, locked while an entry is appended
+
+create table IF NOT EXISTS oxipay_vend_audit_head (
+    id integer NOT NULL primary key,
+    hash varchar(64)
+);
+
+INSERT INTO oxipay_vend_audit_head (id, hash)
+    SELECT 1, (SELECT hash FROM oxipay_vend_audit ORDER BY id DESC LIMIT 1)
+    WHERE NOT EXISTS (SELECT id FROM oxipay_vend_audit_head WHERE id = 1);
@@ -0,0 +1,22 @@
+package oxipay
+
+import "context"
+
+// RequestIDHeader carries the request ID to the gateway so that a request can
+// be traced through the proxy and Oxipay
+const RequestIDHeader = "X-Request-Id"
+
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+// WithRequestID returns a copy of ctx that sends id with every request made using it
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request ID carried by ctx, if any
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
@@ -0,0 +1,81 @@
+package oxipay
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRequestIDIsSent(t *testing.T) {
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(RequestIDHeader)
+		w.Write([]byte(`{"x_code":"SPRA01","x_message":"Success"}`))
+	}))
+	defer server.Close()
+
+	client := NewOxipay(server.URL, "1.1", logrus.New())
+	ctx := WithRequestID(context.Background(), "req-1")
+
+	if _, err := client.ProcessAuthorisationWithContext(ctx, &AuthorisationPayload{}); err != nil {
+		t.Fatal(err)
+	}
+	if received != "req-1" {
+		t.Errorf("expected request ID req-1 got %q", received)
+	}
+}
+
+func TestTimedOutRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server only notices the client going away once the body is read
+		ioutil.ReadAll(r.Body)
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	client := NewOxipay(server.URL, "1.1", logrus.New())
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.ProcessSalesAdjustmentWithContext(ctx, &SalesAdjustmentPayload{})
+	if err == nil || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("expected the request to be abandoned when the context is done, got %v after %s", err, time.Since(start))
+	}
+	// the request was sent, so Oxipay may have processed it
+	if !MayHaveBeenProcessed(err) {
+		t.Errorf("expected a timed out request to be treated as possibly processed: %v", err)
+	}
+}
+
+func TestCancelledRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	client := NewOxipay(server.URL, "1.1", logrus.New())
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	_, err := client.ProcessAuthorisationWithContext(ctx, &AuthorisationPayload{})
+	if err == nil {
+		t.Fatal("expected the request to be abandoned when the context is cancelled")
+	}
+	// the request was sent before the cashier abandoned it
+	if !MayHaveBeenProcessed(err) {
+		t.Errorf("expected a cancelled request to be treated as possibly processed: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package oxipay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// DefaultConnectTimeout is how long to wait for a connection to the gateway
+	DefaultConnectTimeout = 5 * time.Second
+	// DefaultTimeout is how long to wait for the whole request, including
+	// reading the response. Authorisations can take a while as Oxipay may
+	// contact the bank.
+	DefaultTimeout = 60 * time.Second
+	// DefaultMaxIdleConns is the number of keep-alive connections kept open to the gateway
+	DefaultMaxIdleConns = 10
+)
+
+// RetryPolicy controls how often a request is retried. Only failures where
+// the request can't have reached Oxipay, such as a refused connection, are
+// retried, as retrying anything else could process a payment twice.
+type RetryPolicy struct {
+	// Attempts is the total number of attempts, 0 or 1 disables retries
+	Attempts int
+	// Backoff is the wait before the first retry, it doubles for each retry
+	Backoff time.Duration
+}
+
+// Option configures the Oxipay client
+type Option func(*oxipay)
+
+// WithTimeout limits how long a request, including reading the response, can take
+func WithTimeout(timeout time.Duration) Option {
+	return func(oc *oxipay) {
+		oc.client.Timeout = timeout
+	}
+}
+
+// WithConnectTimeout limits how long to wait for a connection to the gateway
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(oc *oxipay) {
+		dialer := &net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+		}
+		oc.transport.DialContext = dialer.DialContext
+		oc.transport.TLSHandshakeTimeout = timeout
+	}
+}
+
+// WithMaxIdleConns sets the number of keep-alive connections kept open to the gateway
+func WithMaxIdleConns(n int) Option {
+	return func(oc *oxipay) {
+		oc.transport.MaxIdleConns = n
+		oc.transport.MaxIdleConnsPerHost = n
+	}
+}
+
+// WithRootCAs replaces the system certificate pool used to verify the gateway
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(oc *oxipay) {
+		oc.transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+}
+
+// WithProxy sends every request through the proxy rather than the proxy from
+// the environment
+func WithProxy(proxy *url.URL) Option {
+	return func(oc *oxipay) {
+		oc.transport.Proxy = http.ProxyURL(proxy)
+	}
+}
+
+// WithRetry sets the retry policy
+func WithRetry(policy RetryPolicy) Option {
+	return func(oc *oxipay) {
+		oc.retry = policy
+	}
+}
+
+// Observer is called after each attempt to send a request to the gateway with
+// the endpoint, how long it took and the error when there was no response
+type Observer func(endpoint string, elapsed time.Duration, err error)
+
+// WithObserver calls observe after each attempt, e.g. to record metrics
+func WithObserver(observe Observer) Option {
+	return func(oc *oxipay) {
+		oc.observe = observe
+	}
+}
+
+// newTransport returns the transport shared by every request from a client
+func newTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   DefaultConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          DefaultMaxIdleConns,
+		MaxIdleConnsPerHost:   DefaultMaxIdleConns,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   DefaultConnectTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// safeToRetry reports whether the request failed before it could have been
+// sent to the gateway. Dial errors, such as a refused connection or a failed
+// DNS lookup, mean we never connected.
+func safeToRetry(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// readError reports a failure reading the response like any other transport
+// error, the request reached the gateway so it may have been processed
+func readError(endpoint string, err error) error {
+	return &url.Error{Op: "Post", URL: endpoint, Err: err}
+}
+
+// MayHaveBeenProcessed reports whether a request that failed with err could
+// still have been processed by Oxipay and should be replayed to find out, for
+// example the response timed out or the connection dropped after the request
+// was sent. That includes a request the cashier cancelled while it was with
+// Oxipay.
+func MayHaveBeenProcessed(err error) bool {
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) && !safeToRetry(err)
+}
@@ -0,0 +1,151 @@
+package oxipay
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRetryConnectionRefused(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"x_code":"SPRA01","x_message":"Success"}`))
+	}))
+	defer server.Close()
+
+	oc := NewOxipay(server.URL, "1.1", logrus.New(), WithRetry(RetryPolicy{Attempts: 3, Backoff: time.Millisecond})).(*oxipay)
+
+	// refuse the first two connections
+	var dials int32
+	dial := oc.transport.DialContext
+	oc.transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) <= 2 {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+		}
+		return dial(ctx, network, addr)
+	}
+
+	response, err := oc.ProcessAuthorisation(&AuthorisationPayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts := atomic.LoadInt32(&dials); response.Code != "SPRA01" || attempts != 3 {
+		t.Errorf("expected SPRA01 after 3 attempts got %s after %d", response.Code, attempts)
+	}
+}
+
+func TestTimeoutIsNotRetried(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client := NewOxipay(server.URL, "1.1", logrus.New(),
+		WithTimeout(20*time.Millisecond),
+		WithRetry(RetryPolicy{Attempts: 3, Backoff: time.Millisecond}),
+	)
+
+	if _, err := client.ProcessAuthorisation(&AuthorisationPayload{}); err == nil {
+		t.Error("expected the request to time out")
+	}
+	// the gateway may have processed the payment, so it must not be sent again
+	if sent := atomic.LoadInt32(&requests); sent != 1 {
+		t.Errorf("expected a single request got %d", sent)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	proxyURL, _ := url.Parse("http://proxy.internal:3128")
+	oc := NewOxipay("https://sandboxpos.oxipay.com.au/webapi/v1/", "1.1", logrus.New(),
+		WithConnectTimeout(2*time.Second),
+		WithTimeout(30*time.Second),
+		WithMaxIdleConns(4),
+		WithProxy(proxyURL),
+		WithRetry(RetryPolicy{Attempts: 3, Backoff: 100 * time.Millisecond}),
+	).(*oxipay)
+	if oc.client.Timeout != 30*time.Second || oc.transport.TLSHandshakeTimeout != 2*time.Second {
+		t.Errorf("unexpected timeouts %s %s", oc.client.Timeout, oc.transport.TLSHandshakeTimeout)
+	}
+	if oc.transport.MaxIdleConnsPerHost != 4 {
+		t.Errorf("expected 4 idle connections got %d", oc.transport.MaxIdleConnsPerHost)
+	}
+	if oc.retry.Attempts != 3 || oc.retry.Backoff != 100*time.Millisecond {
+		t.Errorf("unexpected retry policy %+v", oc.retry)
+	}
+
+	proxy, _ := oc.transport.Proxy(httptest.NewRequest(http.MethodPost, "https://sandboxpos.oxipay.com.au/", nil))
+	if proxy == nil || proxy.Host != "proxy.internal:3128" {
+		t.Errorf("expected the configured proxy got %v", proxy)
+	}
+}
+
+func TestObserver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"x_code":"SPRA01","x_message":"Success"}`))
+	}))
+	defer server.Close()
+
+	var endpoints []string
+	client := NewOxipay(server.URL, "1.1", logrus.New(), WithObserver(func(endpoint string, elapsed time.Duration, err error) {
+		if err != nil {
+			t.Errorf("unexpected error %s", err)
+		}
+		endpoints = append(endpoints, endpoint)
+	}))
+
+	if _, err := client.ProcessAuthorisation(&AuthorisationPayload{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 1 || endpoints[0] != "ProcessAuthorisation" {
+		t.Errorf("expected a ProcessAuthorisation request to be observed got %v", endpoints)
+	}
+}
+
+func TestCloseIdleConnections(t *testing.T) {
+	closed := make(chan struct{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"x_code":"SPRA01"}`))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			close(closed)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	client := NewOxipay(server.URL, "1.1", logrus.New())
+	if _, err := client.ProcessAuthorisation(&AuthorisationPayload{}); err != nil {
+		t.Fatal(err)
+	}
+
+	client.CloseIdleConnections()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("expected the kept-alive connection to be closed")
+	}
+}
+
+func TestTruncatedResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// promise more than is sent so reading the body fails
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte(`{"x_code":"SPRA01"`))
+	}))
+	defer server.Close()
+
+	_, err := NewOxipay(server.URL, "1.1", logrus.New()).ProcessAuthorisation(&AuthorisationPayload{})
+	if err == nil || !MayHaveBeenProcessed(err) {
+		t.Errorf("expected a transport error that may have been processed got %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package oxipay
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
@@ -13,15 +14,13 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
 	log "github.com/sirupsen/logrus"
 )
 
-//HTTPClientTimout default http client timeout
-const HTTPClientTimout = 0
-
 const defaultResponseCode = "EISE01"
 
 // Client exposes an interface to Oxipay
@@ -29,22 +28,44 @@ type Client interface {
 	RegisterPosDevice(*RegistrationPayload) (*Response, error)
 	ProcessAuthorisation(oxipayPayload *AuthorisationPayload) (*Response, error)
 	ProcessSalesAdjustment(adjustment *SalesAdjustmentPayload) (*Response, error)
+	// the WithContext variants abandon the request when the context is done
+	RegisterPosDeviceWithContext(ctx context.Context, payload *RegistrationPayload) (*Response, error)
+	ProcessAuthorisationWithContext(ctx context.Context, oxipayPayload *AuthorisationPayload) (*Response, error)
+	ProcessSalesAdjustmentWithContext(ctx context.Context, adjustment *SalesAdjustmentPayload) (*Response, error)
 	GetVersion() string
+	// CloseIdleConnections closes the kept-alive connections to the gateway,
+	// requests in flight are left to finish
+	CloseIdleConnections()
 }
 
 type oxipay struct {
 	GatewayURL string
 	Version    string
 	Log        *log.Logger
+	client     *http.Client
+	transport  *http.Transport
+	retry      RetryPolicy
+	observe    Observer
 }
 
 //NewOxipay returns a base struct on which all other functions operate
-func NewOxipay(gatewayURL string, version string, log *log.Logger) Client {
-	return &oxipay{
+func NewOxipay(gatewayURL string, version string, log *log.Logger, options ...Option) Client {
+	transport := newTransport()
+	oc := &oxipay{
 		GatewayURL: gatewayURL,
 		Version:    version,
 		Log:        log,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   DefaultTimeout,
+		},
+		transport: transport,
+	}
+
+	for _, option := range options {
+		option(oc)
 	}
+	return oc
 }
 
 // RegistrationPayload required to register a device with Oxipay
@@ -132,41 +153,57 @@ func (oc *oxipay) GetVersion() string {
 	return oc.Version
 }
 
+// CloseIdleConnections closes the connections kept alive by the transport
+func (oc *oxipay) CloseIdleConnections() {
+	oc.transport.CloseIdleConnections()
+}
+
 // RegisterPosDevice is used to register a new vend terminal
 func (oc *oxipay) RegisterPosDevice(payload *RegistrationPayload) (*Response, error) {
+	return oc.RegisterPosDeviceWithContext(context.Background(), payload)
+}
+
+// RegisterPosDeviceWithContext is RegisterPosDevice, abandoning the request when ctx is done
+func (oc *oxipay) RegisterPosDeviceWithContext(ctx context.Context, payload *RegistrationPayload) (*Response, error) {
 	contextLogger := oc.Log.WithFields(log.Fields{
-		"module":    "oxipay",
-		"call":      "RegisterPosDevice",
-		"device_id": payload.DeviceID,
+		"module":     "oxipay",
+		"call":       "RegisterPosDevice",
+		"device_id":  payload.DeviceID,
+		"request_id": RequestID(ctx),
 	})
 
 	jsonValue, _ := json.Marshal(payload)
-	return post(oc.GatewayURL+"/CreateKey", jsonValue, contextLogger)
+	return oc.post(ctx, oc.GatewayURL+"/CreateKey", jsonValue, contextLogger)
 }
 
 // ProcessAuthorisation calls the ProcessAuthorisation Method
 func (oc *oxipay) ProcessAuthorisation(payload *AuthorisationPayload) (*Response, error) {
+	return oc.ProcessAuthorisationWithContext(context.Background(), payload)
+}
+
+// ProcessAuthorisationWithContext is ProcessAuthorisation, abandoning the
+// request when ctx is done. Oxipay may still process an abandoned request.
+func (oc *oxipay) ProcessAuthorisationWithContext(ctx context.Context, payload *AuthorisationPayload) (*Response, error) {
 	contextLogger := oc.Log.WithFields(log.Fields{
 		"module":      "oxipay",
 		"call":        "ProcessAuthorisation",
 		"device_id":   payload.DeviceID,
 		"merchant_id": payload.MerchantID,
+		"request_id":  RequestID(ctx),
 	})
 
 	jsonValue, _ := json.Marshal(payload)
-	return post(oc.GatewayURL+"/ProcessAuthorisation", jsonValue, contextLogger)
+	return oc.post(ctx, oc.GatewayURL+"/ProcessAuthorisation", jsonValue, contextLogger)
 }
 
-func post(url string, jsonValue []byte, contextLogger *logrus.Entry) (*Response, error) {
+func (oc *oxipay) post(ctx context.Context, url string, jsonValue []byte, contextLogger *logrus.Entry) (*Response, error) {
 
 	var err error
 	oxipayResponse := new(Response)
 
 	contextLogger.Debugf("POST to : %s , %s \n", url, string(jsonValue))
 
-	client := http.Client{}
-	client.Timeout = HTTPClientTimout
-	response, responseErr := client.Post(url, "application/json", bytes.NewBuffer(jsonValue))
+	response, responseErr := oc.send(ctx, url, jsonValue, contextLogger)
 
 	if responseErr != nil {
 		return oxipayResponse, responseErr
@@ -179,7 +216,10 @@ func post(url string, jsonValue []byte, contextLogger *logrus.Entry) (*Response,
 		response.Header,
 	)
 
-	body, _ := ioutil.ReadAll(response.Body)
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return oxipayResponse, readError(url, err)
+	}
 	contextLogger.Debugf("Response Body: \n %s", string(body))
 
 	err = json.Unmarshal(body, oxipayResponse)
@@ -189,18 +229,59 @@ func post(url string, jsonValue []byte, contextLogger *logrus.Entry) (*Response,
 	return oxipayResponse, err
 }
 
+// send posts to the gateway, retrying according to the retry policy when the
+// request can't have reached the gateway
+func (oc *oxipay) send(ctx context.Context, url string, jsonValue []byte, contextLogger *logrus.Entry) (*http.Response, error) {
+	endpoint := url[strings.LastIndex(url, "/")+1:]
+	backoff := oc.retry.Backoff
+	for attempt := 1; ; attempt++ {
+		request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(jsonValue))
+		if err != nil {
+			return nil, err
+		}
+		request = request.WithContext(ctx)
+		request.Header.Set("Content-Type", "application/json")
+		if id := RequestID(ctx); id != "" {
+			request.Header.Set(RequestIDHeader, id)
+		}
+
+		start := time.Now()
+		response, err := oc.client.Do(request)
+		if oc.observe != nil {
+			oc.observe(endpoint, time.Since(start), err)
+		}
+		if err == nil || attempt >= oc.retry.Attempts || !safeToRetry(err) {
+			return response, err
+		}
+
+		contextLogger.Warnf("Attempt %d failed, retrying in %s: %s", attempt, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
 // ProcessSalesAdjustment provides a mechansim to perform a sales ajustment on an Oxipay schedule
 func (oc *oxipay) ProcessSalesAdjustment(adjustment *SalesAdjustmentPayload) (*Response, error) {
+	return oc.ProcessSalesAdjustmentWithContext(context.Background(), adjustment)
+}
+
+// ProcessSalesAdjustmentWithContext is ProcessSalesAdjustment, abandoning the request when ctx is done
+func (oc *oxipay) ProcessSalesAdjustmentWithContext(ctx context.Context, adjustment *SalesAdjustmentPayload) (*Response, error) {
 
 	contextLogger := oc.Log.WithFields(log.Fields{
 		"module":      "oxipay",
 		"call":        "ProcessSalesAdjustment",
 		"device_id":   adjustment.DeviceID,
 		"merchant_id": adjustment.MerchantID,
+		"request_id":  RequestID(ctx),
 	})
 
 	jsonValue, _ := json.Marshal(adjustment)
-	return post(oc.GatewayURL+"/ProcessSalesAdjustment", jsonValue, contextLogger)
+	return oc.post(ctx, oc.GatewayURL+"/ProcessSalesAdjustment", jsonValue, contextLogger)
 
 }
 
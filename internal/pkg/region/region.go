@@ -0,0 +1,142 @@
+package region
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
+	"github.com/sirupsen/logrus"
+)
+
+// supportEmail is the address used in the Oxipay response messages, it is
+// replaced with the support address of the region
+const supportEmail = "pit@oxipay.com.au"
+
+// Region is a gateway profile and the client used to talk to its gateway
+type Region struct {
+	Name          string
+	Currency      string
+	SupportEmail  string
+	MinimumAmount int64 // in cents, 0 for no minimum
+	Client        oxipay.Client
+}
+
+// Message replaces the Oxipay support address in a customer message with the
+// support address of the region
+func (r *Region) Message(message string) string {
+	if r.SupportEmail == "" {
+		return message
+	}
+	return strings.Replace(message, supportEmail, r.SupportEmail, -1)
+}
+
+// BelowMinimum reports whether amount, in cents, is less than the minimum for the region
+func (r *Region) BelowMinimum(amount int64) bool {
+	return amount < r.MinimumAmount
+}
+
+// Router picks the region that handles a request
+type Router struct {
+	Default *Region
+	regions map[string]*Region
+	hosts   map[string]*Region
+}
+
+// NewRouter creates a client for each region in the configuration, the
+// options are applied to every client
+func NewRouter(hostConfig config.HostConfig, log *logrus.Logger, options ...oxipay.Option) (*Router, error) {
+	profiles := hostConfig.GatewayRegions()
+	rt := &Router{
+		regions: make(map[string]*Region, len(profiles)),
+		hosts:   make(map[string]*Region),
+	}
+
+	for name, profile := range profiles {
+		if profile.GatewayURL == "" {
+			return nil, fmt.Errorf("regions.%s.gatewayurl is required", name)
+		}
+
+		region := &Region{
+			Name:          name,
+			Currency:      profile.Currency,
+			SupportEmail:  profile.SupportEmail,
+			MinimumAmount: profile.MinimumAmount,
+			Client:        oxipay.NewOxipay(profile.GatewayURL, hostConfig.Oxipay.Version, log, options...),
+		}
+		rt.regions[name] = region
+
+		for _, host := range profile.Hosts {
+			host = strings.ToLower(host)
+			if other, ok := rt.hosts[host]; ok {
+				return nil, fmt.Errorf("Host %s is used by both the %s and %s regions", host, other.Name, name)
+			}
+			rt.hosts[host] = region
+		}
+	}
+
+	defaultRegion := hostConfig.DefaultRegion
+	if defaultRegion == "" && len(profiles) == 1 {
+		for name := range profiles {
+			defaultRegion = name
+		}
+	}
+	if defaultRegion == "" {
+		return nil, fmt.Errorf("defaultregion is required when there is more than one region")
+	}
+
+	var ok bool
+	if rt.Default, ok = rt.regions[defaultRegion]; !ok {
+		return nil, fmt.Errorf("defaultregion %s is not one of the configured regions", defaultRegion)
+	}
+	return rt, nil
+}
+
+// CloseIdleConnections closes the kept-alive connections of every region's
+// client, once the router has been replaced
+func (rt *Router) CloseIdleConnections() {
+	for _, region := range rt.regions {
+		region.Client.CloseIdleConnections()
+	}
+}
+
+// Get returns a region by name
+func (rt *Router) Get(name string) (*Region, bool) {
+	region, ok := rt.regions[name]
+	return region, ok
+}
+
+// ForHost returns the region serving the Host header, ignoring the port.
+// Hosts that don't belong to a region are handled by the default region.
+func (rt *Router) ForHost(host string) *Region {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if region, ok := rt.hosts[strings.ToLower(host)]; ok {
+		return region
+	}
+	return rt.Default
+}
+
+// ForRegister returns the region a register was registered in. Registers
+// saved before regions were configured are routed by the Host header.
+func (rt *Router) ForRegister(name string, host string) *Region {
+	if region, ok := rt.regions[name]; ok {
+		return region
+	}
+	return rt.ForHost(host)
+}
+
+// Regions returns every region ordered by name
+func (rt *Router) Regions() []*Region {
+	regions := make([]*Region, 0, len(rt.regions))
+	for _, region := range rt.regions {
+		regions = append(regions, region)
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		return regions[i].Name < regions[j].Name
+	})
+	return regions
+}
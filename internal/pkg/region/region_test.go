@@ -0,0 +1,101 @@
+package region
+
+import (
+	"testing"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+func newConfig() config.HostConfig {
+	return config.HostConfig{
+		Regions: map[string]config.RegionConfig{
+			"au": {
+				GatewayURL:    "https://sandboxpos.oxipay.com.au/webapi/v1/",
+				Currency:      "AUD",
+				SupportEmail:  "pit@oxipay.com.au",
+				MinimumAmount: 2000,
+				Hosts:         []string{"vend.oxipay.com.au"},
+			},
+			"nz": {
+				GatewayURL:   "https://sandboxpos.oxipay.co.nz/webapi/v1/",
+				Currency:     "NZD",
+				SupportEmail: "pit@oxipay.co.nz",
+				Hosts:        []string{"vend.oxipay.co.nz"},
+			},
+		},
+		DefaultRegion: "au",
+	}
+}
+
+func TestRouting(t *testing.T) {
+	router, err := NewRouter(newConfig(), logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hosts := map[string]string{
+		"vend.oxipay.co.nz":      "nz",
+		"VEND.OXIPAY.CO.NZ:443":  "nz",
+		"vend.oxipay.com.au":     "au",
+		"localhost:5000":         "au",
+		"unknown.example.com.au": "au",
+	}
+	for host, expected := range hosts {
+		if region := router.ForHost(host); region.Name != expected {
+			t.Errorf("expected %s to be routed to %s got %s", host, expected, region.Name)
+		}
+	}
+
+	// the stored region wins over the Host
+	if region := router.ForRegister("nz", "vend.oxipay.com.au"); region.Name != "nz" {
+		t.Errorf("expected the register's region got %s", region.Name)
+	}
+	if region := router.ForRegister("", "vend.oxipay.co.nz"); region.Name != "nz" {
+		t.Errorf("expected a register without a region to use the Host got %s", region.Name)
+	}
+
+	nz, _ := router.Get("nz")
+	if message := nz.Message("Please contact pit@oxipay.com.au for further support"); message != "Please contact pit@oxipay.co.nz for further support" {
+		t.Errorf("expected the NZ support address got %s", message)
+	}
+
+	au, _ := router.Get("au")
+	if !au.BelowMinimum(1999) || au.BelowMinimum(2000) || nz.BelowMinimum(1) {
+		t.Error("unexpected minimum amount check")
+	}
+}
+
+func TestDefaultRegion(t *testing.T) {
+	hostConfig := config.HostConfig{Oxipay: config.OxipayConfig{GatewayURL: "https://sandboxpos.oxipay.com.au/webapi/v1/"}}
+	router, err := NewRouter(hostConfig, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if router.Default.Name != config.DefaultRegionName || router.ForHost("anything") != router.Default {
+		t.Errorf("expected oxipay.gatewayurl to be used for every request")
+	}
+}
+
+func TestInvalidRegions(t *testing.T) {
+	noDefault := newConfig()
+	noDefault.DefaultRegion = ""
+
+	unknownDefault := newConfig()
+	unknownDefault.DefaultRegion = "uk"
+
+	sharedHost := newConfig()
+	nz := sharedHost.Regions["nz"]
+	nz.Hosts = []string{"vend.oxipay.com.au"}
+	sharedHost.Regions["nz"] = nz
+
+	for name, hostConfig := range map[string]config.HostConfig{
+		"no default":      noDefault,
+		"unknown default": unknownDefault,
+		"shared host":     sharedHost,
+	} {
+		if _, err := NewRouter(hostConfig, logrus.New()); err == nil {
+			t.Errorf("expected an error for %s", name)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// EndpointCreateKey registers a device and returns its signing key
+	EndpointCreateKey = "/CreateKey"
+	// EndpointProcessAuthorisation processes a payment
+	EndpointProcessAuthorisation = "/ProcessAuthorisation"
+	// EndpointProcessSalesAdjustment processes a refund
+	EndpointProcessSalesAdjustment = "/ProcessSalesAdjustment"
+)
+
+// successCodes are returned when a behaviour does not specify a code
+var successCodes = map[string]string{
+	EndpointCreateKey:              "SCRK01",
+	EndpointProcessAuthorisation:   "SPRA01",
+	EndpointProcessSalesAdjustment: "SPSA01",
+}
+
+// Behaviour describes how the simulator answers a single request
+type Behaviour struct {
+	Code         string        // x_code to return, defaults to the success code for the endpoint
+	Delay        time.Duration // wait before answering, used to simulate a gateway timeout
+	Malformed    bool          // answer with a body that is not JSON
+	BadSignature bool          // sign the response with the wrong key
+	HTTPStatus   int           // defaults to 200
+	Drop         bool          // process the request then close the connection without answering
+}
+
+// Simulator is a fake Oxipay POS gateway. It verifies the signature of each
+// request, signs each response and can be scripted to answer with any response
+// code so that the proxy can be exercised without the Oxipay sandbox.
+type Simulator struct {
+	mu             sync.Mutex
+	keys           map[string]string
+	defaults       map[string]Behaviour
+	scripts        map[string][]Behaviour
+	processed      map[string]string
+	purchaseNumber int
+	Log            *logrus.Logger
+}
+
+// New returns a Simulator that approves every request
+func New(log *logrus.Logger) *Simulator {
+	if log == nil {
+		log = logrus.New()
+	}
+
+	return &Simulator{
+		keys:           make(map[string]string),
+		defaults:       make(map[string]Behaviour),
+		scripts:        make(map[string][]Behaviour),
+		processed:      make(map[string]string),
+		purchaseNumber: 52000000,
+		Log:            log,
+	}
+}
+
+// NewServer starts an httptest server backed by the simulator. The caller
+// should Close the server when finished with it.
+func NewServer(s *Simulator) *httptest.Server {
+	return httptest.NewServer(s)
+}
+
+// AddDevice registers a device and its signing key without a call to CreateKey
+func (s *Simulator) AddDevice(deviceID string, signingKey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[deviceID] = signingKey
+}
+
+// SetDefault changes how the endpoint answers once its script is exhausted
+func (s *Simulator) SetDefault(endpoint string, behaviour Behaviour) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.defaults[endpoint] = behaviour
+}
+
+// Script queues behaviours for the endpoint, each one is used for a single request
+func (s *Simulator) Script(endpoint string, behaviours ...Behaviour) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[endpoint] = append(s.scripts[endpoint], behaviours...)
+}
+
+func (s *Simulator) next(endpoint string) Behaviour {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if queue := s.scripts[endpoint]; len(queue) > 0 {
+		s.scripts[endpoint] = queue[1:]
+		return queue[0]
+	}
+	return s.defaults[endpoint]
+}
+
+// markProcessed records an approved authorisation and its purchase number so
+// that a replay is rejected
+func (s *Simulator) markProcessed(ref string, purchaseNumber string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.processed[ref] = purchaseNumber
+}
+
+// alreadyProcessed returns the purchase number the authorisation was approved as
+func (s *Simulator) alreadyProcessed(ref string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	purchaseNumber, ok := s.processed[ref]
+	return purchaseNumber, ok
+}
+
+func (s *Simulator) signingKey(deviceID string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[deviceID]
+	return key, ok
+}
+
+// ServeHTTP implements http.Handler
+func (s *Simulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	endpoint := r.URL.Path[strings.LastIndex(r.URL.Path, "/"):]
+
+	contextLogger := s.Log.WithFields(logrus.Fields{
+		"module": "simulator",
+		"call":   endpoint,
+	})
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var response *oxipay.Response
+	var signingKey string
+	var ref string
+
+	switch endpoint {
+	case EndpointCreateKey:
+		response, signingKey = s.createKey(body)
+	case EndpointProcessAuthorisation:
+		response, signingKey, ref = s.processAuthorisation(body)
+	case EndpointProcessSalesAdjustment:
+		response, signingKey = s.processSalesAdjustment(body)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	behaviour := s.next(endpoint)
+	if response.Code == "" {
+		response.Code = behaviour.Code
+		if response.Code != "" && response.Code[0] != 'S' {
+			// a scripted decline doesn't create a purchase
+			response.PurchaseNumber = ""
+		}
+	}
+	if response.Code == "" {
+		response.Code = successCodes[endpoint]
+	}
+	if response.Code[0] == 'S' {
+		response.Status = "Success"
+	} else {
+		response.Status = "Fail"
+		response.Key = ""
+	}
+	response.Message = message(endpoint, response.Code)
+
+	if behaviour.Delay > 0 {
+		select {
+		case <-time.After(behaviour.Delay):
+		case <-r.Context().Done():
+			contextLogger.Debug("Client went away before the delayed response was sent")
+			return
+		}
+	}
+
+	// the request has been processed once the delay is over, even if the
+	// response never arrives
+	if ref != "" && response.Status == "Success" {
+		s.markProcessed(ref, response.PurchaseNumber)
+	}
+
+	if behaviour.Drop {
+		contextLogger.Debug("Dropping the connection without a response")
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+			}
+		}
+		return
+	}
+
+	if behaviour.BadSignature {
+		signingKey = signingKey + "-invalid"
+	}
+	if signingKey != "" {
+		response.Signature = oxipay.SignMessage(oxipay.GeneratePlainTextSignature(response), signingKey)
+	}
+
+	status := behaviour.HTTPStatus
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	contextLogger.Debugf("Responding with %s", response.Code)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if behaviour.Malformed {
+		w.Write([]byte("<html><body>502 Bad Gateway</body></html>"))
+		return
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// createKey responds to a registration, the response is signed with the device
+// token as the device does not have a key yet
+func (s *Simulator) createKey(body []byte) (*oxipay.Response, string) {
+	payload := new(oxipay.RegistrationPayload)
+	if err := json.Unmarshal(body, payload); err != nil {
+		return &oxipay.Response{Code: "EVAL01"}, ""
+	}
+
+	if !verify(payload, payload.Signature, payload.DeviceToken) {
+		return &oxipay.Response{Code: "ESIG01"}, payload.DeviceToken
+	}
+
+	key := randomKey()
+	s.AddDevice(payload.DeviceID, key)
+
+	return &oxipay.Response{Key: key}, payload.DeviceToken
+}
+
+// processAuthorisation responds to a payment, the returned ref identifies the
+// authorisation so that Oxipay can reject a PosTransactionRef it has already processed
+func (s *Simulator) processAuthorisation(body []byte) (*oxipay.Response, string, string) {
+	payload := new(oxipay.AuthorisationPayload)
+	if err := json.Unmarshal(body, payload); err != nil {
+		return &oxipay.Response{Code: "EVAL02"}, "", ""
+	}
+
+	key, ok := s.signingKey(payload.DeviceID)
+	if !ok || !verify(payload, payload.Signature, key) {
+		return &oxipay.Response{Code: "ESIG01"}, key, ""
+	}
+
+	if payload.PosTransactionRef == "" {
+		return &oxipay.Response{PurchaseNumber: s.nextPurchaseNumber()}, key, ""
+	}
+
+	ref := payload.DeviceID + "|" + payload.PosTransactionRef
+	if purchaseNumber, ok := s.alreadyProcessed(ref); ok {
+		// Oxipay reports the purchase the PosTransactionRef was processed as
+		return &oxipay.Response{Code: "FPRA07", PurchaseNumber: purchaseNumber}, key, ""
+	}
+	return &oxipay.Response{PurchaseNumber: s.nextPurchaseNumber()}, key, ref
+}
+
+func (s *Simulator) processSalesAdjustment(body []byte) (*oxipay.Response, string) {
+	payload := new(oxipay.SalesAdjustmentPayload)
+	if err := json.Unmarshal(body, payload); err != nil {
+		return &oxipay.Response{Code: "EVAL01"}, ""
+	}
+
+	key, ok := s.signingKey(payload.DeviceID)
+	if !ok || !verify(payload, payload.Signature, key) {
+		return &oxipay.Response{Code: "ESIG01"}, key
+	}
+
+	return &oxipay.Response{PurchaseNumber: payload.PurchaseRef}, key
+}
+
+func (s *Simulator) nextPurchaseNumber() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purchaseNumber++
+	return fmt.Sprintf("%d", s.purchaseNumber)
+}
+
+// verify checks the signature of a request using the same plain text the proxy signs
+func verify(payload interface{}, signature string, key string) bool {
+	plainText := oxipay.GeneratePlainTextSignature(payload)
+	valid, err := oxipay.CheckMAC([]byte(plainText), []byte(signature), []byte(key))
+	return valid && err == nil
+}
+
+func message(endpoint string, code string) string {
+	var responseCode *oxipay.ResponseCode
+	switch endpoint {
+	case EndpointCreateKey:
+		responseCode = oxipay.ProcessRegistrationResponse()(code)
+	case EndpointProcessAuthorisation:
+		responseCode = oxipay.ProcessAuthorisationResponses()(code)
+	case EndpointProcessSalesAdjustment:
+		responseCode = oxipay.ProcessSalesAdjustmentResponse()(code)
+	}
+	return responseCode.LogMessage
+}
+
+func randomKey() string {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	key := make([]byte, 12)
+	for i := range key {
+		key[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(key)
+}
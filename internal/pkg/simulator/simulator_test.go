@@ -0,0 +1,178 @@
+package simulator
+
+import (
+	"testing"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
+	"github.com/sirupsen/logrus"
+)
+
+func newClient(t *testing.T) (*Simulator, oxipay.Client, func()) {
+	sim := New(nil)
+	server := NewServer(sim)
+	client := oxipay.NewOxipay(server.URL, "1.1", logrus.New())
+	return sim, client, server.Close
+}
+
+func signedAuthorisation(deviceID string, key string, ref string) *oxipay.AuthorisationPayload {
+	payload := &oxipay.AuthorisationPayload{
+		DeviceID:          deviceID,
+		MerchantID:        "30188105",
+		PosTransactionRef: ref,
+		FinanceAmount:     "4400",
+		FirmwareVersion:   "vend_integration_v0.0.1",
+		OperatorID:        "Vend",
+		PurchaseAmount:    "4400",
+		PreApprovalCode:   "01APPROV",
+	}
+	payload.Signature = oxipay.SignMessage(oxipay.GeneratePlainTextSignature(payload), key)
+	return payload
+}
+
+func TestCreateKey(t *testing.T) {
+	_, client, done := newClient(t)
+	defer done()
+
+	payload := &oxipay.RegistrationPayload{
+		MerchantID:      "30188105",
+		DeviceID:        "01SUCCES-abc",
+		DeviceToken:     "01SUCCES",
+		OperatorID:      "unknown",
+		FirmwareVersion: "version 1.1",
+		POSVendor:       "Vend-Proxy",
+	}
+	payload.Signature = oxipay.SignMessage(oxipay.GeneratePlainTextSignature(payload), payload.DeviceToken)
+
+	response, err := client.RegisterPosDevice(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid, _ := response.Authenticate(payload.DeviceToken); !valid {
+		t.Error("response should be signed with the device token")
+	}
+	if response.Code != "SCRK01" || response.Key == "" {
+		t.Errorf("unexpected response: %+v", response)
+	}
+
+	// the returned key must be usable straight away
+	auth, err := client.ProcessAuthorisation(signedAuthorisation(payload.DeviceID, response.Key, "sale-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Code != "SPRA01" {
+		t.Errorf("expected SPRA01 got %s", auth.Code)
+	}
+}
+
+func TestScriptedAuthorisation(t *testing.T) {
+	sim, client, done := newClient(t)
+	defer done()
+
+	sim.AddDevice("Oxipos", "1234567890")
+	sim.Script(EndpointProcessAuthorisation, Behaviour{Code: "FPRA21"}, Behaviour{BadSignature: true})
+
+	declined, err := client.ProcessAuthorisation(signedAuthorisation("Oxipos", "1234567890", "sale-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if declined.Code != "FPRA21" || declined.PurchaseNumber != "" {
+		t.Errorf("expected a FPRA21 decline got %+v", declined)
+	}
+	if valid, _ := declined.Authenticate("1234567890"); !valid {
+		t.Error("declined response should be signed")
+	}
+
+	badlySigned, err := client.ProcessAuthorisation(signedAuthorisation("Oxipos", "1234567890", "sale-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid, _ := badlySigned.Authenticate("1234567890"); valid {
+		t.Error("response should not pass authentication")
+	}
+
+	// script exhausted, back to the default
+	approved, err := client.ProcessAuthorisation(signedAuthorisation("Oxipos", "1234567890", "sale-3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if approved.Code != "SPRA01" || approved.PurchaseNumber == "" {
+		t.Errorf("expected an approval got %+v", approved)
+	}
+}
+
+func TestRequestSignatureIsVerified(t *testing.T) {
+	sim, client, done := newClient(t)
+	defer done()
+
+	sim.AddDevice("Oxipos", "1234567890")
+
+	response, err := client.ProcessAuthorisation(signedAuthorisation("Oxipos", "wrong-key", "sale-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Code != "ESIG01" {
+		t.Errorf("expected ESIG01 got %s", response.Code)
+	}
+}
+
+func TestMalformedResponse(t *testing.T) {
+	sim, client, done := newClient(t)
+	defer done()
+
+	sim.AddDevice("Oxipos", "1234567890")
+	sim.Script(EndpointProcessAuthorisation, Behaviour{Malformed: true})
+
+	_, err := client.ProcessAuthorisation(signedAuthorisation("Oxipos", "1234567890", "sale-1"))
+	if err == nil {
+		t.Error("expected an error unmarshalling a malformed body")
+	}
+}
+
+func TestDroppedAuthorisationIsProcessed(t *testing.T) {
+	sim, client, done := newClient(t)
+	defer done()
+
+	sim.AddDevice("Oxipos", "1234567890")
+	sim.Script(EndpointProcessAuthorisation, Behaviour{Drop: true})
+
+	_, err := client.ProcessAuthorisation(signedAuthorisation("Oxipos", "1234567890", "sale-1"))
+	if !oxipay.MayHaveBeenProcessed(err) {
+		t.Fatalf("expected a lost response got %v", err)
+	}
+
+	// the replay reaches a gateway that has already processed the sale
+	replay, err := client.ProcessAuthorisation(signedAuthorisation("Oxipos", "1234567890", "sale-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replay.Code != "FPRA07" || replay.PurchaseNumber != "52000001" {
+		t.Errorf("expected FPRA07 with the original purchase got %s %s", replay.Code, replay.PurchaseNumber)
+	}
+}
+
+func TestSalesAdjustment(t *testing.T) {
+	sim, client, done := newClient(t)
+	defer done()
+
+	sim.AddDevice("Oxipos", "1234567890")
+	sim.Script(EndpointProcessSalesAdjustment, Behaviour{Code: "FPSA09"})
+
+	adjustment := &oxipay.SalesAdjustmentPayload{
+		PosTransactionRef: "refund-1",
+		PurchaseRef:       "52000001",
+		MerchantID:        "30188105",
+		Amount:            "0",
+		DeviceID:          "Oxipos",
+		OperatorID:        "Vend",
+		FirmwareVersion:   "vend_integration_v0.0.1",
+	}
+	adjustment.Signature = oxipay.SignMessage(oxipay.GeneratePlainTextSignature(adjustment), "1234567890")
+
+	response, err := client.ProcessSalesAdjustment(adjustment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Code != "FPSA09" {
+		t.Errorf("expected FPSA09 got %s", response.Code)
+	}
+}
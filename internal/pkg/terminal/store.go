@@ -0,0 +1,462 @@
+package terminal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/database"
+)
+
+// RegisterStore persists the mapping between Vend registers and Oxipay devices
+type RegisterStore interface {
+	Save(user string, register *Register) (bool, error)
+	GetRegister(originDomain string, vendRegisterID string) (*Register, error)
+	Update(user string, register *Register) (bool, error)
+	Deactivate(user string, originDomain string, vendRegisterID string) (bool, error)
+	Delete(originDomain string, vendRegisterID string) (bool, error)
+	List(filter Filter) ([]*Register, error)
+	Count(filter Filter) (int, error)
+	GetByID(id int64) (*Register, error)
+	SigningKeys() ([]*Register, error)
+	ReplaceSigningKey(register *Register, key string, keyVersion int) (bool, error)
+}
+
+// Filter narrows down the registers returned by List and Count. Empty fields
+// match everything, a Limit of 0 returns every matching register.
+type Filter struct {
+	OriginDomain   string
+	FxlSellerID    string
+	VendRegisterID string
+	Limit          int
+	Offset         int
+}
+
+// ErrNotFound no register matches the origin domain and Vend register ID
+var ErrNotFound = errors.New("Unable to find a matching terminal ")
+
+// sqlStore stores registers in oxipay_vend_map. The queries are the same for
+// every supported database apart from the placeholder syntax.
+type sqlStore struct {
+	db     *sql.DB
+	driver string
+}
+
+// NewRegisterStore returns a RegisterStore for the database/sql driver
+func NewRegisterStore(driver string, db *sql.DB) (RegisterStore, error) {
+	switch driver {
+	case database.DriverMySQL, database.DriverPostgres, database.DriverSQLite:
+		return &sqlStore{db: db, driver: driver}, nil
+	}
+	return nil, fmt.Errorf("Database driver %s is not supported", driver)
+}
+
+// NewMySQLStore returns a RegisterStore backed by MySQL or MariaDB
+func NewMySQLStore(db *sql.DB) RegisterStore {
+	return &sqlStore{db: db, driver: database.DriverMySQL}
+}
+
+// NewPostgresStore returns a RegisterStore backed by PostgreSQL
+func NewPostgresStore(db *sql.DB) RegisterStore {
+	return &sqlStore{db: db, driver: database.DriverPostgres}
+}
+
+// NewSQLiteStore returns a RegisterStore backed by SQLite
+func NewSQLiteStore(db *sql.DB) RegisterStore {
+	return &sqlStore{db: db, driver: database.DriverSQLite}
+}
+
+// Save will save the terminal to the database. A deactivated register keeps
+// its row, so registering it again reactivates it with the new device.
+func (s *sqlStore) Save(user string, register *Register) (bool, error) {
+	if reactivated, err := s.update(user, register, true); err != ErrNotFound {
+		return reactivated, err
+	}
+
+	query := `INSERT INTO 
+		oxipay_vend_map  
+		(
+			fxl_register_id,
+			fxl_seller_id,
+			fxl_device_signing_key,
+			key_version,
+			region,
+			origin_domain, 
+			vend_register_id,
+			created_by
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?) `
+
+	stmt, err := s.db.Prepare(database.Rebind(s.driver, query))
+
+	if err != nil {
+		return false, err
+	}
+
+	defer stmt.Close()
+
+	_, err = stmt.Exec(
+		newNullString(register.FxlRegisterID),
+		newNullString(register.FxlSellerID),
+		newNullString(register.FxlDeviceSigningKey),
+		register.KeyVersion,
+		newNullString(register.Region),
+		newNullString(register.Origin),
+		newNullString(register.VendRegisterID),
+		newNullString(user),
+	)
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// GetRegister will return a registered terminal for the the domain & vendregister_id combo
+func (s *sqlStore) GetRegister(originDomain string, vendRegisterID string) (*Register, error) {
+	var register = new(Register)
+	var region sql.NullString
+	query := `SELECT 
+			 fxl_register_id, 
+			 fxl_seller_id,
+			 fxl_device_signing_key, 
+			 key_version,
+			 region,
+			 origin_domain,
+			 vend_register_id
+			FROM 
+				oxipay_vend_map 
+			WHERE 
+				origin_domain = ? 
+			AND
+				vend_register_id = ? 
+			AND
+				active = 1`
+
+	rows, err := s.db.Query(database.Rebind(s.driver, query), originDomain, vendRegisterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotFound
+	}
+
+	err = rows.Scan(
+		&register.FxlRegisterID,
+		&register.FxlSellerID,
+		&register.FxlDeviceSigningKey,
+		&register.KeyVersion,
+		&region,
+		&register.Origin,
+		&register.VendRegisterID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	register.Region = region.String
+
+	return register, nil
+}
+
+// Update replaces the Oxipay device, merchant and signing key of an existing
+// register and reactivates it
+func (s *sqlStore) Update(user string, register *Register) (bool, error) {
+	return s.update(user, register, false)
+}
+
+// update replaces the device of the register, only when it is deactivated if
+// inactive is set
+func (s *sqlStore) update(user string, register *Register, inactive bool) (bool, error) {
+	query := `UPDATE
+			oxipay_vend_map
+		SET
+			fxl_register_id = ?,
+			fxl_seller_id = ?,
+			fxl_device_signing_key = ?,
+			key_version = ?,
+			region = ?,
+			active = 1,
+			modified_date = ?,
+			modified_by = ?
+		WHERE
+			origin_domain = ?
+		AND
+			vend_register_id = ?`
+	if inactive {
+		query += `
+		AND
+			active = 0`
+	}
+
+	return s.exec(
+		query,
+		newNullString(register.FxlRegisterID),
+		newNullString(register.FxlSellerID),
+		newNullString(register.FxlDeviceSigningKey),
+		register.KeyVersion,
+		newNullString(register.Region),
+		time.Now(),
+		newNullString(user),
+		register.Origin,
+		register.VendRegisterID,
+	)
+}
+
+// Deactivate stops a register from being used without removing it
+func (s *sqlStore) Deactivate(user string, originDomain string, vendRegisterID string) (bool, error) {
+	query := `UPDATE
+			oxipay_vend_map
+		SET
+			active = 0,
+			modified_date = ?,
+			modified_by = ?
+		WHERE
+			origin_domain = ?
+		AND
+			vend_register_id = ?`
+
+	return s.exec(query, time.Now(), newNullString(user), originDomain, vendRegisterID)
+}
+
+// Delete removes a register
+func (s *sqlStore) Delete(originDomain string, vendRegisterID string) (bool, error) {
+	query := `DELETE FROM
+			oxipay_vend_map
+		WHERE
+			origin_domain = ?
+		AND
+			vend_register_id = ?`
+
+	return s.exec(query, originDomain, vendRegisterID)
+}
+
+// listColumns are returned by List and GetByID, the signing key is
+// intentionally not selected
+const listColumns = `
+			id,
+			fxl_register_id,
+			fxl_seller_id,
+			origin_domain,
+			vend_register_id,
+			key_version,
+			region,
+			active,
+			created_date,
+			created_by,
+			modified_date,
+			modified_by`
+
+// List returns the registers matching the filter, including deactivated
+// registers, ordered by ID
+func (s *sqlStore) List(filter Filter) ([]*Register, error) {
+	where, args := filter.where()
+	query := `SELECT ` + listColumns + `
+		FROM
+			oxipay_vend_map ` + where + `
+		ORDER BY id`
+
+	if filter.Limit > 0 {
+		query += ` LIMIT ? OFFSET ?`
+		args = append(args, filter.Limit, filter.Offset)
+	}
+
+	rows, err := s.db.Query(database.Rebind(s.driver, query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var registers []*Register
+	for rows.Next() {
+		register, err := scanRegister(rows)
+		if err != nil {
+			return nil, err
+		}
+		registers = append(registers, register)
+	}
+	return registers, rows.Err()
+}
+
+// Count returns the number of registers matching the filter, ignoring Limit and Offset
+func (s *sqlStore) Count(filter Filter) (int, error) {
+	where, args := filter.where()
+	query := `SELECT COUNT(*) FROM oxipay_vend_map ` + where
+
+	var count int
+	err := s.db.QueryRow(database.Rebind(s.driver, query), args...).Scan(&count)
+	return count, err
+}
+
+// GetByID returns a single register, including a deactivated register
+func (s *sqlStore) GetByID(id int64) (*Register, error) {
+	query := `SELECT ` + listColumns + `
+		FROM
+			oxipay_vend_map
+		WHERE
+			id = ?`
+
+	rows, err := s.db.Query(database.Rebind(s.driver, query), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotFound
+	}
+	return scanRegister(rows)
+}
+
+func (f Filter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if f.OriginDomain != "" {
+		conditions = append(conditions, "origin_domain = ?")
+		args = append(args, f.OriginDomain)
+	}
+	if f.FxlSellerID != "" {
+		conditions = append(conditions, "fxl_seller_id = ?")
+		args = append(args, f.FxlSellerID)
+	}
+	if f.VendRegisterID != "" {
+		conditions = append(conditions, "vend_register_id = ?")
+		args = append(args, f.VendRegisterID)
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func scanRegister(rows *sql.Rows) (*Register, error) {
+	var active int
+	var region, createdBy, modifiedBy sql.NullString
+	var createdDate, modifiedDate nullTime
+
+	register := new(Register)
+	err := rows.Scan(
+		&register.ID,
+		&register.FxlRegisterID,
+		&register.FxlSellerID,
+		&register.Origin,
+		&register.VendRegisterID,
+		&register.KeyVersion,
+		&region,
+		&active,
+		&createdDate,
+		&createdBy,
+		&modifiedDate,
+		&modifiedBy,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	register.Region = region.String
+	register.Active = active == 1
+	register.CreatedDate = createdDate.Time
+	register.CreatedBy = createdBy.String
+	register.ModifiedDate = modifiedDate.Time
+	register.ModifiedBy = modifiedBy.String
+
+	return register, nil
+}
+
+// nullTime represents a time.Time that may be NULL in the database
+type nullTime struct {
+	Time  time.Time
+	Valid bool
+}
+
+// Scan implements the sql.Scanner interface
+func (nt *nullTime) Scan(value interface{}) error {
+	nt.Time, nt.Valid = value.(time.Time)
+	return nil
+}
+
+// SigningKeys returns the ID, signing key and key version of every register,
+// including deactivated registers
+func (s *sqlStore) SigningKeys() ([]*Register, error) {
+	query := `SELECT
+			id,
+			fxl_device_signing_key,
+			key_version
+		FROM
+			oxipay_vend_map
+		WHERE
+			fxl_device_signing_key IS NOT NULL
+		ORDER BY id`
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var registers []*Register
+	for rows.Next() {
+		register := new(Register)
+		if err = rows.Scan(&register.ID, &register.FxlDeviceSigningKey, &register.KeyVersion); err != nil {
+			return nil, err
+		}
+		registers = append(registers, register)
+	}
+	return registers, rows.Err()
+}
+
+// ReplaceSigningKey stores a re-encrypted signing key. It returns ErrNotFound
+// if the key has changed since it was read by SigningKeys.
+func (s *sqlStore) ReplaceSigningKey(register *Register, key string, keyVersion int) (bool, error) {
+	query := `UPDATE
+			oxipay_vend_map
+		SET
+			fxl_device_signing_key = ?,
+			key_version = ?
+		WHERE
+			id = ?
+		AND
+			fxl_device_signing_key = ?
+		AND
+			key_version = ?`
+
+	return s.exec(query, key, keyVersion, register.ID, register.FxlDeviceSigningKey, register.KeyVersion)
+}
+
+// exec runs a statement that is expected to change at least one register
+func (s *sqlStore) exec(query string, args ...interface{}) (bool, error) {
+	result, err := s.db.Exec(database.Rebind(s.driver, query), args...)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected < 1 {
+		return false, ErrNotFound
+	}
+	return true, nil
+}
+
+func newNullString(s string) sql.NullString {
+	if len(s) == 0 {
+		return sql.NullString{}
+	}
+	return sql.NullString{
+		String: s,
+		Valid:  true,
+	}
+}
@@ -0,0 +1,168 @@
+package terminal
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/oxipay/oxipay-vend/internal/pkg/database"
+	"github.com/oxipay/oxipay-vend/internal/pkg/migrate"
+)
+
+func newDB(t *testing.T) *sql.DB {
+	db, err := sql.Open(database.DriverSQLite, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: is a new database
+	db.SetMaxOpenConns(1)
+
+	migrator, err := migrate.NewMigrator(database.DriverSQLite, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// stores runs the tests against the store for each driver. SQLite accepts the
+// $n placeholders used by Postgres, so the rebound queries run against it too.
+var stores = map[string]func(db *sql.DB) RegisterStore{
+	database.DriverMySQL:    NewMySQLStore,
+	database.DriverPostgres: NewPostgresStore,
+	database.DriverSQLite:   NewSQLiteStore,
+}
+
+func TestStore(t *testing.T) {
+	for driver, newStore := range stores {
+		t.Run(driver, func(t *testing.T) {
+			store := newStore(newDB(t))
+
+			register := NewRegister("signing-key", "device-1", "30188105", "https://pos.example.com", "register-1")
+			register.Region = "nz"
+			if saved, err := store.Save("unit-test", register); err != nil || !saved {
+				t.Fatalf("expected the register to be saved: %v", err)
+			}
+			if _, err := store.Save("unit-test", register); err == nil {
+				t.Error("expected saving the same register twice to fail")
+			}
+
+			got, err := store.GetRegister(register.Origin, register.VendRegisterID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.FxlRegisterID != "device-1" || got.FxlDeviceSigningKey != "signing-key" || got.Region != "nz" {
+				t.Errorf("unexpected register %+v", got)
+			}
+			if _, err = store.GetRegister(register.Origin, "register-2"); err != ErrNotFound {
+				t.Errorf("expected ErrNotFound got %v", err)
+			}
+
+			register.FxlRegisterID = "device-2"
+			register.FxlDeviceSigningKey = "new-signing-key"
+			if _, err = store.Update("unit-test", register); err != nil {
+				t.Fatal(err)
+			}
+			if got, err = store.GetRegister(register.Origin, register.VendRegisterID); err != nil || got.FxlRegisterID != "device-2" || got.FxlDeviceSigningKey != "new-signing-key" {
+				t.Errorf("expected the register to be updated got %+v: %v", got, err)
+			}
+
+			if _, err = store.Deactivate("unit-test", register.Origin, register.VendRegisterID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.GetRegister(register.Origin, register.VendRegisterID); err != ErrNotFound {
+				t.Errorf("expected a deactivated register not to be found got %v", err)
+			}
+
+			// deactivated registers are still listed
+			registers, err := store.List(Filter{OriginDomain: register.Origin})
+			if err != nil || len(registers) != 1 || registers[0].Active || registers[0].ModifiedBy != "unit-test" {
+				t.Fatalf("expected the deactivated register to be listed got %v: %v", registers, err)
+			}
+			if registers[0].FxlDeviceSigningKey != "" {
+				t.Error("expected List not to return the signing key")
+			}
+			if byID, err := store.GetByID(registers[0].ID); err != nil || byID.VendRegisterID != register.VendRegisterID {
+				t.Errorf("expected the register by ID got %+v: %v", byID, err)
+			}
+			if count, err := store.Count(Filter{FxlSellerID: "30188105"}); err != nil || count != 1 {
+				t.Errorf("expected 1 register got %d: %v", count, err)
+			}
+
+			// registering a deactivated register again reactivates it
+			register.FxlRegisterID = "device-3"
+			if saved, err := store.Save("unit-test", register); err != nil || !saved {
+				t.Fatalf("expected the deactivated register to be registered again: %v", err)
+			}
+			if got, err = store.GetRegister(register.Origin, register.VendRegisterID); err != nil || got.FxlRegisterID != "device-3" {
+				t.Errorf("expected the register to be reactivated with the new device got %+v: %v", got, err)
+			}
+			if _, err = store.Deactivate("unit-test", register.Origin, register.VendRegisterID); err != nil {
+				t.Fatal(err)
+			}
+
+			// updating a register reactivates it
+			if _, err = store.Update("unit-test", register); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.GetRegister(register.Origin, register.VendRegisterID); err != nil {
+				t.Errorf("expected the register to be reactivated: %v", err)
+			}
+
+			if _, err = store.Delete(register.Origin, register.VendRegisterID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = store.GetByID(registers[0].ID); err != ErrNotFound {
+				t.Errorf("expected a deleted register not to be found got %v", err)
+			}
+
+			// changing a register that doesn't exist
+			if _, err = store.Update("unit-test", register); err != ErrNotFound {
+				t.Errorf("expected ErrNotFound updating got %v", err)
+			}
+			if _, err = store.Deactivate("unit-test", register.Origin, register.VendRegisterID); err != ErrNotFound {
+				t.Errorf("expected ErrNotFound deactivating got %v", err)
+			}
+			if _, err = store.Delete(register.Origin, register.VendRegisterID); err != ErrNotFound {
+				t.Errorf("expected ErrNotFound deleting got %v", err)
+			}
+		})
+	}
+}
+
+func TestReplaceSigningKey(t *testing.T) {
+	store := NewSQLiteStore(newDB(t))
+	if _, err := store.Save("unit-test", NewRegister("signing-key", "device-1", "30188105", "https://pos.example.com", "register-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	registers, err := store.SigningKeys()
+	if err != nil || len(registers) != 1 {
+		t.Fatalf("expected 1 signing key got %d: %v", len(registers), err)
+	}
+
+	if _, err = store.ReplaceSigningKey(registers[0], "encrypted-key", 1); err != nil {
+		t.Fatal(err)
+	}
+	// the key read before it was replaced is stale
+	if _, err = store.ReplaceSigningKey(registers[0], "other-key", 2); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound replacing a stale key got %v", err)
+	}
+
+	got, err := store.GetRegister("https://pos.example.com", "register-1")
+	if err != nil || got.FxlDeviceSigningKey != "encrypted-key" || got.KeyVersion != 1 {
+		t.Errorf("expected the replaced key got %+v: %v", got, err)
+	}
+}
+
+func TestClosedDatabase(t *testing.T) {
+	db := newDB(t)
+	store := NewSQLiteStore(db)
+	db.Close()
+
+	if _, err := store.GetRegister("https://pos.example.com", "register-1"); err == nil || err == ErrNotFound {
+		t.Errorf("expected the query error to be returned got %v", err)
+	}
+}
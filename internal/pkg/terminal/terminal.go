@@ -1,31 +1,45 @@
 package terminal
 
 import (
-	"database/sql"
 	"errors"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/keyring"
+	"github.com/oxipay/oxipay-vend/internal/pkg/metrics"
 )
 
+// ErrNoKeyring a signing key is encrypted but no encryption keys are configured
+var ErrNoKeyring = errors.New("The signing key is encrypted but no encryption keys are configured")
+
 // Terminal terminal mapping
 type Register struct {
+	ID                  int64
 	FxlRegisterID       string // Oxipay registerid
 	FxlSellerID         string
 	FxlDeviceSigningKey string
+	KeyVersion          int    // master key version protecting FxlDeviceSigningKey, 0 when stored in plaintext
+	Region              string // gateway region the merchant was registered in, empty for the default region
 	Origin              string
 	VendRegisterID      string
+	Active              bool
+	CreatedDate         time.Time
+	CreatedBy           string
+	ModifiedDate        time.Time
+	ModifiedBy          string
 }
 
 // Terminal terminal mapping
 type Terminal struct {
-	Db *sql.DB
+	Store RegisterStore
+	// Keys encrypts signing keys before they are stored, signing keys are
+	// stored in plaintext when nil
+	Keys *keyring.Keyring
 }
 
-// Db connection to the database
-var db *sql.DB
-
-// NewTerminal Used to marshall the DB connection
-func NewTerminal(db *sql.DB) *Terminal {
+// NewTerminal Used to marshall the register store
+func NewTerminal(store RegisterStore) *Terminal {
 	return &Terminal{
-		Db: db,
+		Store: store,
 	}
 }
 
@@ -40,95 +54,128 @@ func NewRegister(key string, deviceID string, merchantID string, origin string,
 	}
 }
 
-//Save will save the terminal to the database
+// Save will save the terminal to the database
 func (t Terminal) Save(user string, register *Register) (bool, error) {
-	query := `INSERT INTO 
-		oxipay_vend_map  
-		(
-			fxl_register_id,
-			fxl_seller_id,
-			fxl_device_signing_key,
-			origin_domain, 
-			vend_register_id,
-			created_by
-		) VALUES (?, ?, ?, ?, ?, ?) `
-
-	stmt, err := t.Db.Prepare(query)
-
+	encrypted, err := t.encrypt(register)
 	if err != nil {
 		return false, err
 	}
+	return t.Store.Save(user, encrypted)
+}
 
-	defer stmt.Close()
-
-	_, err = stmt.Exec(
-		newNullString(register.FxlRegisterID),
-		newNullString(register.FxlSellerID),
-		newNullString(register.FxlDeviceSigningKey),
-		newNullString(register.Origin),
-		newNullString(register.VendRegisterID),
-		newNullString(user),
-	)
+// GetRegister will return a registered terminal for the the domain & vendregister_id combo
+func (t Terminal) GetRegister(originDomain string, vendRegisterID string) (*Register, error) {
+	start := time.Now()
+	register, err := t.Store.GetRegister(originDomain, vendRegisterID)
+	metrics.Since(metrics.RegisterLookupLatency, start)
+	if err != nil || register == nil {
+		return register, err
+	}
+	return t.decrypt(register)
+}
 
+// Update replaces the Oxipay device and signing key of an existing register, for
+// example after it has been registered again with a new device token
+func (t Terminal) Update(user string, register *Register) (bool, error) {
+	encrypted, err := t.encrypt(register)
 	if err != nil {
 		return false, err
 	}
+	return t.Store.Update(user, encrypted)
+}
 
-	return true, nil
+// Deactivate stops a register from processing payments without removing it
+func (t Terminal) Deactivate(user string, originDomain string, vendRegisterID string) (bool, error) {
+	return t.Store.Deactivate(user, originDomain, vendRegisterID)
 }
 
-// GetRegister will return a registered terminal for the the domain & vendregister_id combo
-func (t Terminal) GetRegister(originDomain string, vendRegisterID string) (*Register, error) {
-	var register = new(Register)
-	sql := `SELECT 
-			 fxl_register_id, 
-			 fxl_seller_id,
-			 fxl_device_signing_key, 
-			 origin_domain,
-			 vend_register_id
-			FROM 
-				oxipay_vend_map 
-			WHERE 
-				origin_domain = ? 
-			AND
-				vend_register_id = ? 
-			AND 1=1`
-
-	rows, err := t.Db.Query(sql, originDomain, vendRegisterID)
-	if rows == nil {
-		return register, errors.New("Nothing returned from register lookup. Has the table been created ?")
-	}
+// Delete removes a register so that it can be paired from scratch
+func (t Terminal) Delete(originDomain string, vendRegisterID string) (bool, error) {
+	return t.Store.Delete(originDomain, vendRegisterID)
+}
+
+// List returns the registers matching the filter. The signing key is not
+// populated.
+func (t Terminal) List(filter Filter) ([]*Register, error) {
+	return t.Store.List(filter)
+}
 
-	noRows := 0
+// Count returns the number of registers matching the filter
+func (t Terminal) Count(filter Filter) (int, error) {
+	return t.Store.Count(filter)
+}
 
-	for rows.Next() {
-		noRows++
-		err = rows.Scan(
-			&register.FxlRegisterID,
-			&register.FxlSellerID,
-			&register.FxlDeviceSigningKey,
-			&register.Origin,
-			&register.VendRegisterID,
-		)
+// GetByID returns a single register. The signing key is not populated.
+func (t Terminal) GetByID(id int64) (*Register, error) {
+	return t.Store.GetByID(id)
+}
 
+// RotateKeys re-encrypts every signing key that isn't protected by the current
+// master key, including keys stored in plaintext. It returns the number of
+// registers that were changed.
+func (t Terminal) RotateKeys() (int, error) {
+	if t.Keys == nil {
+		return 0, ErrNoKeyring
 	}
+
+	registers, err := t.Store.SigningKeys()
 	if err != nil {
-		return register, err
+		return 0, err
 	}
 
-	if noRows < 1 {
-		return nil, errors.New("Unable to find a matching terminal ")
+	rotated := 0
+	for _, register := range registers {
+		if register.KeyVersion == t.Keys.Current() {
+			continue
+		}
+
+		key, version, err := t.Keys.Rewrap(register.FxlDeviceSigningKey, register.KeyVersion)
+		if err != nil {
+			return rotated, err
+		}
+
+		_, err = t.Store.ReplaceSigningKey(register, key, version)
+		if err == ErrNotFound {
+			// re-keyed or deleted since we read it, a new key will already
+			// have been encrypted with the current master key
+			continue
+		}
+		if err != nil {
+			return rotated, err
+		}
+		rotated++
 	}
+	return rotated, nil
+}
 
-	return register, err
+// encrypt returns a copy of the register with the signing key encrypted
+func (t Terminal) encrypt(register *Register) (*Register, error) {
+	if t.Keys == nil || register.FxlDeviceSigningKey == "" {
+		return register, nil
+	}
+
+	encrypted := *register
+	key, version, err := t.Keys.Encrypt(register.FxlDeviceSigningKey)
+	if err != nil {
+		return nil, err
+	}
+	encrypted.FxlDeviceSigningKey = key
+	encrypted.KeyVersion = version
+	return &encrypted, nil
 }
 
-func newNullString(s string) sql.NullString {
-	if len(s) == 0 {
-		return sql.NullString{}
+func (t Terminal) decrypt(register *Register) (*Register, error) {
+	if register.KeyVersion == keyring.Plaintext {
+		return register, nil
 	}
-	return sql.NullString{
-		String: s,
-		Valid:  true,
+	if t.Keys == nil {
+		return nil, ErrNoKeyring
+	}
+
+	key, err := t.Keys.Decrypt(register.FxlDeviceSigningKey, register.KeyVersion)
+	if err != nil {
+		return nil, err
 	}
+	register.FxlDeviceSigningKey = key
+	return register, nil
 }
@@ -0,0 +1,110 @@
+package transaction
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// InFlight collapses concurrent requests for the same key into a single call.
+// It is used to stop a double-tapped or re-posted payment from reaching
+// Oxipay more than once.
+type InFlight struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	key     string
+	done    chan struct{}
+	val     interface{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// NewInFlight returns an empty InFlight group
+func NewInFlight() *InFlight {
+	return &InFlight{
+		calls: make(map[string]*call),
+	}
+}
+
+// Key builds the idempotency key for a Vend sale
+func Key(originDomain string, vendRegisterID string, saleID string) string {
+	return strings.Join([]string{originDomain, vendRegisterID, saleID}, "|")
+}
+
+// Do executes fn while holding the lock for key. Any caller that arrives with
+// the same key while fn is running waits for it to finish and receives the same
+// result instead of calling fn again. shared reports whether the result was
+// handed to more than one caller. fn runs on behalf of every caller, so it
+// mustn't depend on the request of the first one. The context passed to fn is
+// cancelled once the context of every caller is done, a duplicate whose context
+// is done stops waiting and receives its error. A panic in fn is returned to
+// every caller as an error.
+func (f *InFlight) Do(ctx context.Context, key string, fn func(context.Context) interface{}) (v interface{}, shared bool, err error) {
+	f.mu.Lock()
+	if c, ok := f.calls[key]; ok {
+		c.waiters++
+		f.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.val, true, c.err
+		case <-ctx.Done():
+			f.leave(c)
+			return nil, true, ctx.Err()
+		}
+	}
+	callCtx, cancel := context.WithCancel(context.Background())
+	c := &call{key: key, done: make(chan struct{}), waiters: 1, cancel: cancel}
+	f.calls[key] = c
+	f.mu.Unlock()
+
+	// the first caller runs fn so it can only leave by watching its context
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.leave(c)
+		case <-c.done:
+		}
+	}()
+
+	f.call(callCtx, c, fn)
+
+	f.mu.Lock()
+	if f.calls[key] == c {
+		delete(f.calls, key)
+	}
+	f.mu.Unlock()
+	cancel()
+	close(c.done)
+
+	return c.val, false, c.err
+}
+
+// leave removes a caller whose context is done. Once every caller has gone the
+// call is cancelled and the key released, so a later request starts afresh
+// rather than receiving the cancelled result.
+func (f *InFlight) leave(c *call) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c.waiters--
+	if c.waiters == 0 {
+		c.cancel()
+		if f.calls[c.key] == c {
+			delete(f.calls, c.key)
+		}
+	}
+}
+
+func (f *InFlight) call(ctx context.Context, c *call, fn func(context.Context) interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.val = nil
+			c.err = fmt.Errorf("The in-flight call panicked: %v", r)
+		}
+	}()
+	c.val = fn(ctx)
+}
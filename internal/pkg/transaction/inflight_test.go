@@ -0,0 +1,168 @@
+package transaction
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInFlightCollapsesDuplicates(t *testing.T) {
+	group := NewInFlight()
+	key := Key("https://pos.example.com", "register-1", "sale-1")
+
+	var calls int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	fn := func(context.Context) interface{} {
+		atomic.AddInt32(&calls, 1)
+		close(started)
+		<-release
+		return "ACCEPTED"
+	}
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 5)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], _, _ = group.Do(context.Background(), key, fn)
+	}()
+	<-started
+
+	for i := 1; i < len(results); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _, _ = group.Do(context.Background(), key, fn)
+		}(i)
+	}
+
+	// give the duplicates a chance to queue behind the first call
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("expected a single upstream call, got %d", calls)
+	}
+	for i, result := range results {
+		if result != "ACCEPTED" {
+			t.Errorf("caller %d got %v want ACCEPTED", i, result)
+		}
+	}
+}
+
+func TestInFlightSequentialCallsAreIndependent(t *testing.T) {
+	group := NewInFlight()
+	key := Key("https://pos.example.com", "register-1", "sale-2")
+
+	calls := 0
+	fn := func(context.Context) interface{} {
+		calls++
+		return calls
+	}
+
+	first, shared, _ := group.Do(context.Background(), key, fn)
+	if shared {
+		t.Error("first call should not be shared")
+	}
+	second, _, _ := group.Do(context.Background(), key, fn)
+
+	if first == second {
+		t.Errorf("expected a fresh call once the first completed, got %v twice", first)
+	}
+}
+
+func TestInFlightPanic(t *testing.T) {
+	group := NewInFlight()
+	key := Key("https://pos.example.com", "register-1", "sale-3")
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	fn := func(context.Context) interface{} {
+		close(started)
+		<-release
+		panic("gateway client bug")
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		_, _, err := group.Do(context.Background(), key, fn)
+		errs <- err
+	}()
+	<-started
+	go func() {
+		_, _, err := group.Do(context.Background(), key, func(context.Context) interface{} { return "ACCEPTED" })
+		errs <- err
+	}()
+
+	// give the duplicate a chance to queue behind the first call
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err == nil {
+			t.Error("expected the panic to be returned to every caller")
+		}
+	}
+
+	// the key is released once the call has panicked
+	if v, _, err := group.Do(context.Background(), key, func(context.Context) interface{} { return "ACCEPTED" }); err != nil || v != "ACCEPTED" {
+		t.Errorf("expected a fresh call got %v: %v", v, err)
+	}
+}
+
+// TestInFlightCancelled closes the window of the first request and then of its
+// duplicate, the call is only cancelled once both have gone
+func TestInFlightCancelled(t *testing.T) {
+	group := NewInFlight()
+	key := Key("https://pos.example.com", "register-1", "sale-4")
+
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	fn := func(ctx context.Context) interface{} {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return "FAILED"
+	}
+
+	first, closeFirst := context.WithCancel(context.Background())
+	go group.Do(first, key, fn)
+	<-started
+
+	duplicate, closeDuplicate := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, _, err := group.Do(duplicate, key, fn)
+		errs <- err
+	}()
+
+	// give the duplicate a chance to queue behind the first call
+	time.Sleep(50 * time.Millisecond)
+	closeFirst()
+	select {
+	case <-cancelled:
+		t.Fatal("expected the call to continue for the duplicate")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	closeDuplicate()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("expected the duplicate to stop waiting got %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("expected the call to be cancelled once every caller had gone")
+	}
+
+	// the key is released so a later request isn't handed the cancelled result
+	if v, shared, _ := group.Do(context.Background(), key, func(context.Context) interface{} { return "ACCEPTED" }); v != "ACCEPTED" || shared {
+		t.Errorf("expected a fresh call got %v", v)
+	}
+}
@@ -0,0 +1,166 @@
+package transaction
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/metrics"
+	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultReconcileBackoff is the wait before the first reconciliation attempt,
+	// it doubles for each attempt after that
+	DefaultReconcileBackoff = 5 * time.Second
+	// DefaultReconcileAttempts is the number of times the authorisation is replayed
+	// before it is left for manual review
+	DefaultReconcileAttempts = 5
+	// approvedCode is recorded when a replay shows the original was approved
+	approvedCode = "SPRA01"
+)
+
+// alreadyProcessed are the codes Oxipay answers a replay with when the original
+// request may have been processed. FPRA22 is also the decline for a Payment
+// Code spent on another sale, so the replay is only trusted as an approval
+// when Oxipay includes the purchase it was processed as.
+var alreadyProcessed = map[string]bool{
+	"FPRA07": true, // the PosTransactionRef has already been processed
+	"FPRA22": true, // the Payment Code has already been used
+}
+
+// Reconciler resolves authorisations whose response from Oxipay was lost.
+//
+// The Oxipay POS API doesn't have a status query, so the signed authorisation
+// is replayed instead. Oxipay rejects a PosTransactionRef or Payment Code it
+// has already processed, which means a replay can't charge the customer twice.
+type Reconciler struct {
+	Ledger      *Ledger
+	Log         *logrus.Logger
+	Backoff     time.Duration
+	MaxAttempts int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewReconciler returns a Reconciler using the default backoff and attempts
+func NewReconciler(ledger *Ledger, log *logrus.Logger) *Reconciler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Reconciler{
+		Ledger:      ledger,
+		Log:         log,
+		Backoff:     DefaultReconcileBackoff,
+		MaxAttempts: DefaultReconcileAttempts,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Reconcile marks the transaction as UNKNOWN and resolves it in the background
+// by replaying the payload to the gateway the original was sent to. The
+// payload must be signed with signingKey. The reconciliation outlives ctx, it
+// only carries the request ID to the replays.
+func (rc *Reconciler) Reconcile(ctx context.Context, client oxipay.Client, txn *Transaction, payload *oxipay.AuthorisationPayload, signingKey string) error {
+	txn.Status = StatusUnknown
+	if err := rc.Ledger.Complete(txn); err != nil {
+		return err
+	}
+
+	// the caller keeps using txn, so work on a copy
+	pending := *txn
+	rc.wg.Add(1)
+	go func() {
+		defer rc.wg.Done()
+		rc.resolve(oxipay.WithRequestID(rc.ctx, oxipay.RequestID(ctx)), client, &pending, payload, signingKey)
+	}()
+	return nil
+}
+
+// Stop cancels any reconciliation that is still in progress and waits up to
+// the context deadline for them to be recorded. Transactions that are still
+// unresolved are left for manual review.
+func (rc *Reconciler) Stop(ctx context.Context) error {
+	rc.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		rc.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (rc *Reconciler) resolve(ctx context.Context, client oxipay.Client, txn *Transaction, payload *oxipay.AuthorisationPayload, signingKey string) {
+	contextLogger := rc.Log.WithFields(logrus.Fields{
+		"module":         "reconcile",
+		"call":           "resolve",
+		"transaction_id": txn.ID,
+		"request_id":     oxipay.RequestID(ctx),
+	})
+
+	backoff := rc.Backoff
+	for attempt := 1; attempt <= rc.MaxAttempts; attempt++ {
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			rc.review(txn, "Reconciliation was stopped before Oxipay confirmed the outcome", contextLogger)
+			return
+		}
+		backoff *= 2
+
+		response, err := client.ProcessAuthorisationWithContext(ctx, payload)
+		if err != nil {
+			contextLogger.Warnf("Attempt %d of %d failed: %s", attempt, rc.MaxAttempts, err)
+			continue
+		}
+
+		if valid, err := response.Authenticate(signingKey); !valid || err != nil {
+			metrics.SignatureFailures.Inc()
+			contextLogger.Warnf("Attempt %d of %d returned an invalid signature", attempt, rc.MaxAttempts)
+			continue
+		}
+
+		txn.Code = response.Code
+		txn.PurchaseNumber = response.PurchaseNumber
+		txn.Message = response.Message
+		txn.Status = oxipay.ProcessAuthorisationResponses()(response.Code).TxnStatus
+		if alreadyProcessed[response.Code] {
+			if response.PurchaseNumber == "" {
+				// without the purchase the code can't be told apart from a
+				// decline, so it is left for an operator to check
+				rc.review(txn, "Oxipay refused the replay with "+response.Code+", check the Oxipay portal for the PosTransactionRef", contextLogger)
+				return
+			}
+			txn.Code = approvedCode
+			txn.Status = oxipay.StatusApproved
+			txn.Message = "Approved by the original request, Oxipay refused the replay with " + response.Code
+		}
+		if err = rc.Ledger.Complete(txn); err != nil {
+			contextLogger.Error(err)
+			return
+		}
+		contextLogger.Infof("Reconciled as %s after %d attempts", txn.Status, attempt)
+		return
+	}
+
+	rc.review(txn, "Oxipay could not be reached to confirm the outcome", contextLogger)
+}
+
+// review records that the outcome could not be determined
+func (rc *Reconciler) review(txn *Transaction, message string, contextLogger *logrus.Entry) {
+	txn.Status = StatusError
+	txn.Message = message
+	if err := rc.Ledger.Complete(txn); err != nil {
+		contextLogger.Error(err)
+	}
+	contextLogger.Errorf("%s, manual review required", message)
+}
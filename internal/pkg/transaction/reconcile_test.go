@@ -0,0 +1,172 @@
+package transaction
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
+	"github.com/sirupsen/logrus"
+)
+
+const testSigningKey = "signing-key"
+
+// replayClient answers each replayed authorisation with the next reply
+type replayClient struct {
+	oxipay.Client
+
+	mu      sync.Mutex
+	replies []reply
+	replays int
+}
+
+type reply struct {
+	code string
+	// purchase is the purchase number Oxipay includes, SPRA01 always has one
+	purchase string
+	err      error
+}
+
+func (c *replayClient) ProcessAuthorisationWithContext(ctx context.Context, payload *oxipay.AuthorisationPayload) (*oxipay.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.replays++
+	if len(c.replies) == 0 {
+		return nil, errors.New("Connection refused")
+	}
+	next := c.replies[0]
+	c.replies = c.replies[1:]
+	if next.err != nil {
+		return nil, next.err
+	}
+
+	response := &oxipay.Response{Code: next.code, Message: "Replayed", PurchaseNumber: next.purchase}
+	if next.code == "SPRA01" {
+		response.PurchaseNumber = "52000001"
+	}
+	response.Signature = oxipay.SignMessage(oxipay.GeneratePlainTextSignature(response), testSigningKey)
+	return response, nil
+}
+
+func (c *replayClient) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.replays
+}
+
+func newReconciler(t *testing.T) *Reconciler {
+	rc := NewReconciler(newLedger(t), logrus.New())
+	rc.Backoff = time.Millisecond
+	rc.MaxAttempts = 3
+	return rc
+}
+
+// reconcile starts reconciling a pending authorisation and waits for it to finish
+func reconcile(t *testing.T, rc *Reconciler, client oxipay.Client) *Transaction {
+	txn := record(t, rc.Ledger, &Transaction{Type: TypeAuthorisation, SaleID: "sale-1", Amount: 4400}, StatusPending)
+
+	if err := rc.Reconcile(context.Background(), client, txn, &oxipay.AuthorisationPayload{}, testSigningKey); err != nil {
+		t.Fatal(err)
+	}
+	if txn.Status != StatusUnknown {
+		t.Errorf("expected the transaction to be UNKNOWN while it is reconciled got %s", txn.Status)
+	}
+	rc.wg.Wait()
+
+	got, err := rc.Ledger.Get(txn.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestReconcile(t *testing.T) {
+	rc := newReconciler(t)
+	client := &replayClient{replies: []reply{{err: errors.New("Connection reset")}, {code: "SPRA01"}}}
+
+	txn := reconcile(t, rc, client)
+	if txn.Status != oxipay.StatusApproved || txn.PurchaseNumber != "52000001" || client.count() != 2 {
+		t.Errorf("expected the second replay to approve the payment got %+v after %d replays", txn, client.count())
+	}
+}
+
+func TestReconcileDeclined(t *testing.T) {
+	rc := newReconciler(t)
+
+	txn := reconcile(t, rc, &replayClient{replies: []reply{{code: "FPRA21"}}})
+	if txn.Status != oxipay.StatusDeclined || txn.Code != "FPRA21" {
+		t.Errorf("expected the payment to be declined got %+v", txn)
+	}
+}
+
+// TestReconcileAlreadyProcessed replays a payment that Oxipay approved before
+// the response was lost
+func TestReconcileAlreadyProcessed(t *testing.T) {
+	for _, code := range []string{"FPRA07", "FPRA22"} {
+		rc := newReconciler(t)
+
+		txn := reconcile(t, rc, &replayClient{replies: []reply{{code: code, purchase: "52000001"}}})
+		if txn.Status != oxipay.StatusApproved || txn.Code != approvedCode || txn.PurchaseNumber != "52000001" {
+			t.Errorf("%s: expected the payment to be approved got %+v", code, txn)
+		}
+	}
+}
+
+// TestReconcileSpentPaymentCode replays a payment whose code was already spent
+// on another sale, which Oxipay declines with FPRA22 and no purchase
+func TestReconcileSpentPaymentCode(t *testing.T) {
+	rc := newReconciler(t)
+
+	txn := reconcile(t, rc, &replayClient{replies: []reply{{code: "FPRA22"}}})
+	if txn.Status != StatusError || !strings.Contains(txn.Message, "Oxipay portal") {
+		t.Errorf("expected the payment to need review got %+v", txn)
+	}
+}
+
+func TestReconcileUnreachable(t *testing.T) {
+	rc := newReconciler(t)
+	client := &replayClient{}
+
+	txn := reconcile(t, rc, client)
+	if txn.Status != StatusError || client.count() != rc.MaxAttempts {
+		t.Errorf("expected review after %d replays got %+v after %d", rc.MaxAttempts, txn, client.count())
+	}
+}
+
+func TestReconcileInvalidSignature(t *testing.T) {
+	rc := newReconciler(t)
+	client := &replayClient{replies: []reply{{code: "SPRA01"}}}
+
+	txn := record(t, rc.Ledger, &Transaction{Type: TypeAuthorisation, SaleID: "sale-1", Amount: 4400}, StatusPending)
+	if err := rc.Reconcile(context.Background(), client, txn, &oxipay.AuthorisationPayload{}, "other-key"); err != nil {
+		t.Fatal(err)
+	}
+	rc.wg.Wait()
+
+	// a response that isn't signed with the device key isn't trusted
+	if got, err := rc.Ledger.Get(txn.ID); err != nil || got.Status != StatusError {
+		t.Errorf("expected the payment to need review got %+v: %v", got, err)
+	}
+}
+
+func TestReconcileStop(t *testing.T) {
+	rc := newReconciler(t)
+	rc.Backoff = time.Hour
+	client := &replayClient{replies: []reply{{code: "SPRA01"}}}
+
+	txn := record(t, rc.Ledger, &Transaction{Type: TypeAuthorisation, SaleID: "sale-1", Amount: 4400}, StatusPending)
+	if err := rc.Reconcile(context.Background(), client, txn, &oxipay.AuthorisationPayload{}, testSigningKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := rc.Ledger.Get(txn.ID)
+	if err != nil || got.Status != StatusError || client.count() != 0 {
+		t.Errorf("expected a stopped reconciliation to need review without a replay got %+v after %d: %v", got, client.count(), err)
+	}
+}
@@ -0,0 +1,497 @@
+package transaction
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/database"
+	"github.com/oxipay/oxipay-vend/internal/pkg/metrics"
+	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
+	shortid "github.com/ventu-io/go-shortid"
+)
+
+const (
+	// TypeAuthorisation a call to ProcessAuthorisation
+	TypeAuthorisation = "AUTHORISATION"
+	// TypeAdjustment a call to ProcessSalesAdjustment
+	TypeAdjustment = "ADJUSTMENT"
+)
+
+const (
+	// StatusPending the request has been recorded but Oxipay has not responded yet
+	StatusPending = "PENDING"
+	// StatusError the gateway could not be reached or the response could not be trusted
+	StatusError = "ERROR"
+	// StatusUnknown the request reached Oxipay but the response was lost, the
+	// outcome is being reconciled
+	StatusUnknown = "UNKNOWN"
+)
+
+// ErrNotFound no transaction matches the ID
+var ErrNotFound = errors.New("Unable to find a matching transaction ")
+
+// ErrExceedsBalance the adjustment is more than the refundable balance of the purchase
+var ErrExceedsBalance = errors.New("The refund is more than the balance remaining on the purchase")
+
+// refundLockTimeout is how long to wait for another refund of the same purchase
+const refundLockTimeout = 10 * time.Second
+
+// querier is satisfied by *sql.DB and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Transaction is a single request sent to Oxipay on behalf of a Vend sale
+type Transaction struct {
+	ID                string
+	Type              string
+	SaleID            string // Vend Sale ID
+	Origin            string // Vend Website
+	VendRegisterID    string
+	FxlRegisterID     string // Oxipay Device ID
+	FxlSellerID       string // Oxipay Merchant No
+	Amount            int64  // Amount in cents
+	PosTransactionRef string
+	PurchaseNumber    string // x_purchase_number returned by Oxipay
+	Code              string // x_code returned by Oxipay
+	Status            string // TxnStatus mapped from the Oxipay x_code
+	Message           string
+	CreatedDate       time.Time
+	ModifiedDate      time.Time
+}
+
+// Ledger records every request sent to Oxipay
+type Ledger struct {
+	Db     *sql.DB
+	Driver string
+	// OnComplete is called with each outcome recorded by Complete
+	OnComplete func(txn *Transaction)
+}
+
+// NewLedger Used to marshall the DB connection
+func NewLedger(driver string, db *sql.DB) *Ledger {
+	return &Ledger{
+		Db:     db,
+		Driver: driver,
+	}
+}
+
+// Begin records the transaction as pending before it is sent to Oxipay
+func (l Ledger) Begin(txn *Transaction) error {
+	return l.begin(context.Background(), l.Db, txn)
+}
+
+// BeginRefund records an adjustment as pending once the refundable balance of
+// its purchase covers it, and returns the balance before the adjustment. The
+// balance is checked and the adjustment recorded while holding a database lock
+// on the purchase, so refunds from proxies sharing the database can't both
+// spend it. ErrExceedsBalance is returned when the balance doesn't cover the
+// adjustment. Purchases that weren't authorised through the proxy can't be
+// checked, the adjustment is recorded and found is false.
+func (l Ledger) BeginRefund(txn *Transaction) (remaining int64, found bool, err error) {
+	ctx := context.Background()
+	conn, err := l.Db.Conn(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer conn.Close()
+
+	// the lock is per purchase, MySQL limits lock names to 64 characters
+	lockName := fmt.Sprintf("oxipay_vend_refund_%x", sha1.Sum([]byte(txn.FxlSellerID+"|"+txn.PurchaseNumber)))
+	if l.Driver == database.DriverMySQL {
+		var locked sql.NullInt64
+		err = conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, lockName, int(refundLockTimeout.Seconds())).Scan(&locked)
+		if err == nil && locked.Int64 != 1 {
+			err = errors.New("Timed out waiting for another refund of the purchase")
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		// released once the adjustment has been committed
+		defer conn.ExecContext(ctx, `SELECT RELEASE_LOCK(?)`, lockName)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	if l.Driver == database.DriverPostgres {
+		// released when the transaction ends
+		lockCtx, cancel := context.WithTimeout(ctx, refundLockTimeout)
+		_, err = tx.ExecContext(lockCtx, `SELECT pg_advisory_xact_lock(hashtext($1))`, lockName)
+		cancel()
+		if err != nil {
+			tx.Rollback()
+			return 0, false, err
+		}
+	}
+	// SQLite has a single connection, so the transaction is serialised already
+
+	remaining, err = l.refundableBalance(ctx, tx, txn.FxlSellerID, txn.PurchaseNumber)
+	found = err != ErrNotFound
+	if err == ErrNotFound {
+		err = nil
+	}
+	if err == nil && found && txn.Amount > remaining {
+		err = ErrExceedsBalance
+	}
+	if err == nil {
+		err = l.begin(ctx, tx, txn)
+	}
+	if err != nil {
+		tx.Rollback()
+		return remaining, found, err
+	}
+	return remaining, found, tx.Commit()
+}
+
+func (l Ledger) begin(ctx context.Context, q querier, txn *Transaction) error {
+	var err error
+
+	if txn.ID == "" {
+		txn.ID, err = shortid.Generate()
+		if err != nil {
+			return err
+		}
+	}
+	txn.Status = StatusPending
+	txn.CreatedDate = time.Now()
+
+	query := `INSERT INTO
+		oxipay_vend_transaction
+		(
+			id,
+			txn_type,
+			vend_sale_id,
+			origin_domain,
+			vend_register_id,
+			fxl_register_id,
+			fxl_seller_id,
+			amount,
+			pos_transaction_ref,
+			purchase_number,
+			txn_status,
+			created_date
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) `
+
+	_, err = q.ExecContext(ctx,
+		database.Rebind(l.Driver, query),
+		txn.ID,
+		txn.Type,
+		newNullString(txn.SaleID),
+		txn.Origin,
+		txn.VendRegisterID,
+		txn.FxlRegisterID,
+		txn.FxlSellerID,
+		txn.Amount,
+		txn.PosTransactionRef,
+		newNullString(txn.PurchaseNumber),
+		txn.Status,
+		txn.CreatedDate,
+	)
+
+	return err
+}
+
+// Complete records the outcome of the gateway call against a transaction
+// previously saved with Begin. Each outcome is counted in the metrics, so a
+// payment that was UNKNOWN is counted again once it has been reconciled.
+func (l Ledger) Complete(txn *Transaction) error {
+	if txn.ID == "" {
+		return errors.New("Unable to complete a transaction that has not begun")
+	}
+	txn.ModifiedDate = time.Now()
+
+	query := `UPDATE
+			oxipay_vend_transaction
+		SET
+			purchase_number = ?,
+			oxipay_code = ?,
+			txn_status = ?,
+			message = ?,
+			modified_date = ?
+		WHERE
+			id = ?`
+
+	result, err := l.Db.Exec(
+		database.Rebind(l.Driver, query),
+		newNullString(txn.PurchaseNumber),
+		newNullString(txn.Code),
+		txn.Status,
+		newNullString(txn.Message),
+		txn.ModifiedDate,
+		txn.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err == nil && affected < 1 {
+		return ErrNotFound
+	}
+	if err == nil {
+		metrics.ObserveTransaction(txn.Type, txn.Status, txn.Code)
+		if l.OnComplete != nil {
+			l.OnComplete(txn)
+		}
+	}
+	return err
+}
+
+// Get returns a single transaction
+func (l Ledger) Get(id string) (*Transaction, error) {
+	query := `SELECT ` + columns + `
+		FROM
+			oxipay_vend_transaction
+		WHERE
+			id = ?`
+
+	rows, err := l.Db.Query(database.Rebind(l.Driver, query), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotFound
+	}
+	return scan(rows)
+}
+
+// GetBySale returns every transaction recorded for a Vend sale, oldest first
+func (l Ledger) GetBySale(originDomain string, vendRegisterID string, saleID string) ([]*Transaction, error) {
+	query := `SELECT ` + columns + `
+		FROM
+			oxipay_vend_transaction
+		WHERE
+			origin_domain = ?
+		AND
+			vend_register_id = ?
+		AND
+			vend_sale_id = ?
+		ORDER BY created_date`
+
+	rows, err := l.Db.Query(database.Rebind(l.Driver, query), originDomain, vendRegisterID, saleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var txns []*Transaction
+	for rows.Next() {
+		txn, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		txns = append(txns, txn)
+	}
+
+	return txns, rows.Err()
+}
+
+// GetApprovedAuthorisation returns the authorisation Oxipay approved for a Vend
+// sale, or nil if the sale has not been paid
+func (l Ledger) GetApprovedAuthorisation(originDomain string, vendRegisterID string, saleID string) (*Transaction, error) {
+	return l.authorisationWithStatus(originDomain, vendRegisterID, saleID, oxipay.StatusApproved)
+}
+
+// GetPurchase returns the approved authorisation for a Vend sale paid on any
+// register of the Vend website, or nil if the sale wasn't paid through the proxy
+func (l Ledger) GetPurchase(originDomain string, saleID string) (*Transaction, error) {
+	query := `SELECT ` + columns + `
+		FROM
+			oxipay_vend_transaction
+		WHERE
+			origin_domain = ?
+		AND
+			vend_sale_id = ?
+		AND
+			txn_type = ?
+		AND
+			txn_status = ?
+		ORDER BY created_date`
+
+	rows, err := l.Db.Query(
+		database.Rebind(l.Driver, query),
+		originDomain,
+		saleID,
+		TypeAuthorisation,
+		oxipay.StatusApproved,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	return scan(rows)
+}
+
+// GetUnknownAuthorisation returns the authorisation for a Vend sale that is
+// still being reconciled, or nil if there isn't one
+func (l Ledger) GetUnknownAuthorisation(originDomain string, vendRegisterID string, saleID string) (*Transaction, error) {
+	return l.authorisationWithStatus(originDomain, vendRegisterID, saleID, StatusUnknown)
+}
+
+// GetPendingAuthorisation returns the authorisation for a Vend sale that is
+// waiting on Oxipay, which may have been sent by another instance of the
+// proxy, or nil if there isn't one
+func (l Ledger) GetPendingAuthorisation(originDomain string, vendRegisterID string, saleID string) (*Transaction, error) {
+	return l.authorisationWithStatus(originDomain, vendRegisterID, saleID, StatusPending)
+}
+
+// RefundableBalance returns the amount of the approved authorisation for an
+// Oxipay purchase, in cents, less the adjustments made against it. Adjustments
+// that are still waiting on Oxipay are deducted too, so two refunds can't both
+// spend the same balance. ErrNotFound is returned when the purchase wasn't
+// authorised through the proxy.
+func (l Ledger) RefundableBalance(sellerID string, purchaseNumber string) (int64, error) {
+	return l.refundableBalance(context.Background(), l.Db, sellerID, purchaseNumber)
+}
+
+func (l Ledger) refundableBalance(ctx context.Context, q querier, sellerID string, purchaseNumber string) (int64, error) {
+	query := `SELECT ` + columns + `
+		FROM
+			oxipay_vend_transaction
+		WHERE
+			fxl_seller_id = ?
+		AND
+			purchase_number = ?
+		ORDER BY created_date`
+
+	rows, err := q.QueryContext(ctx, database.Rebind(l.Driver, query), sellerID, purchaseNumber)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var authorised, refunded int64
+	found := false
+	for rows.Next() {
+		txn, err := scan(rows)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case txn.Type == TypeAuthorisation && txn.Status == oxipay.StatusApproved:
+			authorised += txn.Amount
+			found = true
+		case txn.Type == TypeAdjustment && refunding[txn.Status]:
+			refunded += txn.Amount
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, ErrNotFound
+	}
+	return authorised - refunded, nil
+}
+
+// refunding are the adjustment statuses deducted from the refundable balance
+var refunding = map[string]bool{
+	oxipay.StatusApproved: true,
+	StatusPending:         true,
+	StatusUnknown:         true,
+}
+
+func (l Ledger) authorisationWithStatus(originDomain string, vendRegisterID string, saleID string, status string) (*Transaction, error) {
+	txns, err := l.GetBySale(originDomain, vendRegisterID, saleID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, txn := range txns {
+		if txn.Type == TypeAuthorisation && txn.Status == status {
+			return txn, nil
+		}
+	}
+	return nil, nil
+}
+
+// columns are selected in the order expected by scan
+const columns = `
+			id,
+			txn_type,
+			vend_sale_id,
+			origin_domain,
+			vend_register_id,
+			fxl_register_id,
+			fxl_seller_id,
+			amount,
+			pos_transaction_ref,
+			purchase_number,
+			oxipay_code,
+			txn_status,
+			message,
+			created_date,
+			modified_date`
+
+func scan(rows *sql.Rows) (*Transaction, error) {
+	var saleID, purchaseNumber, code, message sql.NullString
+	var modified nullTime
+
+	txn := new(Transaction)
+	err := rows.Scan(
+		&txn.ID,
+		&txn.Type,
+		&saleID,
+		&txn.Origin,
+		&txn.VendRegisterID,
+		&txn.FxlRegisterID,
+		&txn.FxlSellerID,
+		&txn.Amount,
+		&txn.PosTransactionRef,
+		&purchaseNumber,
+		&code,
+		&txn.Status,
+		&message,
+		&txn.CreatedDate,
+		&modified,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	txn.SaleID = saleID.String
+	txn.PurchaseNumber = purchaseNumber.String
+	txn.Code = code.String
+	txn.Message = message.String
+	txn.ModifiedDate = modified.Time
+
+	return txn, nil
+}
+
+// nullTime represents a time.Time that may be NULL in the database
+type nullTime struct {
+	Time  time.Time
+	Valid bool
+}
+
+// Scan implements the sql.Scanner interface
+func (nt *nullTime) Scan(value interface{}) error {
+	nt.Time, nt.Valid = value.(time.Time)
+	return nil
+}
+
+func newNullString(s string) sql.NullString {
+	if len(s) == 0 {
+		return sql.NullString{}
+	}
+	return sql.NullString{
+		String: s,
+		Valid:  true,
+	}
+}
@@ -0,0 +1,245 @@
+package transaction
+
+import (
+	"database/sql"
+	"sync"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/oxipay/oxipay-vend/internal/pkg/database"
+	"github.com/oxipay/oxipay-vend/internal/pkg/migrate"
+	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
+)
+
+func newLedger(t *testing.T) *Ledger {
+	db, err := sql.Open(database.DriverSQLite, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: is a new database
+	db.SetMaxOpenConns(1)
+
+	migrator, err := migrate.NewMigrator(database.DriverSQLite, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	return NewLedger(database.DriverSQLite, db)
+}
+
+// record begins a transaction and completes it with the status, unless the
+// status is PENDING
+func record(t *testing.T, ledger *Ledger, txn *Transaction, status string) *Transaction {
+	if txn.Origin == "" {
+		txn.Origin = "https://pos.example.com"
+		txn.VendRegisterID = "register-1"
+		txn.FxlRegisterID = "device-1"
+		txn.FxlSellerID = "30188105"
+	}
+	if err := ledger.Begin(txn); err != nil {
+		t.Fatal(err)
+	}
+	if status == StatusPending {
+		return txn
+	}
+	txn.Status = status
+	if err := ledger.Complete(txn); err != nil {
+		t.Fatal(err)
+	}
+	return txn
+}
+
+func TestBeginAndComplete(t *testing.T) {
+	ledger := newLedger(t)
+
+	var completed []*Transaction
+	ledger.OnComplete = func(txn *Transaction) {
+		completed = append(completed, txn)
+	}
+
+	txn := record(t, ledger, &Transaction{
+		Type:              TypeAuthorisation,
+		SaleID:            "sale-1",
+		Amount:            4400,
+		PosTransactionRef: "sale-1",
+	}, StatusPending)
+
+	got, err := ledger.Get(txn.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != StatusPending || got.Amount != 4400 || !got.ModifiedDate.IsZero() {
+		t.Errorf("expected a pending transaction got %+v", got)
+	}
+
+	txn.Status = oxipay.StatusApproved
+	txn.PurchaseNumber = "52000001"
+	txn.Code = "SPRA01"
+	if err = ledger.Complete(txn); err != nil {
+		t.Fatal(err)
+	}
+	if len(completed) != 1 || completed[0] != txn {
+		t.Errorf("expected OnComplete to be called with the transaction got %v", completed)
+	}
+
+	got, err = ledger.Get(txn.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != oxipay.StatusApproved || got.PurchaseNumber != "52000001" || got.Code != "SPRA01" {
+		t.Errorf("expected the outcome to be recorded got %+v", got)
+	}
+
+	if _, err = ledger.Get("missing"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound got %v", err)
+	}
+	if err = ledger.Complete(&Transaction{ID: "missing", Status: StatusError}); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound completing a missing transaction got %v", err)
+	}
+	if err = ledger.Complete(&Transaction{Status: StatusError}); err == nil {
+		t.Error("expected an error completing a transaction that has not begun")
+	}
+}
+
+func TestGetBySale(t *testing.T) {
+	ledger := newLedger(t)
+
+	declined := record(t, ledger, &Transaction{Type: TypeAuthorisation, SaleID: "sale-1", Amount: 4400}, oxipay.StatusDeclined)
+	unknown := record(t, ledger, &Transaction{Type: TypeAuthorisation, SaleID: "sale-1", Amount: 4400}, StatusUnknown)
+
+	txns, err := ledger.GetBySale("https://pos.example.com", "register-1", "sale-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txns) != 2 || txns[0].ID != declined.ID || txns[1].ID != unknown.ID {
+		t.Errorf("expected both attempts oldest first got %v", txns)
+	}
+
+	if txn, err := ledger.GetApprovedAuthorisation("https://pos.example.com", "register-1", "sale-1"); err != nil || txn != nil {
+		t.Errorf("expected no approved authorisation got %v: %v", txn, err)
+	}
+	if txn, err := ledger.GetUnknownAuthorisation("https://pos.example.com", "register-1", "sale-1"); err != nil || txn == nil || txn.ID != unknown.ID {
+		t.Errorf("expected the unknown authorisation got %v: %v", txn, err)
+	}
+
+	unknown.Status = oxipay.StatusApproved
+	unknown.PurchaseNumber = "52000001"
+	if err = ledger.Complete(unknown); err != nil {
+		t.Fatal(err)
+	}
+
+	// the purchase can be found from any register of the website
+	txn, err := ledger.GetPurchase("https://pos.example.com", "sale-1")
+	if err != nil || txn == nil || txn.PurchaseNumber != "52000001" {
+		t.Errorf("expected the approved purchase got %v: %v", txn, err)
+	}
+	if txn, err = ledger.GetPurchase("https://other.example.com", "sale-1"); err != nil || txn != nil {
+		t.Errorf("expected no purchase for another website got %v: %v", txn, err)
+	}
+}
+
+func TestRefundableBalance(t *testing.T) {
+	ledger := newLedger(t)
+
+	if _, err := ledger.RefundableBalance("30188105", "52000001"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for a purchase that wasn't authorised through the proxy got %v", err)
+	}
+
+	record(t, ledger, &Transaction{Type: TypeAuthorisation, SaleID: "sale-1", Amount: 10000, PurchaseNumber: "52000001"}, oxipay.StatusApproved)
+
+	adjustments := []struct {
+		amount int64
+		status string
+		// remaining is the balance after the adjustment
+		remaining int64
+	}{
+		// a partial refund
+		{2500, oxipay.StatusApproved, 7500},
+		// declined and failed refunds don't spend the balance
+		{1000, oxipay.StatusDeclined, 7500},
+		{1000, StatusError, 7500},
+		// refunds waiting on Oxipay do, so two refunds can't spend the same balance
+		{2000, StatusPending, 5500},
+		{500, StatusUnknown, 5000},
+	}
+	for _, a := range adjustments {
+		record(t, ledger, &Transaction{
+			Type:           TypeAdjustment,
+			SaleID:         "refund-1",
+			Amount:         a.amount,
+			PurchaseNumber: "52000001",
+		}, a.status)
+
+		remaining, err := ledger.RefundableBalance("30188105", "52000001")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if remaining != a.remaining {
+			t.Errorf("expected %d remaining after a %s refund of %d got %d", a.remaining, a.status, a.amount, remaining)
+		}
+	}
+
+	// purchase numbers are only unique for a merchant
+	if _, err := ledger.RefundableBalance("30188106", "52000001"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for another merchant got %v", err)
+	}
+}
+
+// TestBeginRefund sends refunds of the same purchase from two ledgers sharing
+// the database, like the AU and NZ proxies, only those the balance covers are
+// recorded
+func TestBeginRefund(t *testing.T) {
+	au := newLedger(t)
+	nz := NewLedger(database.DriverSQLite, au.Db)
+
+	refund := func(ledger *Ledger, purchaseNumber string, amount int64) (int64, bool, error) {
+		return ledger.BeginRefund(&Transaction{
+			Type:           TypeAdjustment,
+			SaleID:         "refund-1",
+			Origin:         "https://pos.example.com",
+			VendRegisterID: "register-1",
+			FxlRegisterID:  "device-1",
+			FxlSellerID:    "30188105",
+			Amount:         amount,
+			PurchaseNumber: purchaseNumber,
+		})
+	}
+
+	// purchases that weren't authorised through the proxy are refunded unchecked
+	if _, found, err := refund(au, "52000002", 4000); err != nil || found {
+		t.Errorf("expected an unchecked refund got found %t: %v", found, err)
+	}
+
+	record(t, au, &Transaction{Type: TypeAuthorisation, SaleID: "sale-1", Amount: 10000, PurchaseNumber: "52000001"}, oxipay.StatusApproved)
+
+	var mu sync.Mutex
+	recorded, declined := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(ledger *Ledger) {
+			defer wg.Done()
+			_, _, err := refund(ledger, "52000001", 4000)
+			mu.Lock()
+			defer mu.Unlock()
+			switch err {
+			case nil:
+				recorded++
+			case ErrExceedsBalance:
+				declined++
+			default:
+				t.Error(err)
+			}
+		}([]*Ledger{au, nz}[i%2])
+	}
+	wg.Wait()
+
+	if recorded != 2 || declined != 4 {
+		t.Errorf("expected 2 refunds of 4000 from a balance of 10000 got %d, %d declined", recorded, declined)
+	}
+	if remaining, err := au.RefundableBalance("30188105", "52000001"); err != nil || remaining != 2000 {
+		t.Errorf("expected 2000 remaining got %d: %v", remaining, err)
+	}
+}
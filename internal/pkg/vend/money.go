@@ -0,0 +1,126 @@
+package vend
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultMinorUnits is the number of decimal places used for a currency that
+// isn't listed in minorUnits
+const DefaultMinorUnits = 2
+
+// minorUnits is the number of decimal places of each currency, from ISO 4217
+var minorUnits = map[string]int{
+	"AUD": 2,
+	"NZD": 2,
+}
+
+// MinorUnits returns the number of decimal places used by the currency
+func MinorUnits(currency string) int {
+	if units, ok := minorUnits[strings.ToUpper(currency)]; ok {
+		return units
+	}
+	return DefaultMinorUnits
+}
+
+// Money is an exact amount in the minor unit of its currency, e.g. cents.
+// Amounts are never held as a float, so 0.29 is always 29 cents.
+type Money struct {
+	Minor    int64
+	Currency string
+}
+
+// NewMoney returns an amount of minor units, e.g. cents, in the currency
+func NewMoney(minor int64, currency string) Money {
+	return Money{Minor: minor, Currency: currency}
+}
+
+// ParseMoney parses a decimal amount such as "44.00" or "-10.5" as sent by
+// Vend. Amounts with more decimal places than the currency has are rejected
+// rather than rounded, unless the extra digits are zeros.
+func ParseMoney(amount string, currency string) (Money, error) {
+	value := strings.TrimSpace(amount)
+	negative := false
+	if strings.HasPrefix(value, "-") || strings.HasPrefix(value, "+") {
+		negative = value[0] == '-'
+		value = value[1:]
+	}
+
+	whole, fraction := value, ""
+	if i := strings.Index(value, "."); i >= 0 {
+		whole, fraction = value[:i], value[i+1:]
+	}
+	if whole == "" && fraction == "" {
+		return Money{}, fmt.Errorf("%q is not a valid amount", amount)
+	}
+	if !digits(whole) || !digits(fraction) {
+		return Money{}, fmt.Errorf("%q is not a valid amount", amount)
+	}
+
+	units := MinorUnits(currency)
+	if len(fraction) > units {
+		if strings.Trim(fraction[units:], "0") != "" {
+			return Money{}, fmt.Errorf("%q has more than %d decimal places", amount, units)
+		}
+		fraction = fraction[:units]
+	}
+	fraction += strings.Repeat("0", units-len(fraction))
+
+	minor, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("%q is not a valid amount", amount)
+	}
+	if negative {
+		minor = -minor
+	}
+	return NewMoney(minor, currency), nil
+}
+
+// Cents formats the amount in minor units, the format Oxipay expects
+func (m Money) Cents() string {
+	return strconv.FormatInt(m.Minor, 10)
+}
+
+// String formats the amount as a decimal for display in Vend, e.g. 44.00
+func (m Money) String() string {
+	units := MinorUnits(m.Currency)
+	minor := m.Minor
+	sign := ""
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+	if units == 0 {
+		return sign + strconv.FormatInt(minor, 10)
+	}
+
+	value := strconv.FormatInt(minor, 10)
+	if len(value) <= units {
+		value = strings.Repeat("0", units-len(value)+1) + value
+	}
+	return sign + value[:len(value)-units] + "." + value[len(value)-units:]
+}
+
+// Abs returns the amount without its sign, refunds are sent to Oxipay as a
+// positive amount
+func (m Money) Abs() Money {
+	if m.Minor < 0 {
+		return NewMoney(-m.Minor, m.Currency)
+	}
+	return m
+}
+
+// IsPositive reports whether the amount is a payment rather than a refund
+func (m Money) IsPositive() bool {
+	return m.Minor > 0
+}
+
+func digits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package vend
+
+import "testing"
+
+func TestParseMoney(t *testing.T) {
+	var valid = []struct {
+		amount string
+		minor  int64
+		vend   string
+	}{
+		{"44.00", 4400, "44.00"},
+		{"0.29", 29, "0.29"},
+		{"1.1", 110, "1.10"},
+		{"1.10000", 110, "1.10"},
+		{"-10.05", -1005, "-10.05"},
+		{"+3", 300, "3.00"},
+		{".5", 50, "0.50"},
+		{"4294967.95", 429496795, "4294967.95"},
+	}
+	for _, v := range valid {
+		money, err := ParseMoney(v.amount, "AUD")
+		if err != nil {
+			t.Errorf("%s: %s", v.amount, err)
+			continue
+		}
+		if money.Minor != v.minor || money.String() != v.vend {
+			t.Errorf("%s: expected %d (%s) got %d (%s)", v.amount, v.minor, v.vend, money.Minor, money)
+		}
+	}
+
+	var invalid = []string{"", "-", ".", "1.005", "12,50", "1e2", "NaN", "--1", "99999999999999999999"}
+	for _, amount := range invalid {
+		if _, err := ParseMoney(amount, "NZD"); err == nil {
+			t.Errorf("expected %q to be rejected", amount)
+		}
+	}
+}
+
+func TestMoneyFormat(t *testing.T) {
+	refund := NewMoney(-4401, "AUD")
+	if refund.Cents() != "-4401" || refund.Abs().Cents() != "4401" {
+		t.Errorf("unexpected cents %s %s", refund.Cents(), refund.Abs().Cents())
+	}
+	if refund.IsPositive() || !refund.Abs().IsPositive() {
+		t.Error("expected only the absolute amount to be positive")
+	}
+	if s := NewMoney(5, "").String(); s != "0.05" {
+		t.Errorf("expected 0.05 got %s", s)
+	}
+	if s := NewMoney(-5, "").String(); s != "-0.05" {
+		t.Errorf("expected -0.05 got %s", s)
+	}
+}
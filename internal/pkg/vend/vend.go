@@ -1,13 +1,15 @@
 package vend
 
-// PaymentRequest is the originating request from vend
+// PaymentRequest is the originating request from vend. Amount is the decimal
+// sent by Vend, it is parsed into Money once the currency of the register is
+// known. The request is kept in the session, so Amount stays a string for the
+// sessions saved before the amount was parsed to decode.
 type PaymentRequest struct {
-	SaleID      string
-	Amount      string
-	Origin      string
-	RegisterID  string
-	Code        string
-	AmountFloat float64
+	SaleID     string
+	Amount     string
+	Origin     string
+	RegisterID string
+	Code       string
 }
 
 // RefundRequest is the originating request from vend
@@ -17,5 +19,4 @@ type RefundRequest struct {
 	Origin         string
 	RegisterID     string
 	PurchaseNumber string
-	AmountFloat    float64
 }
@@ -0,0 +1,34 @@
+package vend
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+// TestSessionCompatibility decodes a payment request saved in a session by a
+// release that still kept the float amount
+func TestSessionCompatibility(t *testing.T) {
+	type earlierPaymentRequest struct {
+		SaleID      string
+		Amount      string
+		Origin      string
+		RegisterID  string
+		Code        string
+		AmountFloat float64
+	}
+
+	var saved bytes.Buffer
+	earlier := earlierPaymentRequest{Amount: "-10.00", Origin: "https://pos.example.com", RegisterID: "register-1", AmountFloat: -10}
+	if err := gob.NewEncoder(&saved).Encode(earlier); err != nil {
+		t.Fatal(err)
+	}
+
+	vReq := new(PaymentRequest)
+	if err := gob.NewDecoder(&saved).Decode(vReq); err != nil {
+		t.Fatalf("expected the earlier session to decode: %v", err)
+	}
+	if vReq.Amount != "-10.00" || vReq.RegisterID != "register-1" {
+		t.Errorf("expected the amount and register to be kept got %+v", vReq)
+	}
+}
@@ -0,0 +1,180 @@
+package webhook
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/database"
+)
+
+const (
+	// DeliveryPending the event is waiting to be delivered or retried
+	DeliveryPending = "PENDING"
+	// DeliveryDelivered the subscriber accepted the event
+	DeliveryDelivered = "DELIVERED"
+	// DeliveryFailed the event ran out of attempts
+	DeliveryFailed = "FAILED"
+)
+
+// Delivery is an event queued for a single subscriber
+type Delivery struct {
+	ID          string
+	URL         string
+	EventType   string
+	Payload     []byte
+	Attempts    int
+	NextAttempt time.Time
+	Status      string
+	LastError   string
+	CreatedDate time.Time
+}
+
+// Queue stores deliveries in the database so that they survive a restart
+type Queue struct {
+	Db     *sql.DB
+	Driver string
+}
+
+// NewQueue Used to marshall the DB connection
+func NewQueue(driver string, db *sql.DB) *Queue {
+	return &Queue{
+		Db:     db,
+		Driver: driver,
+	}
+}
+
+// Enqueue saves a new delivery as pending
+func (q *Queue) Enqueue(d *Delivery) error {
+	d.Status = DeliveryPending
+	d.CreatedDate = time.Now().UTC()
+	if d.NextAttempt.IsZero() {
+		d.NextAttempt = d.CreatedDate
+	}
+
+	query := `INSERT INTO
+		oxipay_vend_webhook
+		(
+			id,
+			subscriber_url,
+			event_type,
+			payload,
+			attempts,
+			next_attempt,
+			delivery_status,
+			created_date
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?) `
+
+	_, err := q.Db.Exec(
+		database.Rebind(q.Driver, query),
+		d.ID,
+		d.URL,
+		d.EventType,
+		string(d.Payload),
+		d.Attempts,
+		d.NextAttempt,
+		d.Status,
+		d.CreatedDate,
+	)
+	return err
+}
+
+// Due returns up to limit pending deliveries whose next attempt is before now,
+// oldest first
+func (q *Queue) Due(now time.Time, limit int) ([]*Delivery, error) {
+	query := `SELECT
+			id,
+			subscriber_url,
+			event_type,
+			payload,
+			attempts,
+			next_attempt,
+			delivery_status,
+			last_error,
+			created_date
+		FROM
+			oxipay_vend_webhook
+		WHERE
+			delivery_status = ?
+		AND
+			next_attempt <= ?
+		ORDER BY next_attempt
+		LIMIT ?`
+
+	rows, err := q.Db.Query(database.Rebind(q.Driver, query), DeliveryPending, now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*Delivery
+	for rows.Next() {
+		var payload string
+		var lastError sql.NullString
+
+		d := new(Delivery)
+		err = rows.Scan(
+			&d.ID,
+			&d.URL,
+			&d.EventType,
+			&payload,
+			&d.Attempts,
+			&d.NextAttempt,
+			&d.Status,
+			&lastError,
+			&d.CreatedDate,
+		)
+		if err != nil {
+			return nil, err
+		}
+		d.Payload = []byte(payload)
+		d.LastError = lastError.String
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// Update records the outcome of a delivery attempt
+func (q *Queue) Update(d *Delivery) error {
+	query := `UPDATE
+			oxipay_vend_webhook
+		SET
+			attempts = ?,
+			next_attempt = ?,
+			delivery_status = ?,
+			last_error = ?,
+			modified_date = ?
+		WHERE
+			id = ?`
+
+	var lastError sql.NullString
+	if d.LastError != "" {
+		lastError = sql.NullString{String: truncate(d.LastError, 255), Valid: true}
+	}
+
+	result, err := q.Db.Exec(
+		database.Rebind(q.Driver, query),
+		d.Attempts,
+		d.NextAttempt.UTC(),
+		d.Status,
+		lastError,
+		time.Now().UTC(),
+		d.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err == nil && affected < 1 {
+		return errors.New("Unable to find the webhook delivery " + d.ID)
+	}
+	return err
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
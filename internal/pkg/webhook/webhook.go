@@ -0,0 +1,400 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
+	"github.com/oxipay/oxipay-vend/internal/pkg/transaction"
+	"github.com/sirupsen/logrus"
+	shortid "github.com/ventu-io/go-shortid"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 of the body, hex encoded, using
+	// the subscriber's secret
+	SignatureHeader = "X-Oxipay-Signature"
+	// EventHeader carries the event type
+	EventHeader = "X-Oxipay-Event"
+	// DeliveryHeader carries the delivery ID, which stays the same across
+	// retries so that subscribers can ignore duplicates
+	DeliveryHeader = "X-Oxipay-Delivery"
+)
+
+const (
+	// DefaultInterval is how often the queue is checked for retries
+	DefaultInterval = 30 * time.Second
+	// DefaultBackoff is the wait before the first retry, it doubles for each retry
+	DefaultBackoff = 30 * time.Second
+	// DefaultMaxAttempts is the number of deliveries before an event is given up on
+	DefaultMaxAttempts = 8
+	// DefaultTimeout is how long a subscriber has to respond
+	DefaultTimeout = 10 * time.Second
+
+	// maxBackoff caps the wait between retries
+	maxBackoff = 6 * time.Hour
+	// batchSize is the number of deliveries sent on each pass of the queue
+	batchSize = 50
+)
+
+// Event is the JSON body sent to subscribers when a payment or refund completes
+type Event struct {
+	Type           string    `json:"type"`
+	TransactionID  string    `json:"transaction_id"`
+	SaleID         string    `json:"sale_id,omitempty"`
+	Origin         string    `json:"origin"`
+	RegisterID     string    `json:"register_id"`
+	MerchantID     string    `json:"merchant_id"`
+	PurchaseNumber string    `json:"purchase_number,omitempty"`
+	Amount         int64     `json:"amount"` // in cents
+	Status         string    `json:"status"`
+	Code           string    `json:"code,omitempty"`
+	Message        string    `json:"message,omitempty"`
+	Created        time.Time `json:"created"`
+}
+
+// eventTypes maps the ledger transaction types onto the event names
+var eventTypes = map[string]string{
+	transaction.TypeAuthorisation: "payment",
+	transaction.TypeAdjustment:    "refund",
+}
+
+// processed are the outcomes that are sent, a transaction that is still
+// pending, being reconciled or errored hasn't been processed by Oxipay
+var processed = map[string]bool{
+	oxipay.StatusApproved: true,
+	oxipay.StatusDeclined: true,
+	oxipay.StatusFailed:   true,
+}
+
+// NewEvent returns the event for a transaction, or false when the outcome
+// hasn't been decided by Oxipay
+func NewEvent(txn *transaction.Transaction) (*Event, bool) {
+	name, ok := eventTypes[txn.Type]
+	if !ok || !processed[txn.Status] {
+		return nil, false
+	}
+
+	return &Event{
+		Type:           name + "." + strings.ToLower(txn.Status),
+		TransactionID:  txn.ID,
+		SaleID:         txn.SaleID,
+		Origin:         txn.Origin,
+		RegisterID:     txn.VendRegisterID,
+		MerchantID:     txn.FxlSellerID,
+		PurchaseNumber: txn.PurchaseNumber,
+		Amount:         txn.Amount,
+		Status:         txn.Status,
+		Code:           txn.Code,
+		Message:        txn.Message,
+		Created:        txn.ModifiedDate.UTC(),
+	}, true
+}
+
+// Sign returns the signature of a body, it uses the same HMAC as the Oxipay
+// POS API
+func Sign(body []byte, secret string) string {
+	return oxipay.SignMessage(string(body), secret)
+}
+
+// Subscriber is an endpoint the events are POSTed to
+type Subscriber struct {
+	URL    string
+	Secret string
+	Events []string
+}
+
+// Wants reports whether the subscriber receives the event type
+func (s Subscriber) Wants(eventType string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Dispatcher queues an event for each subscriber when a transaction completes
+// and delivers them in the background. Failed deliveries are retried with a
+// backoff until MaxAttempts, the queue is in the database so retries survive a
+// restart.
+type Dispatcher struct {
+	Queue       *Queue
+	Subscribers []Subscriber
+	Client      *http.Client
+	Log         *logrus.Logger
+	Interval    time.Duration
+	Backoff     time.Duration
+	MaxAttempts int
+
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewDispatcher returns a Dispatcher using the default interval, backoff and attempts
+func NewDispatcher(queue *Queue, subscribers []Subscriber, log *logrus.Logger) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Dispatcher{
+		Queue:       queue,
+		Subscribers: subscribers,
+		Client:      &http.Client{Timeout: DefaultTimeout},
+		Log:         log,
+		Interval:    DefaultInterval,
+		Backoff:     DefaultBackoff,
+		MaxAttempts: DefaultMaxAttempts,
+		wake:        make(chan struct{}, 1),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// FromConfig returns a Dispatcher for the webhook configuration
+func FromConfig(webhookConfig config.WebhookConfig, queue *Queue, log *logrus.Logger) (*Dispatcher, error) {
+	var subscribers []Subscriber
+	for i, s := range webhookConfig.Subscribers {
+		if s.URL == "" || s.Secret == "" {
+			return nil, fmt.Errorf("webhooks.subscribers[%d] needs a url and a secret", i)
+		}
+		subscribers = append(subscribers, Subscriber{URL: s.URL, Secret: s.Secret, Events: s.Events})
+	}
+
+	d := NewDispatcher(queue, subscribers, log)
+
+	durations := []struct {
+		name  string
+		value string
+		set   func(time.Duration)
+	}{
+		{"webhooks.interval", webhookConfig.Interval, func(v time.Duration) { d.Interval = v }},
+		{"webhooks.backoff", webhookConfig.Backoff, func(v time.Duration) { d.Backoff = v }},
+		{"webhooks.timeout", webhookConfig.Timeout, func(v time.Duration) { d.Client.Timeout = v }},
+	}
+	for _, duration := range durations {
+		if duration.value == "" {
+			continue
+		}
+		value, err := time.ParseDuration(duration.value)
+		if err != nil || value <= 0 {
+			return nil, fmt.Errorf("%s is not a valid duration: %s", duration.name, duration.value)
+		}
+		duration.set(value)
+	}
+
+	if webhookConfig.MaxAttempts > 0 {
+		d.MaxAttempts = webhookConfig.MaxAttempts
+	}
+	return d, nil
+}
+
+// Publish queues the event for a transaction with each subscriber that wants
+// it. It is used as the ledger's OnComplete, so errors are logged rather than
+// failing the payment.
+func (d *Dispatcher) Publish(txn *transaction.Transaction) {
+	event, ok := NewEvent(txn)
+	if !ok {
+		return
+	}
+
+	contextLogger := d.Log.WithFields(logrus.Fields{
+		"module":         "webhook",
+		"call":           "Publish",
+		"transaction_id": txn.ID,
+		"event":          event.Type,
+	})
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		contextLogger.Error(err)
+		return
+	}
+
+	queued := false
+	for _, s := range d.Subscribers {
+		if !s.Wants(event.Type) {
+			continue
+		}
+
+		id, err := shortid.Generate()
+		if err == nil {
+			err = d.Queue.Enqueue(&Delivery{
+				ID:        id,
+				URL:       s.URL,
+				EventType: event.Type,
+				Payload:   payload,
+			})
+		}
+		if err != nil {
+			contextLogger.Errorf("Unable to queue the event for %s: %s", s.URL, err)
+			continue
+		}
+		queued = true
+	}
+
+	if queued {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Start delivers the queued events in the background until Stop is called
+func (d *Dispatcher) Start() {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		ticker := time.NewTicker(d.Interval)
+		defer ticker.Stop()
+
+		for {
+			d.deliverDue()
+
+			select {
+			case <-ticker.C:
+			case <-d.wake:
+			case <-d.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop cancels the deliveries in progress and waits up to the context
+// deadline for the dispatcher to finish. Undelivered events stay queued.
+func (d *Dispatcher) Stop(ctx context.Context) error {
+	d.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deliverDue sends every delivery that is due
+func (d *Dispatcher) deliverDue() {
+	contextLogger := d.Log.WithFields(logrus.Fields{
+		"module": "webhook",
+		"call":   "deliverDue",
+	})
+
+	for d.ctx.Err() == nil {
+		deliveries, err := d.Queue.Due(time.Now(), batchSize)
+		if err != nil {
+			contextLogger.Error(err)
+			return
+		}
+
+		for _, delivery := range deliveries {
+			if d.ctx.Err() != nil {
+				return
+			}
+			d.attempt(delivery, contextLogger.WithField("delivery_id", delivery.ID))
+		}
+
+		if len(deliveries) < batchSize {
+			return
+		}
+	}
+}
+
+// attempt sends a delivery and records the outcome
+func (d *Dispatcher) attempt(delivery *Delivery, contextLogger *logrus.Entry) {
+	err := d.send(delivery)
+	if err != nil && d.ctx.Err() != nil {
+		// shutting down, the delivery stays due for the next start
+		return
+	}
+
+	delivery.Attempts++
+	switch {
+	case err == nil:
+		delivery.Status = DeliveryDelivered
+		delivery.LastError = ""
+	case delivery.Attempts >= d.MaxAttempts:
+		delivery.Status = DeliveryFailed
+		delivery.LastError = err.Error()
+		contextLogger.Errorf("Giving up on %s to %s after %d attempts: %s", delivery.EventType, delivery.URL, delivery.Attempts, err)
+	default:
+		delivery.LastError = err.Error()
+		delivery.NextAttempt = time.Now().Add(d.backoff(delivery.Attempts))
+		contextLogger.Warnf("Attempt %d of %d to %s failed, retrying at %s: %s", delivery.Attempts, d.MaxAttempts, delivery.URL, delivery.NextAttempt.Format(time.RFC3339), err)
+	}
+
+	if err = d.Queue.Update(delivery); err != nil {
+		contextLogger.Error(err)
+	}
+}
+
+// backoff returns the wait after a number of failed attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := d.Backoff
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	return wait
+}
+
+// send POSTs the signed event to the subscriber, any status other than 2xx is a failure
+func (d *Dispatcher) send(delivery *Delivery) error {
+	subscriber, ok := d.subscriber(delivery.URL)
+	if !ok {
+		return fmt.Errorf("%s is no longer a subscriber", delivery.URL)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(d.ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, delivery.EventType)
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	req.Header.Set(SignatureHeader, Sign(delivery.Payload, subscriber.Secret))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded with %s", delivery.URL, resp.Status)
+	}
+	return nil
+}
+
+func (d *Dispatcher) subscriber(url string) (Subscriber, bool) {
+	for _, s := range d.Subscribers {
+		if s.URL == url {
+			return s, true
+		}
+	}
+	return Subscriber{}, false
+}
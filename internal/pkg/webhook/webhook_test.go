@@ -0,0 +1,168 @@
+package webhook
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/oxipay/oxipay-vend/internal/pkg/config"
+	"github.com/oxipay/oxipay-vend/internal/pkg/database"
+	"github.com/oxipay/oxipay-vend/internal/pkg/migrate"
+	"github.com/oxipay/oxipay-vend/internal/pkg/oxipay"
+	"github.com/oxipay/oxipay-vend/internal/pkg/transaction"
+	"github.com/sirupsen/logrus"
+)
+
+func newQueue(t *testing.T) *Queue {
+	db, err := sql.Open(database.DriverSQLite, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: is a new database
+	db.SetMaxOpenConns(1)
+
+	migrator, err := migrate.NewMigrator(database.DriverSQLite, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	return NewQueue(database.DriverSQLite, db)
+}
+
+func approvedPayment() *transaction.Transaction {
+	return &transaction.Transaction{
+		ID:             "txn-1",
+		Type:           transaction.TypeAuthorisation,
+		SaleID:         "sale-1",
+		Origin:         "https://amtest.vendhq.com",
+		VendRegisterID: "register-1",
+		FxlSellerID:    "30188105",
+		PurchaseNumber: "52000001",
+		Amount:         4400,
+		Status:         oxipay.StatusApproved,
+		Code:           "SPRA01",
+		ModifiedDate:   time.Now(),
+	}
+}
+
+func TestNewEvent(t *testing.T) {
+	event, ok := NewEvent(approvedPayment())
+	if !ok || event.Type != "payment.approved" || event.Amount != 4400 {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	refund := approvedPayment()
+	refund.Type = transaction.TypeAdjustment
+	refund.Status = oxipay.StatusDeclined
+	if event, ok = NewEvent(refund); !ok || event.Type != "refund.declined" {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	for _, status := range []string{transaction.StatusPending, transaction.StatusUnknown, transaction.StatusError} {
+		txn := approvedPayment()
+		txn.Status = status
+		if _, ok = NewEvent(txn); ok {
+			t.Errorf("expected no event for %s", status)
+		}
+	}
+}
+
+func TestRetriedDelivery(t *testing.T) {
+	var requests int32
+	received := make(chan *http.Request, 1)
+	var body []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first delivery fails so that it has to be retried
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+		received <- r
+	}))
+	defer server.Close()
+
+	queue := newQueue(t)
+	dispatcher, err := FromConfig(config.WebhookConfig{
+		Subscribers: []config.SubscriberConfig{
+			{URL: server.URL, Secret: "finance-secret"},
+			{URL: server.URL + "/refunds", Secret: "other", Events: []string{"refund.approved"}},
+		},
+		Interval: "10ms",
+		Backoff:  "10ms",
+	}, queue, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatcher.Start()
+	defer dispatcher.Stop(context.Background())
+
+	dispatcher.Publish(approvedPayment())
+
+	select {
+	case r := <-received:
+		if r.Header.Get(SignatureHeader) != Sign(body, "finance-secret") {
+			t.Error("expected the body to be signed with the subscriber's secret")
+		}
+		if r.Header.Get(EventHeader) != "payment.approved" || r.URL.Path == "/refunds" {
+			t.Errorf("unexpected delivery of %s to %s", r.Header.Get(EventHeader), r.URL.Path)
+		}
+		event := new(Event)
+		if err = json.Unmarshal(body, event); err != nil || event.PurchaseNumber != "52000001" {
+			t.Errorf("unexpected event %s: %v", body, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the event was not delivered")
+	}
+
+	if requests != 2 {
+		t.Errorf("expected 2 attempts got %d", requests)
+	}
+}
+
+func TestFailedDelivery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	queue := newQueue(t)
+	dispatcher := NewDispatcher(queue, []Subscriber{{URL: server.URL, Secret: "finance-secret"}}, logrus.New())
+	dispatcher.Backoff = time.Millisecond
+	dispatcher.MaxAttempts = 2
+
+	dispatcher.Publish(approvedPayment())
+	dispatcher.deliverDue()
+	time.Sleep(5 * time.Millisecond)
+	dispatcher.deliverDue()
+
+	deliveries, err := queue.Due(time.Now().Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 0 {
+		t.Errorf("expected the delivery to be given up on, got %+v", deliveries[0])
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	dispatcher := NewDispatcher(nil, nil, logrus.New())
+	dispatcher.Backoff = time.Minute
+
+	if wait := dispatcher.backoff(3); wait != 4*time.Minute {
+		t.Errorf("expected 4m got %s", wait)
+	}
+	if wait := dispatcher.backoff(100); wait != maxBackoff {
+		t.Errorf("expected the backoff to be capped got %s", wait)
+	}
+}
@@ -1,7 +0,0 @@
--- Deploy vendproxy:create_db to mysql
-
-BEGIN;
-
--- XXX Add DDLs here.
-
-COMMIT;
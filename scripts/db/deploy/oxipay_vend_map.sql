@@ -1,7 +0,0 @@
--- Deploy vendproxy:oxipay_vend_map to mysql
-
-BEGIN;
-
--- XXX Add DDLs here.
-
-COMMIT;
@@ -1,7 +0,0 @@
--- Deploy vendproxy:sessions to mysql
-
-BEGIN;
-
--- XXX Add DDLs here.
-
-COMMIT;
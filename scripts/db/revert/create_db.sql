@@ -1,7 +0,0 @@
--- Revert vendproxy:create_db from mysql
-
-BEGIN;
-
--- XXX Add DDLs here.
-
-COMMIT;
@@ -1,7 +0,0 @@
--- Revert vendproxy:oxipay_vend_map from mysql
-
-BEGIN;
-
--- XXX Add DDLs here.
-
-COMMIT;
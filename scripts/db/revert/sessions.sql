@@ -1,7 +0,0 @@
--- Revert vendproxy:sessions from mysql
-
-BEGIN;
-
--- XXX Add DDLs here.
-
-COMMIT;
@@ -1,7 +0,0 @@
--- Verify vendproxy:create_db on mysql
-
-BEGIN;
-
--- XXX Add verifications here.
-
-ROLLBACK;
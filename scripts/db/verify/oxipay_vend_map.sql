@@ -1,7 +0,0 @@
--- Verify vendproxy:oxipay_vend_map on mysql
-
-BEGIN;
-
--- XXX Add verifications here.
-
-ROLLBACK;
@@ -1,7 +0,0 @@
--- Verify vendproxy:sessions on mysql
-
-BEGIN;
-
--- XXX Add verifications here.
-
-ROLLBACK;